@@ -0,0 +1,194 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned when the breaker rejects a call
+var ErrOpen = errors.New("circuit breaker is open")
+
+// State of the circuit breaker
+type State int
+
+const (
+	// Closed lets all calls through
+	Closed State = iota
+	// Open rejects all calls until OpenTimeout passes
+	Open
+	// HalfOpen lets a limited number of probe calls through to decide whether to close again
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 10 * time.Second
+	DefaultHalfOpenProbes   = 1
+)
+
+type Config struct {
+	// FailureThreshold is the number of consecutive failures which opens the breaker
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before probing
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of concurrent probes allowed in half-open state,
+	// the same number of successful probes closes the breaker
+	HalfOpenProbes int
+	// OnStateChange is called with the new state every time the state changes
+	OnStateChange func(state State)
+}
+
+// Breaker is a circuit breaker with half-open probing
+type Breaker struct {
+	mu               sync.Mutex
+	state            State
+	failures         int
+	openedAt         time.Time
+	probes           int
+	probeSuccesses   int
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenProbes   int
+	onStateChange    func(state State)
+	now              func() time.Time
+}
+
+// New creates a closed breaker, zero config values are replaced by defaults
+func New(config Config) *Breaker {
+	b := &Breaker{
+		failureThreshold: config.FailureThreshold,
+		openTimeout:      config.OpenTimeout,
+		halfOpenProbes:   config.HalfOpenProbes,
+		onStateChange:    config.OnStateChange,
+		now:              time.Now,
+	}
+	if b.failureThreshold <= 0 {
+		b.failureThreshold = DefaultFailureThreshold
+	}
+	if b.openTimeout <= 0 {
+		b.openTimeout = DefaultOpenTimeout
+	}
+	if b.halfOpenProbes <= 0 {
+		b.halfOpenProbes = DefaultHalfOpenProbes
+	}
+	return b
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.openTimeout {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Allow returns ErrOpen if the call must not be made, otherwise the caller
+// has to report the outcome with Success or Failure
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			return ErrOpen
+		}
+		b.setState(HalfOpen)
+		b.probes = 1
+		return nil
+	case HalfOpen:
+		if b.probes >= b.halfOpenProbes {
+			return ErrOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// Success reports a successful call
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case HalfOpen:
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.halfOpenProbes {
+			b.setState(Closed)
+		} else {
+			b.probes--
+		}
+	case Closed:
+		b.failures = 0
+	}
+}
+
+// Failure reports a failed call
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case HalfOpen:
+		b.trip()
+	case Closed:
+		b.failures++
+		if b.failures >= b.failureThreshold {
+			b.trip()
+		}
+	}
+}
+
+// Cancel reports a call which ended without an outcome, e.g. canceled by the caller,
+// a half-open probe slot taken by Allow is given back
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// Do runs fn if the breaker allows it and records its outcome
+func (b *Breaker) Do(fn func() error) error {
+	if err := b.Allow(); err != nil {
+		return err
+	}
+	err := fn()
+	if err != nil {
+		b.Failure()
+	} else {
+		b.Success()
+	}
+	return err
+}
+
+func (b *Breaker) trip() {
+	b.openedAt = b.now()
+	b.setState(Open)
+}
+
+func (b *Breaker) setState(state State) {
+	b.failures = 0
+	b.probes = 0
+	b.probeSuccesses = 0
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onStateChange != nil {
+		b.onStateChange(state)
+	}
+}
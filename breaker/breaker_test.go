@@ -0,0 +1,38 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakerStates(t *testing.T) {
+	now := time.Now()
+	b := New(Config{FailureThreshold: 2, OpenTimeout: time.Second, HalfOpenProbes: 1})
+	b.now = func() time.Time { return now }
+	fail := func() error { return errors.New("failed") }
+	ok := func() error { return nil }
+
+	assert.Error(t, b.Do(fail))
+	assert.Equal(t, Closed, b.State())
+	assert.Error(t, b.Do(fail))
+	assert.Equal(t, Open, b.State())
+	assert.ErrorIs(t, b.Do(ok), ErrOpen)
+
+	// after the open timeout a single probe is let through
+	now = now.Add(time.Second)
+	assert.NoError(t, b.Allow())
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+
+	// a canceled probe lets the next one through
+	now = now.Add(time.Second)
+	assert.NoError(t, b.Allow())
+	b.Cancel()
+	assert.Equal(t, HalfOpen, b.State())
+	assert.NoError(t, b.Do(ok))
+	assert.Equal(t, Closed, b.State())
+}
@@ -1,11 +1,14 @@
 package cache
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 
 	"os"
 	"path"
+	"sort"
 	"sync"
 	"time"
 
@@ -67,6 +70,8 @@ type CacheConfig struct {
 	WalSegmentSize    int64
 	WalMaxWithoutSync uint32
 	TickerDelay       time.Duration
+	WatchBufferSize   int
+	WatchHistorySize  int
 }
 
 // Cache struct to hold the channel, a counter, a mutex, a wait group, and a logger
@@ -74,7 +79,7 @@ type Cache struct {
 	signalChan chan int64
 	counter    int
 	mu         sync.Mutex
-	store      map[string][]byte
+	store      map[string]*pb.KeyValue
 	wal        *wal.WAL
 	cacheSize  int
 	walPath    string
@@ -82,6 +87,11 @@ type Cache struct {
 	logger     Logger
 	roCache    *LRUCache
 	walOptions wal.Options
+	watch      *watchHub
+	// versions keeps the versions of the keys flushed to the DB
+	versions *versionTable
+	// lastVersion is the last version assigned by this cache
+	lastVersion int64
 	// add new ticker
 	ticker *time.Ticker
 }
@@ -98,13 +108,14 @@ func NewCache(config *CacheConfig) *Cache {
 	}
 	cache := &Cache{
 		signalChan: make(chan int64, config.MaxSizeOfChannel),
-		store:      make(map[string][]byte),
+		store:      make(map[string]*pb.KeyValue),
 		cacheSize:  config.CacheSize,
 		walPath:    config.WalPath,
 		dbStorage:  config.DBStorage,
 		logger:     config.Logger,
 		roCache:    NewLRUCache(config.RoCacheSize),
 		walOptions: walOptions,
+		watch:      newWatchHub(config.WatchBufferSize, config.WatchHistorySize),
 	}
 	wal, err := wal.Open(walOptions)
 	if err != nil {
@@ -113,6 +124,13 @@ func NewCache(config *CacheConfig) *Cache {
 		return nil
 	}
 	cache.wal = wal
+	cache.versions, err = openVersionTable(path.Join(config.WalPath, VersionsName))
+	if err != nil {
+		dbErrors.Inc()
+		cache.logger.Println("Error opening version table:", err)
+		wal.Close()
+		return nil
+	}
 	err = cache.Recovery()
 	if err != nil {
 		walErrors.Inc()
@@ -158,23 +176,119 @@ func (c *Cache) SyncWAL() error {
 	return nil
 }
 
+// nextVersion returns a version newer than any version assigned by this cache and than the current version of key.
+// Versions are based on wall clock time so that writes coordinated by different nodes can be ordered.
+// It must be called with mu held.
+func (c *Cache) nextVersion(key string) int64 {
+	version := time.Now().UnixNano()
+	if version <= c.lastVersion {
+		version = c.lastVersion + 1
+	}
+	if cur := c.versionLocked(key); version <= cur {
+		version = cur + 1
+	}
+	c.lastVersion = version
+	return version
+}
+
+// storeLocked writes kv to the WAL and to the store, it must be called with mu held
+func (c *Cache) storeLocked(kv *pb.KeyValue) error {
+	data, err := proto.Marshal(kv)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if _, err := c.wal.Write(data); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	c.store[string(kv.Key)] = kv
+	c.roCache.Remove(string(kv.Key))
+	c.counter++
+	c.watch.publish(Event{Type: EventPut, Key: string(kv.Key), Value: kv.Value})
+
+	if c.counter >= c.cacheSize {
+		if err := c.SyncWAL(); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	return nil
+}
+
 // Store method to store a key-value pair in the cache
 func (c *Cache) Store(key, value []byte) error {
+	_, err := c.Put(key, value)
+	return err
+}
+
+// Put method stores a key-value pair under a new version and returns the version
+func (c *Cache) Put(key, value []byte) (int64, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	kv := &pb.KeyValue{
-		Key:   key,
-		Value: value,
+		Key:     key,
+		Value:   value,
+		Version: c.nextVersion(string(key)),
 	}
-	data, err := proto.Marshal(kv)
+	if err := c.storeLocked(kv); err != nil {
+		return 0, err
+	}
+	return kv.Version, nil
+}
+
+// StoreVersion method stores a key-value pair written with the given version on another node.
+// A write older than the version already held is ignored and false is returned.
+func (c *Cache) StoreVersion(key, value []byte, version int64) (bool, error) {
+	if version <= 0 {
+		_, err := c.Put(key, value)
+		return err == nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur := c.versionLocked(string(key)); cur >= version {
+		// the same write applied twice is not an error
+		return cur == version, nil
+	}
+	if version > c.lastVersion {
+		c.lastVersion = version
+	}
+	return true, c.storeLocked(&pb.KeyValue{Key: key, Value: value, Version: version})
+}
+
+// StoreBatch method to store many key-value pairs as one atomic WAL record,
+// after a crash either all or none of the entries are recovered.
+// Entries without a version get a new one assigned in place, entries older than the version already held are skipped.
+func (c *Cache) StoreBatch(kvs []*pb.KeyValue) error {
+	if len(kvs) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	batch := make([]*pb.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		if kv.Version <= 0 {
+			kv.Version = c.nextVersion(string(kv.Key))
+		} else if c.versionLocked(string(kv.Key)) >= kv.Version {
+			continue
+		} else if kv.Version > c.lastVersion {
+			c.lastVersion = kv.Version
+		}
+		batch = append(batch, kv)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	data, err := proto.Marshal(&pb.KeyValue{Batch: batch})
 	if err != nil {
 		return status.Error(codes.Internal, err.Error())
 	}
 	if _, err := c.wal.Write(data); err != nil {
 		return status.Error(codes.Internal, err.Error())
 	}
-	c.store[string(key)] = value
-	c.counter++
+	for _, kv := range batch {
+		c.store[string(kv.Key)] = kv
+		c.roCache.Remove(string(kv.Key))
+		c.watch.publish(Event{Type: EventPut, Key: string(kv.Key), Value: kv.Value})
+	}
+	c.counter += len(batch)
 
 	if c.counter >= c.cacheSize {
 		if err := c.SyncWAL(); err != nil {
@@ -184,6 +298,83 @@ func (c *Cache) Store(key, value []byte) error {
 	return nil
 }
 
+// CASCondition describes the current state of a key required by CompareAndStore
+type CASCondition struct {
+	// Absent requires the key not to exist
+	Absent bool
+	// Value, when not nil, has to be equal to the current value
+	Value []byte
+	// Version, when not 0, has to be equal to the current version
+	Version int64
+}
+
+// CASResult is the outcome of CompareAndStore, on conflict it holds the current value and version
+type CASResult struct {
+	Swapped bool
+	Found   bool
+	Value   []byte
+	Version int64
+}
+
+// CompareAndStore method stores the value under a new version only if the current state of the key,
+// read from the cache or from the DB on a miss, matches the condition
+func (c *Cache) CompareAndStore(key []byte, cond CASCondition, value []byte) (*CASResult, error) {
+	return c.CompareAndStoreVersion(key, cond, value, 0)
+}
+
+// CompareAndStoreVersion method is CompareAndStore storing the value with the given version. A version not newer
+// than the current one is replaced by the current version + 1, so nodes holding the same state and applying the
+// same writes assign the same versions. Version 0 assigns a new version like CompareAndStore.
+func (c *Cache) CompareAndStoreVersion(key []byte, cond CASCondition, value []byte, version int64) (*CASResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, currentVersion, err := c.getLocked(key)
+	found := err == nil
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+	matches := true
+	if cond.Absent {
+		matches = !found
+	}
+	if cond.Value != nil && (!found || !bytes.Equal(current, cond.Value)) {
+		matches = false
+	}
+	if cond.Version != 0 && (!found || currentVersion != cond.Version) {
+		matches = false
+	}
+	if !matches {
+		return &CASResult{Found: found, Value: current, Version: currentVersion}, nil
+	}
+	if version == 0 {
+		version = c.nextVersion(string(key))
+	} else {
+		if found && version <= currentVersion {
+			version = currentVersion + 1
+		}
+		if version > c.lastVersion {
+			c.lastVersion = version
+		}
+	}
+	kv := &pb.KeyValue{
+		Key:     key,
+		Value:   value,
+		Version: version,
+	}
+	if err := c.storeLocked(kv); err != nil {
+		return nil, err
+	}
+	return &CASResult{Swapped: true, Found: true, Value: value, Version: kv.Version}, nil
+}
+
+// walEntries returns the key-value pairs of a WAL record, batch records are flattened
+func walEntries(kv *pb.KeyValue) []*pb.KeyValue {
+	if len(kv.Batch) != 0 {
+		return kv.Batch
+	}
+	return []*pb.KeyValue{kv}
+}
+
 func (c *Cache) Recovery() error {
 	reader := c.wal.NewReader()
 	recoveryCounter := 0
@@ -200,8 +391,13 @@ func (c *Cache) Recovery() error {
 		if err := proto.Unmarshal(data, kv); err != nil {
 			return status.Error(codes.Internal, err.Error())
 		}
-		c.store[string(kv.Key)] = kv.Value
-		recoveryCounter++
+		for _, entry := range walEntries(kv) {
+			c.store[string(entry.Key)] = entry
+			if entry.Version > c.lastVersion {
+				c.lastVersion = entry.Version
+			}
+			recoveryCounter++
+		}
 	}
 	if recoveryCounter > 0 {
 		c.logger.Println("Recovered", recoveryCounter, "entries from WAL")
@@ -234,10 +430,14 @@ func (c *Cache) WaitForSignal() {
 				c.logger.Println("Error unmarshalling data:", err)
 				continue
 			}
-			pushToDb = append(pushToDb, kv)
+			pushToDb = append(pushToDb, walEntries(kv)...)
 		}
 		succeded := false
-		if err := c.dbStorage.Push(pushToDb); err != nil {
+		// the versions are saved first, a value in the DB always has its version
+		if err := c.versions.save(pushToDb); err != nil {
+			dbErrors.Inc()
+			c.logger.Println("Error saving versions:", err)
+		} else if err := c.dbStorage.Push(pushToDb); err != nil {
 			dbErrors.Inc()
 			c.logger.Println("Error pushing to DB:", err)
 		} else {
@@ -247,7 +447,10 @@ func (c *Cache) WaitForSignal() {
 		if succeded {
 			c.mu.Lock()
 			for _, kv := range pushToDb {
-				delete(c.store, string(kv.Key))
+				// keep entries overwritten after the WAL switch, they are flushed with the next WAL
+				if cur, ok := c.store[string(kv.Key)]; ok && cur.Version == kv.Version {
+					delete(c.store, string(kv.Key))
+				}
 			}
 			if err := wal.Delete(); err != nil {
 				walErrors.Inc()
@@ -262,28 +465,136 @@ func (c *Cache) WaitForSignal() {
 
 // Get method to get a value from the cache
 func (c *Cache) Get(key []byte) ([]byte, error) {
+	value, _, err := c.GetVersion(key)
+	return value, err
+}
+
+// GetVersion method to get a value and its version from the cache, values read from the DB have the
+// version they were flushed with, or 0 when they were written to the DB without one
+func (c *Cache) GetVersion(key []byte) ([]byte, int64, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if value, ok := c.store[string(key)]; ok {
+	return c.getLocked(key)
+}
+
+// getLocked must be called with mu held
+func (c *Cache) getLocked(key []byte) ([]byte, int64, error) {
+	if kv, ok := c.store[string(key)]; ok {
 		cacheHits.Inc()
-		return value, nil
+		return kv.Value, kv.Version, nil
 	}
 	// check if in RO
 	if value, ok := c.roCache.Get(string(key)); ok {
 		cacheHits.Inc()
-		return value, nil
+		return value, c.persistedVersion(string(key)), nil
 	}
 	cacheMisses.Inc()
 	value, err := c.dbStorage.Get(string(key))
 	if err != nil {
 		dbErrors.Inc()
-		return nil, err
+		return nil, 0, err
 	}
 	if value != nil || len(value) != 0 {
 		c.roCache.Put(string(key), value)
-		return value, nil
+		return value, c.persistedVersion(string(key)), nil
 	}
-	return nil, status.Error(codes.NotFound, "not found")
+	return nil, 0, status.Error(codes.NotFound, "not found")
+}
+
+// BatchGet method to get many values from the cache, keys missing in the cache are read from the DB in one call.
+// Keys which are not found are absent from the returned map.
+func (c *Cache) BatchGet(keys [][]byte) (map[string][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make(map[string][]byte, len(keys))
+	missing := []string{}
+	for _, key := range keys {
+		k := string(key)
+		if _, ok := values[k]; ok {
+			continue
+		}
+		if kv, ok := c.store[k]; ok {
+			cacheHits.Inc()
+			values[k] = kv.Value
+			continue
+		}
+		if value, ok := c.roCache.Get(k); ok {
+			cacheHits.Inc()
+			values[k] = value
+			continue
+		}
+		cacheMisses.Inc()
+		missing = append(missing, k)
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+	dbValues, err := db.MultiGet(c.dbStorage, missing)
+	if err != nil {
+		dbErrors.Inc()
+		return nil, err
+	}
+	for k, value := range dbValues {
+		if len(value) == 0 {
+			continue
+		}
+		c.roCache.Put(k, value)
+		values[k] = value
+	}
+	return values, nil
+}
+
+// Scan method returns up to limit key-value pairs in range [start, end) in key order, an empty end means no upper bound
+// and limit <= 0 means no limit. Entries not flushed to the DB yet take precedence over the DB content.
+func (c *Cache) Scan(start, end string, limit int) ([]*pb.KeyValue, error) {
+	c.mu.Lock()
+	pending := []*pb.KeyValue{}
+	versions := make(map[string]int64)
+	for k, kv := range c.store {
+		if db.InRange(k, start, end) {
+			pending = append(pending, &pb.KeyValue{Key: kv.Key, Value: kv.Value})
+			versions[k] = kv.Version
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(pending, func(i, j int) bool {
+		return string(pending[i].Key) < string(pending[j].Key)
+	})
+	its := []db.Iterator{db.NewSliceIterator(pending)}
+	backend, err := db.NewIterator(c.dbStorage, start, end)
+	if err != nil && !errors.Is(err, db.ErrScanNotSupported) {
+		dbErrors.Inc()
+		return nil, err
+	}
+	if err == nil {
+		its = append(its, backend)
+	}
+	it := db.MergeIterators(its...)
+	defer it.Close()
+	kvs := []*pb.KeyValue{}
+	for (limit <= 0 || len(kvs) < limit) && it.Next() {
+		version, ok := versions[it.Key()]
+		if !ok {
+			version = c.persistedVersion(it.Key())
+		}
+		kvs = append(kvs, &pb.KeyValue{Key: []byte(it.Key()), Value: it.Value(), Version: version})
+	}
+	if err := it.Err(); err != nil {
+		dbErrors.Inc()
+		return nil, err
+	}
+	return kvs, nil
+}
+
+// Watch method returns a watcher of key, or of all keys starting with key when prefix is set.
+// Events from startRevision (inclusive) are replayed if still kept in history, startRevision <= 0 watches only new changes.
+func (c *Cache) Watch(key string, prefix bool, startRevision int64) *Watcher {
+	return c.watch.watch(key, prefix, startRevision)
+}
+
+// Revision method returns the revision of the last change applied to the cache
+func (c *Cache) Revision() int64 {
+	return c.watch.currentRevision()
 }
 
 // CloseSignalChannel method to close the signal channel
@@ -292,4 +603,5 @@ func (c *Cache) CloseSignalChannel() {
 	close(c.signalChan)
 	c.wal.Sync()
 	c.wal.Close()
+	c.versions.close()
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/radek-ryckowski/ssdc/examples/db"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,3 +57,281 @@ func TestCachePersistence(t *testing.T) {
 		assert.Equal(t, expectedValue, value, "Expected value %s for key %s, but got %s", string(expectedValue), string(key), string(value))
 	}
 }
+
+func TestCacheBatchGet(t *testing.T) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	tempDir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := db.NewInMemoryDatabase()
+	storage.Push([]*pb.KeyValue{{Key: []byte("dbkey"), Value: []byte("dbvalue")}})
+	config := &CacheConfig{
+		CacheSize:         1000,
+		WalPath:           tempDir,
+		TickerDelay:       24 * time.Hour,
+		RoCacheSize:       65536,
+		MaxSizeOfChannel:  8192,
+		WalSegmentSize:    1024 * 1024 * 10,
+		Logger:            logger,
+		DBStorage:         storage,
+		WalMaxWithoutSync: 1,
+	}
+	cache := NewCache(config)
+	defer cache.CloseSignalChannel()
+	if err := cache.Store([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Error storing key-value pair: %v", err)
+	}
+
+	values, err := cache.BatchGet([][]byte{[]byte("key"), []byte("dbkey"), []byte("missing")})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"key": []byte("value"), "dbkey": []byte("dbvalue")}, values)
+}
+
+func TestCacheScanOverlaysStore(t *testing.T) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	tempDir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := db.NewInMemoryDatabase()
+	storage.Push([]*pb.KeyValue{
+		{Key: []byte("a/1"), Value: []byte("db1")},
+		{Key: []byte("a/2"), Value: []byte("db2")},
+		{Key: []byte("b/1"), Value: []byte("db3")},
+	})
+	config := &CacheConfig{
+		CacheSize:         1000,
+		WalPath:           tempDir,
+		TickerDelay:       24 * time.Hour,
+		RoCacheSize:       65536,
+		MaxSizeOfChannel:  8192,
+		WalSegmentSize:    1024 * 1024 * 10,
+		Logger:            logger,
+		DBStorage:         storage,
+		WalMaxWithoutSync: 1,
+	}
+	cache := NewCache(config)
+	defer cache.CloseSignalChannel()
+	for key, value := range map[string]string{"a/2": "new2", "a/3": "new3"} {
+		if err := cache.Store([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Error storing key-value pair: %v", err)
+		}
+	}
+
+	kvs, err := cache.Scan("a/", "a0", 0)
+	assert.NoError(t, err)
+	got := map[string]string{}
+	keys := []string{}
+	for _, kv := range kvs {
+		keys = append(keys, string(kv.Key))
+		got[string(kv.Key)] = string(kv.Value)
+	}
+	assert.Equal(t, []string{"a/1", "a/2", "a/3"}, keys)
+	assert.Equal(t, map[string]string{"a/1": "db1", "a/2": "new2", "a/3": "new3"}, got)
+
+	kvs, err = cache.Scan("a/2", "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, kvs, 2)
+	assert.Equal(t, "a/3", string(kvs[1].Key))
+}
+
+func TestCacheStoreBatchRecovery(t *testing.T) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	tempDir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := db.NewInMemoryDatabase()
+	config := &CacheConfig{
+		CacheSize:         1000,
+		WalPath:           tempDir,
+		TickerDelay:       24 * time.Hour,
+		RoCacheSize:       65536,
+		MaxSizeOfChannel:  8192,
+		WalSegmentSize:    1024 * 1024 * 10,
+		Logger:            logger,
+		DBStorage:         storage,
+		WalMaxWithoutSync: 1,
+	}
+	cache := NewCache(config)
+	batch := []*pb.KeyValue{}
+	for i := 0; i < 10; i++ {
+		batch = append(batch, &pb.KeyValue{Key: []byte(fmt.Sprintf("key%d", i)), Value: []byte(fmt.Sprintf("value%d", i))})
+	}
+	if err := cache.StoreBatch(batch); err != nil {
+		t.Fatalf("Error storing batch: %v", err)
+	}
+	cache.CloseSignalChannel()
+
+	newCache := NewCache(config)
+	defer newCache.CloseSignalChannel()
+	for _, kv := range batch {
+		value, err := newCache.Get(kv.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, kv.Value, value)
+	}
+
+	// flushing a batch pushes its entries to the DB one by one
+	go newCache.WaitForSignal()
+	assert.NoError(t, newCache.SyncWAL())
+	assert.Eventually(t, func() bool {
+		value, _ := storage.Get("key9")
+		return string(value) == "value9"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCacheCompareAndStore(t *testing.T) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	tempDir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	storage := db.NewInMemoryDatabase()
+	storage.Push([]*pb.KeyValue{{Key: []byte("dbkey"), Value: []byte("dbvalue")}})
+	config := &CacheConfig{
+		CacheSize:         1000,
+		WalPath:           tempDir,
+		TickerDelay:       24 * time.Hour,
+		RoCacheSize:       65536,
+		MaxSizeOfChannel:  8192,
+		WalSegmentSize:    1024 * 1024 * 10,
+		Logger:            logger,
+		DBStorage:         storage,
+		WalMaxWithoutSync: 1,
+	}
+	cache := NewCache(config)
+	defer cache.CloseSignalChannel()
+
+	result, err := cache.CompareAndStore([]byte("key"), CASCondition{Absent: true}, []byte("v1"))
+	assert.NoError(t, err)
+	assert.True(t, result.Swapped)
+	version := result.Version
+
+	// create only fails once the key exists and returns the current value
+	result, err = cache.CompareAndStore([]byte("key"), CASCondition{Absent: true}, []byte("v2"))
+	assert.NoError(t, err)
+	assert.False(t, result.Swapped)
+	assert.Equal(t, []byte("v1"), result.Value)
+	assert.Equal(t, version, result.Version)
+
+	result, err = cache.CompareAndStore([]byte("key"), CASCondition{Version: version}, []byte("v2"))
+	assert.NoError(t, err)
+	assert.True(t, result.Swapped)
+	assert.Greater(t, result.Version, version)
+
+	result, err = cache.CompareAndStore([]byte("key"), CASCondition{Version: version}, []byte("v3"))
+	assert.NoError(t, err)
+	assert.False(t, result.Swapped)
+	assert.Equal(t, []byte("v2"), result.Value)
+
+	// values found only in the DB are compared too
+	result, err = cache.CompareAndStore([]byte("dbkey"), CASCondition{Value: []byte("dbvalue")}, []byte("new"))
+	assert.NoError(t, err)
+	assert.True(t, result.Swapped)
+	value, err := cache.Get([]byte("dbkey"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+
+	// replicated writes older than the stored version are ignored
+	applied, err := cache.StoreVersion([]byte("key"), []byte("old"), version)
+	assert.NoError(t, err)
+	assert.False(t, applied)
+	value, err = cache.Get([]byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+
+	// a given version is used unless it is not newer than the current one
+	result, err = cache.CompareAndStoreVersion([]byte("versioned"), CASCondition{}, []byte("v1"), 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), result.Version)
+	result, err = cache.CompareAndStoreVersion([]byte("versioned"), CASCondition{Version: 100}, []byte("v2"), 50)
+	assert.NoError(t, err)
+	assert.True(t, result.Swapped)
+	assert.Equal(t, int64(101), result.Version)
+}
+
+func TestCacheVersionsSurviveFlush(t *testing.T) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	tempDir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	config := &CacheConfig{
+		CacheSize:         1000,
+		WalPath:           tempDir,
+		TickerDelay:       24 * time.Hour,
+		RoCacheSize:       65536,
+		MaxSizeOfChannel:  8192,
+		WalSegmentSize:    1024 * 1024 * 10,
+		Logger:            logger,
+		DBStorage:         db.NewInMemoryDatabase(),
+		WalMaxWithoutSync: 1,
+	}
+	cache := NewCache(config)
+	version, err := cache.Put([]byte("key"), []byte("v1"))
+	assert.NoError(t, err)
+	go cache.WaitForSignal()
+	assert.NoError(t, cache.SyncWAL())
+	assert.Eventually(t, func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		_, ok := cache.store["key"]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+
+	// the flushed key keeps its version
+	value, flushed, err := cache.GetVersion([]byte("key"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), value)
+	assert.Equal(t, version, flushed)
+
+	// an older replicated write does not overwrite the flushed value
+	applied, err := cache.StoreVersion([]byte("key"), []byte("old"), version-1)
+	assert.NoError(t, err)
+	assert.False(t, applied)
+
+	result, err := cache.CompareAndStore([]byte("key"), CASCondition{Version: version}, []byte("v2"))
+	assert.NoError(t, err)
+	assert.True(t, result.Swapped)
+	assert.Greater(t, result.Version, version)
+
+	// a version proposed through the Raft log is bumped from the flushed version like from a held one,
+	// so members which flushed the key and members which did not assign the same version
+	_, err = cache.Put([]byte("raft"), []byte("v1"))
+	assert.NoError(t, err)
+	assert.NoError(t, cache.SyncWAL())
+	assert.Eventually(t, func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		_, ok := cache.store["raft"]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	_, raftVersion, err := cache.GetVersion([]byte("raft"))
+	assert.NoError(t, err)
+	swapped, err := cache.CompareAndStoreVersion([]byte("raft"), CASCondition{Version: raftVersion}, []byte("v2"), raftVersion)
+	assert.NoError(t, err)
+	assert.True(t, swapped.Swapped)
+	assert.Equal(t, raftVersion+1, swapped.Version)
+	cache.CloseSignalChannel()
+
+	// the versions are kept across restarts
+	cache = NewCache(config)
+	defer cache.CloseSignalChannel()
+	kvs, err := cache.Scan("", "", 0)
+	assert.NoError(t, err)
+	if assert.Len(t, kvs, 2) {
+		assert.Equal(t, result.Version, kvs[0].Version)
+		assert.Equal(t, swapped.Version, kvs[1].Version)
+	}
+}
@@ -45,3 +45,10 @@ func (c *LRUCache) Put(key string, value []byte) {
 		c.cache[key] = elem
 	}
 }
+
+func (c *LRUCache) Remove(key string) {
+	if elem, ok := c.cache[key]; ok {
+		delete(c.cache, key)
+		c.list.Remove(elem)
+	}
+}
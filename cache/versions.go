@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// VersionsName is the name of the directory next to the WAL keeping the versions of the flushed keys
+const VersionsName = "versions"
+
+// versionTable keeps the version of every key flushed to the DB, the DB stores the values only. A key
+// leaving the store keeps its version so that newer writes, conditions and replicas compare against it.
+type versionTable struct {
+	db *leveldb.DB
+}
+
+func openVersionTable(path string) (*versionTable, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &versionTable{db: db}, nil
+}
+
+// get returns the version the key was flushed with, 0 when the key was never flushed with a version
+func (t *versionTable) get(key string) (int64, error) {
+	data, err := t.db.Get([]byte(key), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil || len(data) != 8 {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
+
+// save records the versions of the entries about to be flushed
+func (t *versionTable) save(kvs []*pb.KeyValue) error {
+	batch := new(leveldb.Batch)
+	for _, kv := range kvs {
+		if kv.Version > 0 {
+			batch.Put(kv.Key, binary.BigEndian.AppendUint64(nil, uint64(kv.Version)))
+		}
+	}
+	return t.db.Write(batch, nil)
+}
+
+func (t *versionTable) close() error {
+	return t.db.Close()
+}
+
+// versionLocked returns the current version of the key held in the store or persisted with its flushed
+// value, 0 when the key has none. It must be called with mu held.
+func (c *Cache) versionLocked(key string) int64 {
+	if kv, ok := c.store[key]; ok {
+		return kv.Version
+	}
+	return c.persistedVersion(key)
+}
+
+// persistedVersion returns the version of a flushed key, 0 when it is unknown
+func (c *Cache) persistedVersion(key string) int64 {
+	version, err := c.versions.get(key)
+	if err != nil {
+		dbErrors.Inc()
+		c.logger.Println("Error reading version:", err)
+	}
+	return version
+}
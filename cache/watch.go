@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultWatchBufferSize is the number of events buffered per watcher before it has to resync
+	DefaultWatchBufferSize = 256
+	// DefaultWatchHistorySize is the number of past events kept for watchers resuming from a revision
+	DefaultWatchHistorySize = 4096
+)
+
+var (
+	watchersActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cache_watchers",
+		Help: "Number of active watchers",
+	})
+
+	watchResyncs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cache_watch_resyncs_total",
+		Help: "Total number of watchers which had to resync because they fell behind",
+	})
+)
+
+// EventType of a change applied to the cache
+type EventType int
+
+const (
+	EventPut EventType = iota
+	// EventDelete is not published yet, there is no operation deleting a key
+	EventDelete
+)
+
+// Event describes a change of a single key
+type Event struct {
+	Type     EventType
+	Key      string
+	Value    []byte
+	Revision int64
+}
+
+// Watcher receives events of keys it watches on Events. The channel is closed when the watcher
+// is closed or when it fell behind, in the latter case ResyncRequired returns true.
+type Watcher struct {
+	Events <-chan Event
+	events chan Event
+	key    string
+	prefix bool
+	hub    *watchHub
+	resync bool
+	closed bool
+}
+
+func (w *Watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// ResyncRequired reports whether events were lost and the client has to re-read the watched keys.
+// It is valid after Events is closed.
+func (w *Watcher) ResyncRequired() bool {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.resync
+}
+
+// Close stops the watcher and closes Events
+func (w *Watcher) Close() {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	w.hub.remove(w)
+}
+
+// watchHub fans events out to watchers and keeps a bounded history for resuming watchers
+type watchHub struct {
+	mu         sync.Mutex
+	revision   int64
+	history    []Event
+	historyPos int
+	watchers   map[*Watcher]struct{}
+	bufferSize int
+}
+
+func newWatchHub(bufferSize, historySize int) *watchHub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultWatchBufferSize
+	}
+	if historySize <= 0 {
+		historySize = DefaultWatchHistorySize
+	}
+	return &watchHub{
+		history:    make([]Event, 0, historySize),
+		watchers:   make(map[*Watcher]struct{}),
+		bufferSize: bufferSize,
+	}
+}
+
+// remove must be called with mu held
+func (h *watchHub) remove(w *Watcher) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	delete(h.watchers, w)
+	close(w.events)
+	watchersActive.Dec()
+}
+
+// send delivers an event without blocking, a watcher with a full buffer is dropped and marked for resync.
+// It must be called with mu held.
+func (h *watchHub) send(w *Watcher, ev Event) {
+	select {
+	case w.events <- ev:
+	default:
+		w.resync = true
+		watchResyncs.Inc()
+		h.remove(w)
+	}
+}
+
+// publish assigns the next revision to the event and delivers it to matching watchers
+func (h *watchHub) publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.revision++
+	ev.Revision = h.revision
+	if len(h.history) < cap(h.history) {
+		h.history = append(h.history, ev)
+	} else {
+		h.history[h.historyPos] = ev
+		h.historyPos = (h.historyPos + 1) % len(h.history)
+	}
+	for w := range h.watchers {
+		if w.matches(ev.Key) {
+			h.send(w, ev)
+		}
+	}
+}
+
+// oldestRevision returns the revision of the oldest event in history, must be called with mu held
+func (h *watchHub) oldestRevision() int64 {
+	if len(h.history) == 0 {
+		return h.revision + 1
+	}
+	return h.history[h.historyPos].Revision
+}
+
+// watch registers a watcher, events from startRevision (inclusive) are replayed from history first.
+// startRevision <= 0 watches only new events. If the requested revision is not available anymore
+// the returned watcher is already closed with ResyncRequired set.
+func (h *watchHub) watch(key string, prefix bool, startRevision int64) *Watcher {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := make(chan Event, h.bufferSize)
+	w := &Watcher{Events: events, events: events, key: key, prefix: prefix, hub: h}
+	h.watchers[w] = struct{}{}
+	watchersActive.Inc()
+	if startRevision <= 0 || startRevision > h.revision {
+		// a revision from the future means the node restarted and its revisions started over
+		if startRevision > h.revision+1 {
+			w.resync = true
+			h.remove(w)
+		}
+		return w
+	}
+	if startRevision < h.oldestRevision() {
+		w.resync = true
+		h.remove(w)
+		return w
+	}
+	for i := 0; i < len(h.history) && !w.closed; i++ {
+		ev := h.history[(h.historyPos+i)%len(h.history)]
+		if ev.Revision >= startRevision && w.matches(ev.Key) {
+			h.send(w, ev)
+		}
+	}
+	return w
+}
+
+// currentRevision returns the revision of the last published event
+func (h *watchHub) currentRevision() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.revision
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchHub(t *testing.T) {
+	h := newWatchHub(2, 4)
+	w := h.watch("a/", true, 0)
+	h.publish(Event{Key: "a/1", Value: []byte("1")})
+	h.publish(Event{Key: "b/1", Value: []byte("2")})
+	ev := <-w.Events
+	assert.Equal(t, "a/1", ev.Key)
+	assert.Equal(t, int64(1), ev.Revision)
+
+	// resuming replays matching events kept in history
+	h.publish(Event{Key: "a/2", Value: []byte("3")})
+	resumed := h.watch("a/2", false, 2)
+	ev = <-resumed.Events
+	assert.Equal(t, int64(3), ev.Revision)
+	resumed.Close()
+	_, ok := <-resumed.Events
+	assert.False(t, ok)
+	assert.False(t, resumed.ResyncRequired())
+
+	// a slow consumer is dropped and has to resync
+	for i := 0; i < 3; i++ {
+		h.publish(Event{Key: fmt.Sprintf("a/%d", i)})
+	}
+	for range w.Events {
+	}
+	assert.True(t, w.ResyncRequired())
+
+	// revisions no longer in history and from the future require a resync
+	old := h.watch("a/", true, 1)
+	assert.True(t, old.ResyncRequired())
+	future := h.watch("a/", true, 100)
+	assert.True(t, future.ResyncRequired())
+}
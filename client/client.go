@@ -0,0 +1,241 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/radek-ryckowski/ssdc/breaker"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// DefaultMaxAttempts is the default number of nodes an idempotent call is tried on
+const DefaultMaxAttempts = 3
+
+// ErrNoAddresses is returned by New without any node to connect to
+var ErrNoAddresses = errors.New("no node addresses")
+
+// Config configures a Client, zero values use the defaults
+type Config struct {
+	// Addresses of the nodes of the cluster, calls are balanced across all of them
+	Addresses []string
+	// DialOptions are passed to every connection, the default is an insecure connection
+	DialOptions []grpc.DialOption
+	// Consistency is used by requests which do not set a consistency nor the legacy local and quorum fields
+	Consistency pb.Consistency
+	// MaxAttempts is the number of nodes a read is tried on when the previous node could not answer,
+	// 1 disables retries. Writes are sent once, a retried write would get a new version and could
+	// overwrite a newer write of another client.
+	MaxAttempts int
+	// HedgeDelay starts a read on the next node when the previous one did not answer within it, the
+	// first answer wins and the other calls are canceled. Hedged reads count against MaxAttempts, 0
+	// disables hedging.
+	HedgeDelay time.Duration
+	// Guard protects the calls to every node, a node whose circuit is open is tried last
+	Guard cluster.GuardConfig
+}
+
+// node is a connection to one node of the cluster
+type node struct {
+	conn    *grpc.ClientConn
+	guard   *cluster.Guard
+	service pb.CacheServiceClient
+}
+
+// Client is a cluster-aware CacheService client, it balances calls across the nodes round-robin
+type Client struct {
+	nodes       []*node
+	next        atomic.Uint64
+	consistency pb.Consistency
+	maxAttempts int
+	hedgeDelay  time.Duration
+}
+
+// New connects to the nodes of the config, connections are established lazily by the first call
+func New(config Config) (*Client, error) {
+	if len(config.Addresses) == 0 {
+		return nil, ErrNoAddresses
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultMaxAttempts
+	}
+	if len(config.DialOptions) == 0 {
+		config.DialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	c := &Client{
+		consistency: config.Consistency,
+		maxAttempts: config.MaxAttempts,
+		hedgeDelay:  config.HedgeDelay,
+	}
+	for _, address := range config.Addresses {
+		conn, err := grpc.NewClient(address, config.DialOptions...)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		guard := cluster.NewGuard(conn, config.Guard)
+		c.nodes = append(c.nodes, &node{conn: conn, guard: guard, service: pb.NewCacheServiceClient(guard)})
+	}
+	return c, nil
+}
+
+// Close closes the connections to all nodes
+func (c *Client) Close() error {
+	var errs []error
+	for _, n := range c.nodes {
+		errs = append(errs, n.conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Get reads a key, it is retried and hedged on other nodes
+func (c *Client) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	if req.Consistency == pb.Consistency_CONSISTENCY_UNSPECIFIED && !req.Local {
+		req = proto.Clone(req).(*pb.GetRequest)
+		req.Consistency = c.consistency
+	}
+	return read(ctx, c, func(ctx context.Context, service pb.CacheServiceClient) (*pb.GetResponse, error) {
+		return service.Get(ctx, req)
+	})
+}
+
+// BatchGet reads several keys, it is retried and hedged on other nodes
+func (c *Client) BatchGet(ctx context.Context, req *pb.BatchGetRequest) (*pb.BatchGetResponse, error) {
+	return read(ctx, c, func(ctx context.Context, service pb.CacheServiceClient) (*pb.BatchGetResponse, error) {
+		return service.BatchGet(ctx, req)
+	})
+}
+
+// Set writes a key on the next node
+func (c *Client) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+	if req.Consistency == pb.Consistency_CONSISTENCY_UNSPECIFIED && !req.Local && req.Quorum == 0 {
+		req = proto.Clone(req).(*pb.SetRequest)
+		req.Consistency = c.consistency
+	}
+	return c.order()[0].service.Set(ctx, req)
+}
+
+// CompareAndSet conditionally writes a key on the next node
+func (c *Client) CompareAndSet(ctx context.Context, req *pb.CompareAndSetRequest) (*pb.CompareAndSetResponse, error) {
+	return c.order()[0].service.CompareAndSet(ctx, req)
+}
+
+// BatchSet writes several keys on the next node
+func (c *Client) BatchSet(ctx context.Context, req *pb.BatchSetRequest) (*pb.BatchSetResponse, error) {
+	return c.order()[0].service.BatchSet(ctx, req)
+}
+
+// order returns the nodes starting with the next one round-robin, nodes whose circuit is open come last
+func (c *Client) order() []*node {
+	start := int(c.next.Add(1)-1) % len(c.nodes)
+	nodes := make([]*node, 0, len(c.nodes))
+	nodes = append(nodes, c.nodes[start:]...)
+	nodes = append(nodes, c.nodes[:start]...)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].guard.State() != breaker.Open && nodes[j].guard.State() == breaker.Open
+	})
+	return nodes
+}
+
+// retryable tells whether another node may answer a read which failed with err
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+type result[R any] struct {
+	resp R
+	err  error
+}
+
+// read makes an idempotent call, it moves on to the next node when a node fails with a retryable
+// error or, with hedging, does not answer within the hedge delay, the first answer wins
+func read[R any](ctx context.Context, c *Client, call func(context.Context, pb.CacheServiceClient) (R, error)) (R, error) {
+	callCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	nodes := c.order()
+	results := make(chan result[R], c.maxAttempts)
+	attempts, pending := 0, 0
+	launch := func() {
+		service := nodes[attempts%len(nodes)].service
+		attempts++
+		pending++
+		go func() {
+			resp, err := call(callCtx, service)
+			results <- result[R]{resp, err}
+		}()
+	}
+
+	// without hedging the channel stays nil and the next node is tried only after a failure
+	var hedge <-chan time.Time
+	var timer *time.Timer
+	if c.hedgeDelay > 0 {
+		timer = time.NewTimer(c.hedgeDelay)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+	launch()
+	for {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil || !retryable(ctx, res.err) {
+				return res.resp, res.err
+			}
+			if attempts < c.maxAttempts {
+				launch()
+				if timer != nil {
+					timer.Reset(c.hedgeDelay)
+				}
+			} else if pending == 0 {
+				return res.resp, res.err
+			}
+		case <-hedge:
+			if attempts < c.maxAttempts {
+				launch()
+				timer.Reset(c.hedgeDelay)
+			}
+		}
+	}
+}
+
+// Get reads a key and unmarshals its value into a new T, found is false when the key does not exist
+func Get[T proto.Message](ctx context.Context, c *Client, key string) (value T, found bool, err error) {
+	resp, err := c.Get(ctx, &pb.GetRequest{Uuid: key})
+	if err != nil || !resp.Found {
+		return value, false, err
+	}
+	value = value.ProtoReflect().New().Interface().(T)
+	if err := resp.Value.UnmarshalTo(value); err != nil {
+		return value, false, err
+	}
+	return value, true, nil
+}
+
+// Set wraps the value into an Any and writes it under the key, it returns the version of the value
+func Set(ctx context.Context, c *Client, key string, value proto.Message) (int64, error) {
+	data, err := anypb.New(value)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.Set(ctx, &pb.SetRequest{Uuid: key, Value: data})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Version, nil
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fakeNode keeps the values in memory, fail makes its calls fail and delay slows its reads down
+type fakeNode struct {
+	pb.UnimplementedCacheServiceServer
+	mu     sync.Mutex
+	values map[string]*anypb.Any
+	gets   atomic.Int32
+	sets   atomic.Int32
+	fail   atomic.Bool
+	delay  time.Duration
+	last   *pb.GetRequest
+}
+
+func (f *fakeNode) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	f.gets.Add(1)
+	if f.fail.Load() {
+		return nil, status.Error(codes.Unavailable, "node is down")
+	}
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = req
+	value, ok := f.values[req.Uuid]
+	return &pb.GetResponse{Value: value, Found: ok, Version: 1}, nil
+}
+
+func (f *fakeNode) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+	f.sets.Add(1)
+	if f.fail.Load() {
+		return nil, status.Error(codes.Unavailable, "node is down")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[req.Uuid] = req.Value
+	return &pb.SetResponse{Success: true, Version: 1}, nil
+}
+
+// newTestClient serves the nodes over in-memory listeners and connects a client to them
+func newTestClient(t *testing.T, config Config, nodes ...*fakeNode) *Client {
+	listeners := map[string]*bufconn.Listener{}
+	for i, n := range nodes {
+		if n.values == nil {
+			n.values = map[string]*anypb.Any{}
+		}
+		lis := bufconn.Listen(1024 * 1024)
+		gs := grpc.NewServer()
+		pb.RegisterCacheServiceServer(gs, n)
+		go gs.Serve(lis)
+		t.Cleanup(gs.Stop)
+		address := string(rune('a' + i))
+		listeners[address] = lis
+		config.Addresses = append(config.Addresses, "passthrough:///"+address)
+	}
+	config.DialOptions = []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return listeners[address].DialContext(ctx)
+		}),
+	}
+	c, err := New(config)
+	assert.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestNewWithoutAddresses(t *testing.T) {
+	_, err := New(Config{})
+	assert.ErrorIs(t, err, ErrNoAddresses)
+}
+
+func TestBalancesAcrossNodes(t *testing.T) {
+	nodes := []*fakeNode{{}, {}, {}}
+	c := newTestClient(t, Config{Consistency: pb.Consistency_QUORUM}, nodes...)
+	for i := 0; i < 6; i++ {
+		_, err := c.Get(context.Background(), &pb.GetRequest{Uuid: "key"})
+		assert.NoError(t, err)
+	}
+	for _, n := range nodes {
+		assert.Equal(t, int32(2), n.gets.Load())
+	}
+	// the configured consistency fills in requests which do not choose one
+	assert.Equal(t, pb.Consistency_QUORUM, nodes[0].last.Consistency)
+	_, err := c.Get(context.Background(), &pb.GetRequest{Uuid: "key", Local: true})
+	assert.NoError(t, err)
+	assert.Equal(t, pb.Consistency_CONSISTENCY_UNSPECIFIED, nodes[0].last.Consistency)
+}
+
+func TestRetriesReadsOnAnotherNode(t *testing.T) {
+	down, up := &fakeNode{}, &fakeNode{}
+	down.fail.Store(true)
+	c := newTestClient(t, Config{}, down, up)
+	for i := 0; i < 4; i++ {
+		_, err := c.Get(context.Background(), &pb.GetRequest{Uuid: "key"})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(4), up.gets.Load())
+
+	// writes are not retried, half of them reach the failing node
+	failed := 0
+	for i := 0; i < 4; i++ {
+		if _, err := c.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: &anypb.Any{}}); err != nil {
+			assert.Equal(t, codes.Unavailable, status.Code(err))
+			failed++
+		}
+	}
+	assert.Equal(t, 2, failed)
+
+	// with a single attempt the error of the node is returned
+	c = newTestClient(t, Config{MaxAttempts: 1}, down, up)
+	_, err := c.Get(context.Background(), &pb.GetRequest{Uuid: "key"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestHedgedRead(t *testing.T) {
+	slow, fast := &fakeNode{delay: time.Second}, &fakeNode{}
+	c := newTestClient(t, Config{HedgeDelay: 20 * time.Millisecond}, slow, fast)
+	start := time.Now()
+	_, err := c.Get(context.Background(), &pb.GetRequest{Uuid: "key"})
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, int32(1), slow.gets.Load())
+	assert.Equal(t, int32(1), fast.gets.Load())
+
+	// a node answering within the delay is not hedged
+	_, err = c.Get(context.Background(), &pb.GetRequest{Uuid: "key"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), slow.gets.Load())
+	assert.Equal(t, int32(2), fast.gets.Load())
+}
+
+func TestTypedHelpers(t *testing.T) {
+	c := newTestClient(t, Config{}, &fakeNode{})
+	version, err := Set(context.Background(), c, "key", wrapperspb.String("value"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), version)
+
+	value, found, err := Get[*wrapperspb.StringValue](context.Background(), c, "key")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "value", value.GetValue())
+
+	_, found, err = Get[*wrapperspb.StringValue](context.Background(), c, "missing")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// a value of another type is an error
+	_, _, err = Get[*wrapperspb.Int64Value](context.Background(), c, "key")
+	assert.Error(t, err)
+}
@@ -2,17 +2,34 @@ package cluster
 
 import (
 	"sync"
+	"time"
 
 	pb "github.com/radek-ryckowski/ssdc/proto/cache"
 	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type CacheClient struct {
-	ServiceClient pb.CacheServiceClient
-	Node          int
-	Address       string
-	Active        bool
-	Conn          *grpc.ClientConn
+	ServiceClient     pb.CacheServiceClient
+	HealthClient      healthpb.HealthClient
+	AntiEntropyClient pb.AntiEntropyServiceClient
+	NodeClient        pb.NodeServiceClient
+	// Guard carries every call but the health checks, it fails fast while the peer cannot answer
+	Guard *Guard
+	// GuardConfig configures the Guard created by Init
+	GuardConfig GuardConfig
+	// Node is the persistent id of the peer, empty until it is identified
+	Node    string
+	Address string
+	Active  bool
+	Conn    *grpc.ClientConn
+	// Latency is the round trip of the last successful health check
+	Latency time.Duration
+	// LastSuccess and LastFailure are the times of the last health check with that outcome
+	LastSuccess time.Time
+	LastFailure time.Time
+	// ConsecutiveFailures counts the failed health checks since the last successful one
+	ConsecutiveFailures int
 	sync.RWMutex
 	Connect func(address string) (*grpc.ClientConn, error)
 }
@@ -24,6 +41,35 @@ func (c *CacheClient) Init() error {
 		return err
 	}
 	c.Conn = conn
-	c.ServiceClient = pb.NewCacheServiceClient(conn)
+	c.Guard = NewGuard(conn, c.GuardConfig)
+	c.ServiceClient = pb.NewCacheServiceClient(c.Guard)
+	// health checks bypass the guard, they tell when the peer is back
+	c.HealthClient = healthpb.NewHealthClient(conn)
+	c.AntiEntropyClient = pb.NewAntiEntropyServiceClient(c.Guard)
+	c.NodeClient = pb.NewNodeServiceClient(c.Guard)
 	return nil
 }
+
+// ID returns the node id of the peer or its address while the id is unknown,
+// it must be called with the lock held
+func (c *CacheClient) ID() string {
+	if c.Node != "" {
+		return c.Node
+	}
+	return c.Address
+}
+
+// RecordSuccess marks the peer active after a successful health check, it must be called with the lock held
+func (c *CacheClient) RecordSuccess(latency time.Duration) {
+	c.Active = true
+	c.Latency = latency
+	c.LastSuccess = time.Now()
+	c.ConsecutiveFailures = 0
+}
+
+// RecordFailure marks the peer inactive after a failed health check, it must be called with the lock held
+func (c *CacheClient) RecordFailure() {
+	c.Active = false
+	c.LastFailure = time.Now()
+	c.ConsecutiveFailures++
+}
@@ -0,0 +1,182 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/radek-ryckowski/ssdc/breaker"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultMaxInFlight is the default number of concurrent calls to one peer
+	DefaultMaxInFlight = 256
+	// DefaultMinCallTimeout and DefaultMaxCallTimeout bound the timeouts derived from the observed latency
+	DefaultMinCallTimeout = 100 * time.Millisecond
+	DefaultMaxCallTimeout = 5 * time.Second
+)
+
+var (
+	// ErrCircuitOpen is returned without calling a peer which kept failing
+	ErrCircuitOpen = status.Error(codes.Unavailable, "circuit breaker of the peer is open")
+	// ErrOverloaded is returned without calling a peer which has too many calls in flight
+	ErrOverloaded = status.Error(codes.ResourceExhausted, "too many calls in flight to the peer")
+)
+
+// GuardConfig configures the protection of the calls to a peer, zero values use the defaults
+type GuardConfig struct {
+	// Breaker opens after consecutive failed calls and probes the peer again once its OpenTimeout passed
+	Breaker breaker.Config
+	// MaxInFlight bounds the concurrent unary calls, calls above it fail immediately
+	MaxInFlight int
+	// MinTimeout and MaxTimeout bound the timeout of a unary call, which follows the observed latency of the method
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+}
+
+// latency is a smoothed round trip and its variation as in RFC 6298
+type latency struct {
+	mean time.Duration
+	dev  time.Duration
+}
+
+// Guard is a connection to a peer which fails fast instead of waiting for a peer that cannot answer. Unary
+// calls pass a circuit breaker and a bound of calls in flight, and time out after a multiple of the latency
+// observed for the method unless the caller's deadline is shorter. Streams pass the breaker only.
+type Guard struct {
+	conn       grpc.ClientConnInterface
+	breaker    *breaker.Breaker
+	inFlight   chan struct{}
+	minTimeout time.Duration
+	maxTimeout time.Duration
+	mu         sync.Mutex
+	latency    map[string]*latency
+}
+
+// NewGuard wraps the connection to a peer
+func NewGuard(conn grpc.ClientConnInterface, config GuardConfig) *Guard {
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = DefaultMaxInFlight
+	}
+	if config.MinTimeout <= 0 {
+		config.MinTimeout = DefaultMinCallTimeout
+	}
+	if config.MaxTimeout <= 0 {
+		config.MaxTimeout = DefaultMaxCallTimeout
+	}
+	return &Guard{
+		conn:       conn,
+		breaker:    breaker.New(config.Breaker),
+		inFlight:   make(chan struct{}, config.MaxInFlight),
+		minTimeout: config.MinTimeout,
+		maxTimeout: max(config.MinTimeout, config.MaxTimeout),
+		latency:    map[string]*latency{},
+	}
+}
+
+// Invoke makes a unary call through the breaker with the adaptive timeout
+func (g *Guard) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	select {
+	case g.inFlight <- struct{}{}:
+	default:
+		return ErrOverloaded
+	}
+	defer func() { <-g.inFlight }()
+	if err := g.breaker.Allow(); err != nil {
+		return ErrCircuitOpen
+	}
+	timeout := g.Timeout(method)
+	callCtx := ctx
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > timeout {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := g.conn.Invoke(callCtx, method, args, reply, opts...)
+	elapsed := time.Since(start)
+	code := status.Code(err)
+	switch {
+	case code == codes.Canceled, code == codes.DeadlineExceeded && ctx.Err() != nil:
+		// the caller gave up, its own deadline says nothing about the peer
+		g.breaker.Cancel()
+	case code == codes.Unavailable && len(status.Convert(err).Details()) == 0:
+		// refused without a round trip, the latency says nothing. UNAVAILABLE sent by the peer itself, e.g. a
+		// missed quorum, carries details and is an answer.
+		g.breaker.Failure()
+	case code == codes.DeadlineExceeded && callCtx.Err() != nil:
+		// the guard's timeout fired, a timed out call raises the estimate so a peer which got slower is not
+		// failed forever
+		g.breaker.Failure()
+		g.observe(method, elapsed)
+	default:
+		// errors returned by the peer itself are answers, including a deadline its handler ran into
+		g.breaker.Success()
+		g.observe(method, elapsed)
+	}
+	return err
+}
+
+// NewStream opens a stream unless the breaker is open, streams are not limited or timed out
+func (g *Guard) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if g.breaker.State() == breaker.Open {
+		return nil, ErrCircuitOpen
+	}
+	return g.conn.NewStream(ctx, desc, method, opts...)
+}
+
+// observe adds a round trip of the method to its latency estimate
+func (g *Guard) observe(method string, rtt time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l, ok := g.latency[method]
+	if !ok {
+		g.latency[method] = &latency{mean: rtt, dev: rtt / 2}
+		return
+	}
+	diff := l.mean - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	l.dev = (3*l.dev + diff) / 4
+	l.mean = (7*l.mean + rtt) / 8
+}
+
+// Timeout returns the timeout of the next call of the method, the maximum until the method was observed
+func (g *Guard) Timeout(method string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l, ok := g.latency[method]
+	if !ok {
+		return g.maxTimeout
+	}
+	return min(max(l.mean+4*l.dev, g.minTimeout), g.maxTimeout)
+}
+
+// Timeouts returns the timeouts of the methods called so far
+func (g *Guard) Timeouts() map[string]time.Duration {
+	g.mu.Lock()
+	methods := make([]string, 0, len(g.latency))
+	for method := range g.latency {
+		methods = append(methods, method)
+	}
+	g.mu.Unlock()
+	timeouts := make(map[string]time.Duration, len(methods))
+	for _, method := range methods {
+		timeouts[method] = g.Timeout(method)
+	}
+	return timeouts
+}
+
+// State returns the state of the circuit breaker
+func (g *Guard) State() breaker.State {
+	return g.breaker.State()
+}
+
+// InFlight returns the number of unary calls in flight
+func (g *Guard) InFlight() int {
+	return len(g.inFlight)
+}
@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/ssdc/breaker"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeConn answers unary calls with invoke
+type fakeConn struct {
+	grpc.ClientConnInterface
+	calls  atomic.Int32
+	invoke func(ctx context.Context) error
+}
+
+func (f *fakeConn) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	f.calls.Add(1)
+	return f.invoke(ctx)
+}
+
+func TestGuardOpensCircuit(t *testing.T) {
+	conn := &fakeConn{invoke: func(ctx context.Context) error { return status.Error(codes.Unavailable, "connection refused") }}
+	g := NewGuard(conn, GuardConfig{Breaker: breaker.Config{FailureThreshold: 2, OpenTimeout: 50 * time.Millisecond}})
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, codes.Unavailable, status.Code(g.Invoke(context.Background(), "/m", nil, nil)))
+	}
+	assert.Equal(t, breaker.Open, g.State())
+	assert.True(t, errors.Is(g.Invoke(context.Background(), "/m", nil, nil), ErrCircuitOpen))
+	assert.Equal(t, int32(2), conn.calls.Load())
+
+	// once the open timeout passed a probe reaches the peer and closes the circuit again
+	conn.invoke = func(ctx context.Context) error { return nil }
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, g.Invoke(context.Background(), "/m", nil, nil))
+	assert.Equal(t, breaker.Closed, g.State())
+
+	// errors returned by the peer itself are answers and keep the circuit closed
+	conn.invoke = func(ctx context.Context) error { return status.Error(codes.NotFound, "no such key") }
+	for i := 0; i < 3; i++ {
+		g.Invoke(context.Background(), "/m", nil, nil)
+	}
+	assert.Equal(t, breaker.Closed, g.State())
+}
+
+func TestGuardAdaptsTimeout(t *testing.T) {
+	conn := &fakeConn{invoke: func(ctx context.Context) error { return nil }}
+	g := NewGuard(conn, GuardConfig{MinTimeout: 20 * time.Millisecond, MaxTimeout: time.Second})
+	assert.Equal(t, time.Second, g.Timeout("/m"))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, g.Invoke(context.Background(), "/m", nil, nil))
+	}
+	assert.Equal(t, 20*time.Millisecond, g.Timeout("/m"))
+	assert.Equal(t, time.Second, g.Timeout("/other"))
+
+	// a peer which stops answering is given up on after the adaptive timeout, not the caller's deadline
+	conn.invoke = func(ctx context.Context) error {
+		<-ctx.Done()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(g.Invoke(ctx, "/m", nil, nil)))
+	assert.Less(t, time.Since(start), time.Second)
+	// the timed out call raised the estimate
+	assert.Greater(t, g.Timeout("/m"), 20*time.Millisecond)
+}
+
+func TestGuardBoundsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	conn := &fakeConn{invoke: func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	}}
+	g := NewGuard(conn, GuardConfig{MaxInFlight: 1})
+	done := make(chan error)
+	go func() { done <- g.Invoke(context.Background(), "/m", nil, nil) }()
+	<-started
+	assert.Equal(t, 1, g.InFlight())
+	assert.True(t, errors.Is(g.Invoke(context.Background(), "/m", nil, nil), ErrOverloaded))
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Zero(t, g.InFlight())
+	// rejected calls do not count against the peer
+	assert.Equal(t, breaker.Closed, g.State())
+}
+
+func TestGuardCountsOnlyItsOwnTimeouts(t *testing.T) {
+	conn := &fakeConn{invoke: func(ctx context.Context) error {
+		<-ctx.Done()
+		return status.FromContextError(ctx.Err()).Err()
+	}}
+	g := NewGuard(conn, GuardConfig{Breaker: breaker.Config{FailureThreshold: 1, OpenTimeout: time.Minute}, MaxTimeout: time.Second})
+
+	// the caller's deadline is shorter than the guard's timeout, the call is given up like a canceled one
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(g.Invoke(ctx, "/m", nil, nil)))
+	assert.Equal(t, breaker.Closed, g.State())
+	assert.Empty(t, g.Timeouts())
+
+	// a deadline the peer's handler ran into is an answer
+	conn.invoke = func(ctx context.Context) error { return status.Error(codes.DeadlineExceeded, "backend timed out") }
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(g.Invoke(context.Background(), "/m", nil, nil)))
+	assert.Equal(t, breaker.Closed, g.State())
+
+	// the guard's own timeout counts against the peer
+	conn.invoke = func(ctx context.Context) error {
+		<-ctx.Done()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(g.Invoke(context.Background(), "/m", nil, nil)))
+	assert.Equal(t, breaker.Open, g.State())
+}
@@ -0,0 +1,96 @@
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+)
+
+// LoadNodeID returns the node id stored in the file, on first start a new random id is generated and stored
+func LoadNodeID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	id, err := NewNodeID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// NewNodeID generates a random version 4 UUID
+func NewNodeID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Identity implements NodeService, it tells peers the id of this node and learns the id of the caller
+type Identity struct {
+	pb.UnimplementedNodeServiceServer
+	id      string
+	onHello func(id, address string)
+}
+
+// NewIdentity creates the node service of the node with the id
+func NewIdentity(id string) *Identity {
+	return &Identity{id: id}
+}
+
+// SetOnHello sets the function called with the id and address a caller introduces itself with,
+// it must be set before the service is served
+func (i *Identity) SetOnHello(fn func(id, address string)) {
+	i.onHello = fn
+}
+
+// Hello method records the id of the caller and returns the id of this node
+func (i *Identity) Hello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	if i.onHello != nil && req.NodeId != "" && req.Address != "" {
+		i.onHello(req.NodeId, req.Address)
+	}
+	return &pb.HelloResponse{NodeId: i.id}, nil
+}
+
+// Identify asks the peer for its node id and records it, it returns the id known before.
+// self and address identify this node to the peer. It must be called without the lock held.
+func (c *CacheClient) Identify(ctx context.Context, self, address string) (string, error) {
+	c.RLock()
+	client := c.NodeClient
+	c.RUnlock()
+	if client == nil {
+		return "", errors.New("not connected")
+	}
+	resp, err := client.Hello(ctx, &pb.HelloRequest{NodeId: self, Address: address})
+	if err != nil {
+		return "", err
+	}
+	if resp.NodeId == "" {
+		return "", errors.New("peer has no node id")
+	}
+	c.Lock()
+	defer c.Unlock()
+	previous := c.Node
+	c.Node = resp.NodeId
+	return previous, nil
+}
@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestLoadNodeID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node", "id")
+	id, err := LoadNodeID(path)
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), id)
+
+	// the id survives restarts
+	again, err := LoadNodeID(path)
+	assert.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	other, err := LoadNodeID(filepath.Join(t.TempDir(), "id"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, other)
+}
+
+func TestIdentify(t *testing.T) {
+	network := newTestNetwork()
+	network.serve(t, "a", func(s *grpc.Server) {
+		pb.RegisterNodeServiceServer(s, NewIdentity("id-a"))
+	})
+	peer := &CacheClient{Address: "a", Connect: network.connect}
+	assert.NoError(t, peer.Init())
+	defer peer.Conn.Close()
+	assert.Equal(t, "a", peer.ID())
+
+	previous, err := peer.Identify(context.Background(), "id-b", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, "", previous)
+	assert.Equal(t, "id-a", peer.Node)
+	assert.Equal(t, "id-a", peer.ID())
+}
+
+func TestHelloRecordsCaller(t *testing.T) {
+	var id, address string
+	identity := NewIdentity("id-a")
+	identity.SetOnHello(func(i, a string) { id, address = i, a })
+
+	resp, err := identity.Hello(context.Background(), &pb.HelloRequest{NodeId: "id-b", Address: "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, "id-a", resp.NodeId)
+	assert.Equal(t, "id-b", id)
+	assert.Equal(t, "b", address)
+}
@@ -0,0 +1,626 @@
+package cluster
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultProbeInterval is the time between two probes of the failure detector
+	DefaultProbeInterval = time.Second
+	// DefaultProbeTimeout is the time a probed member has to answer a ping
+	DefaultProbeTimeout = 500 * time.Millisecond
+	// DefaultSuspectTimeout is the time a suspected member has to refute the suspicion before it is declared dead
+	DefaultSuspectTimeout = 5 * time.Second
+	// DefaultIndirectProbes is the number of members asked to probe a member which did not answer a ping
+	DefaultIndirectProbes = 3
+	// DefaultRetransmitMult scales how many times an update is piggybacked, it is sent mult * log2(members) times
+	DefaultRetransmitMult = 3
+	// DefaultMaxPiggyback is the maximum number of updates carried by one message
+	DefaultMaxPiggyback = 16
+	// DefaultMaxDeadProbeInterval bounds the backoff between two probes of a dead member
+	DefaultMaxDeadProbeInterval = time.Minute
+)
+
+var (
+	clusterMembers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cluster_members",
+		Help: "Number of known cluster members by state",
+	}, []string{"state"})
+
+	probeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cluster_probe_failures_total",
+		Help: "Total number of probes which got no answer, directly or indirectly",
+	})
+)
+
+// MemberState is the state of a member as seen by the failure detector
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+	// MemberLeft is a member which left the cluster on purpose
+	MemberLeft
+)
+
+func (s MemberState) String() string {
+	return pb.Member_State(s).String()
+}
+
+// Member of the cluster identified by its address
+type Member struct {
+	Address string
+	State   MemberState
+	// Incarnation is increased only by the member itself, to refute suspicion or to leave
+	Incarnation uint64
+}
+
+func (m Member) toPB() *pb.Member {
+	return &pb.Member{Address: m.Address, State: pb.Member_State(m.State), Incarnation: m.Incarnation}
+}
+
+func memberFromPB(m *pb.Member) Member {
+	return Member{Address: m.Address, State: MemberState(m.State), Incarnation: m.Incarnation}
+}
+
+// supersedes reports whether the update replaces what is known about the member
+func (m Member) supersedes(old Member) bool {
+	switch m.State {
+	case MemberAlive:
+		return m.Incarnation > old.Incarnation
+	case MemberSuspect:
+		return m.Incarnation > old.Incarnation || (m.Incarnation == old.Incarnation && old.State == MemberAlive)
+	}
+	// dead and left are final for an incarnation, left wins over dead
+	return m.Incarnation > old.Incarnation || (m.Incarnation == old.Incarnation && m.State > old.State)
+}
+
+// MembershipConfig configures the gossip membership, zero durations and counts use the defaults
+type MembershipConfig struct {
+	// Self is the address other members reach this node at
+	Self string
+	// Seeds are contacted to join the cluster, and again whenever no other member is alive
+	Seeds          []string
+	Connect        func(address string) (*grpc.ClientConn, error)
+	ProbeInterval  time.Duration
+	ProbeTimeout   time.Duration
+	SuspectTimeout time.Duration
+	IndirectProbes int
+	RetransmitMult int
+	MaxPiggyback   int
+	// MaxDeadProbeInterval bounds the backoff between two probes of a dead member, the probes start at
+	// ProbeInterval and double until a probe is answered and the member is alive again
+	MaxDeadProbeInterval time.Duration
+}
+
+type memberInfo struct {
+	Member
+	suspectedAt time.Time
+	// deadProbeAt is when a dead member is probed again, deadProbes counts the probes it did not answer
+	deadProbeAt time.Time
+	deadProbes  int
+}
+
+type broadcast struct {
+	member    *pb.Member
+	transmits int
+}
+
+// Membership is a SWIM style gossip membership. Every probe interval one member is pinged, when it
+// does not answer other members are asked to ping it and when they cannot reach it either it becomes
+// suspect. A suspect member which does not refute the suspicion in time is declared dead. State changes
+// are spread by piggybacking them on the probe messages. Dead members are probed again with a backoff so
+// that members separated by a partition merge back once it heals.
+type Membership struct {
+	pb.UnimplementedMembershipServiceServer
+	config MembershipConfig
+
+	mu         sync.Mutex
+	self       Member
+	members    map[string]*memberInfo
+	broadcasts []*broadcast
+	probeOrder []string
+	conns      map[string]*grpc.ClientConn
+	listeners  []func(Member)
+	pending    []Member
+
+	// dispatchMu serializes the delivery of changes to the listeners
+	dispatchMu sync.Mutex
+	notify     chan struct{}
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewMembership creates the membership of this node, Start joins the cluster
+func NewMembership(config MembershipConfig) *Membership {
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = DefaultProbeInterval
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = DefaultProbeTimeout
+	}
+	if config.SuspectTimeout <= 0 {
+		config.SuspectTimeout = DefaultSuspectTimeout
+	}
+	if config.IndirectProbes <= 0 {
+		config.IndirectProbes = DefaultIndirectProbes
+	}
+	if config.RetransmitMult <= 0 {
+		config.RetransmitMult = DefaultRetransmitMult
+	}
+	if config.MaxPiggyback <= 0 {
+		config.MaxPiggyback = DefaultMaxPiggyback
+	}
+	if config.MaxDeadProbeInterval <= 0 {
+		config.MaxDeadProbeInterval = DefaultMaxDeadProbeInterval
+	}
+	return &Membership{
+		config: config,
+		// the incarnation starts at the clock so that a restarted member overrides what was known about it
+		self:    Member{Address: config.Self, State: MemberAlive, Incarnation: uint64(time.Now().UnixNano())},
+		members: make(map[string]*memberInfo),
+		conns:   make(map[string]*grpc.ClientConn),
+		notify:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start joins the cluster through the seeds and starts the failure detector
+func (m *Membership) Start() {
+	m.mu.Lock()
+	m.queue(m.self)
+	m.mu.Unlock()
+	m.wg.Add(2)
+	go m.dispatch()
+	go func() {
+		defer m.wg.Done()
+		m.join()
+		ticker := time.NewTicker(m.config.ProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.probe()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the failure detector without telling the other members, they will detect it as failed
+func (m *Membership) Stop() {
+	close(m.stop)
+	m.wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for address, conn := range m.conns {
+		conn.Close()
+		delete(m.conns, address)
+	}
+}
+
+// Leave tells the alive members that this node leaves the cluster and stops the membership
+func (m *Membership) Leave(ctx context.Context) {
+	m.mu.Lock()
+	m.self.Incarnation++
+	m.self.State = MemberLeft
+	m.queue(m.self)
+	targets := m.randomMembers(m.config.IndirectProbes, "")
+	m.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			m.ping(ctx, target, false)
+		}(target)
+	}
+	wg.Wait()
+	m.Stop()
+}
+
+// Subscribe registers fn to be called on every change of another member, it is called first with
+// every member known at the time of subscribing. Calls are serialized and in order of the changes.
+func (m *Membership) Subscribe(fn func(Member)) {
+	m.dispatchMu.Lock()
+	defer m.dispatchMu.Unlock()
+	m.mu.Lock()
+	m.listeners = append(m.listeners, fn)
+	members := m.otherMembers()
+	m.mu.Unlock()
+	for _, member := range members {
+		fn(member)
+	}
+}
+
+// Members returns all known members including this node, sorted by address
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := append(m.otherMembers(), m.self)
+	sort.Slice(members, func(i, j int) bool { return members[i].Address < members[j].Address })
+	return members
+}
+
+// otherMembers must be called with mu held
+func (m *Membership) otherMembers() []Member {
+	members := make([]Member, 0, len(m.members))
+	for _, info := range m.members {
+		members = append(members, info.Member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Address < members[j].Address })
+	return members
+}
+
+// Ping answers a direct probe
+func (m *Membership) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	m.merge(req.Updates)
+	if req.Join {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		resp := &pb.PingResponse{Updates: []*pb.Member{m.self.toPB()}}
+		for _, member := range m.otherMembers() {
+			resp.Updates = append(resp.Updates, member.toPB())
+		}
+		return resp, nil
+	}
+	return &pb.PingResponse{Updates: m.piggyback()}, nil
+}
+
+// PingReq probes the target on behalf of the sender
+func (m *Membership) PingReq(ctx context.Context, req *pb.PingReqRequest) (*pb.PingResponse, error) {
+	m.merge(req.Updates)
+	pingCtx, cancel := context.WithTimeout(ctx, m.config.ProbeTimeout)
+	defer cancel()
+	if err := m.ping(pingCtx, req.Target, false); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%s did not answer: %v", req.Target, err)
+	}
+	return &pb.PingResponse{Updates: m.piggyback()}, nil
+}
+
+// queue schedules the update to be piggybacked, it replaces an older update of the same member.
+// It must be called with mu held.
+func (m *Membership) queue(member Member) {
+	for i, b := range m.broadcasts {
+		if b.member.Address == member.Address {
+			m.broadcasts = append(m.broadcasts[:i], m.broadcasts[i+1:]...)
+			break
+		}
+	}
+	m.broadcasts = append(m.broadcasts, &broadcast{member: member.toPB()})
+}
+
+// piggyback returns the updates to send with the next message, the least sent first
+func (m *Membership) piggyback() []*pb.Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limit := m.config.RetransmitMult * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	sort.SliceStable(m.broadcasts, func(i, j int) bool { return m.broadcasts[i].transmits < m.broadcasts[j].transmits })
+	updates := []*pb.Member{}
+	for _, b := range m.broadcasts {
+		if len(updates) == m.config.MaxPiggyback {
+			break
+		}
+		updates = append(updates, b.member)
+		b.transmits++
+	}
+	broadcasts := m.broadcasts[:0]
+	for _, b := range m.broadcasts {
+		if b.transmits < limit {
+			broadcasts = append(broadcasts, b)
+		}
+	}
+	m.broadcasts = broadcasts
+	return updates
+}
+
+// merge applies the updates received from another member
+func (m *Membership) merge(updates []*pb.Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, update := range updates {
+		m.apply(memberFromPB(update))
+	}
+}
+
+// apply must be called with mu held
+func (m *Membership) apply(update Member) {
+	if update.Address == "" {
+		return
+	}
+	if update.Address == m.self.Address {
+		// refute the suspicion, unless this node is leaving
+		if (update.State == MemberSuspect || update.State == MemberDead) && update.Incarnation >= m.self.Incarnation && m.self.State == MemberAlive {
+			m.self.Incarnation = update.Incarnation + 1
+			m.queue(m.self)
+		}
+		return
+	}
+	info, ok := m.members[update.Address]
+	if ok && !update.supersedes(info.Member) {
+		return
+	}
+	if !ok {
+		info = &memberInfo{}
+		m.members[update.Address] = info
+	}
+	info.Member = update
+	switch update.State {
+	case MemberSuspect:
+		info.suspectedAt = time.Now()
+	case MemberDead:
+		info.deadProbes = 0
+		info.deadProbeAt = time.Now().Add(m.config.ProbeInterval)
+	case MemberLeft:
+		// a member which left is not probed anymore
+		if conn, ok := m.conns[update.Address]; ok {
+			conn.Close()
+			delete(m.conns, update.Address)
+		}
+	}
+	m.queue(update)
+	m.changed(update)
+}
+
+// changed queues the change for the listeners, it must be called with mu held
+func (m *Membership) changed(member Member) {
+	m.pending = append(m.pending, member)
+	counts := map[MemberState]float64{MemberAlive: 1}
+	for _, info := range m.members {
+		counts[info.State]++
+	}
+	for _, state := range []MemberState{MemberAlive, MemberSuspect, MemberDead, MemberLeft} {
+		clusterMembers.WithLabelValues(state.String()).Set(counts[state])
+	}
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch delivers the queued changes to the listeners
+func (m *Membership) dispatch() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.notify:
+		case <-m.stop:
+			return
+		}
+		m.dispatchMu.Lock()
+		m.mu.Lock()
+		pending, listeners := m.pending, m.listeners
+		m.pending = nil
+		m.mu.Unlock()
+		for _, member := range pending {
+			for _, fn := range listeners {
+				fn(member)
+			}
+		}
+		m.dispatchMu.Unlock()
+	}
+}
+
+// client returns the membership client of the member, connections are kept open
+func (m *Membership) client(address string) (pb.MembershipServiceClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conn, ok := m.conns[address]
+	if !ok {
+		var err error
+		conn, err = m.config.Connect(address)
+		if err != nil {
+			return nil, err
+		}
+		m.conns[address] = conn
+	}
+	return pb.NewMembershipServiceClient(conn), nil
+}
+
+// ping probes the member directly and merges the updates it answers with
+func (m *Membership) ping(ctx context.Context, address string, join bool) error {
+	client, err := m.client(address)
+	if err != nil {
+		return err
+	}
+	req := &pb.PingRequest{From: m.config.Self, Updates: m.piggyback(), Join: join}
+	if join {
+		m.mu.Lock()
+		req.Updates = append(req.Updates, m.self.toPB())
+		m.mu.Unlock()
+	}
+	resp, err := client.Ping(ctx, req)
+	if err != nil {
+		return err
+	}
+	m.merge(resp.Updates)
+	return nil
+}
+
+// join asks the seeds for the member list
+func (m *Membership) join() {
+	for _, seed := range m.config.Seeds {
+		if seed == m.config.Self {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), m.config.ProbeTimeout)
+		m.ping(ctx, seed, true)
+		cancel()
+	}
+}
+
+// randomMembers returns up to n random alive members other than exclude, it must be called with mu held
+func (m *Membership) randomMembers(n int, exclude string) []string {
+	candidates := []string{}
+	for address, info := range m.members {
+		if info.State == MemberAlive && address != exclude {
+			candidates = append(candidates, address)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// nextTarget returns the next member to probe, members are probed round robin in random order
+func (m *Membership) nextTarget() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if len(m.probeOrder) == 0 {
+			for address, info := range m.members {
+				if info.State == MemberAlive || info.State == MemberSuspect {
+					m.probeOrder = append(m.probeOrder, address)
+				}
+			}
+			if len(m.probeOrder) == 0 {
+				return ""
+			}
+			rand.Shuffle(len(m.probeOrder), func(i, j int) {
+				m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+			})
+		}
+		target := m.probeOrder[0]
+		m.probeOrder = m.probeOrder[1:]
+		// members can die or leave after the order was built
+		if info, ok := m.members[target]; ok && (info.State == MemberAlive || info.State == MemberSuspect) {
+			return target
+		}
+	}
+}
+
+// expireSuspects declares the members which did not refute the suspicion in time dead
+func (m *Membership) expireSuspects() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, info := range m.members {
+		if info.State == MemberSuspect && time.Since(info.suspectedAt) > m.config.SuspectTimeout {
+			info.State = MemberDead
+			info.deadProbes = 0
+			info.deadProbeAt = time.Now().Add(m.config.ProbeInterval)
+			m.queue(info.Member)
+			m.changed(info.Member)
+		}
+	}
+}
+
+// probeDead pings the dead members due for another probe. The ping tells the member it is considered dead and
+// asks for its member list like a join, a member which answers refutes its death and both sides merge back.
+func (m *Membership) probeDead() {
+	m.mu.Lock()
+	now := time.Now()
+	due := []Member{}
+	for _, info := range m.members {
+		if info.State != MemberDead || now.Before(info.deadProbeAt) {
+			continue
+		}
+		due = append(due, info.Member)
+		info.deadProbes++
+		backoff := m.config.MaxDeadProbeInterval
+		if info.deadProbes < 32 {
+			backoff = min(m.config.ProbeInterval<<info.deadProbes, backoff)
+		}
+		info.deadProbeAt = now.Add(backoff)
+	}
+	self := m.self.toPB()
+	m.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, member := range due {
+		wg.Add(1)
+		go func(member Member) {
+			defer wg.Done()
+			client, err := m.client(member.Address)
+			if err != nil {
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), m.config.ProbeTimeout)
+			defer cancel()
+			resp, err := client.Ping(ctx, &pb.PingRequest{From: m.config.Self, Updates: []*pb.Member{self, member.toPB()}, Join: true})
+			if err == nil {
+				m.merge(resp.Updates)
+			}
+		}(member)
+	}
+	wg.Wait()
+}
+
+// probe runs one round of the failure detector
+func (m *Membership) probe() {
+	m.expireSuspects()
+	m.probeDead()
+	target := m.nextTarget()
+	if target == "" {
+		// nobody else is alive, try to (re)join through the seeds
+		m.join()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.ProbeTimeout)
+	err := m.ping(ctx, target, false)
+	cancel()
+	if err == nil {
+		return
+	}
+	if m.probeIndirect(target) {
+		return
+	}
+	probeFailures.Inc()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if info, ok := m.members[target]; ok && info.State == MemberAlive {
+		info.State = MemberSuspect
+		info.suspectedAt = time.Now()
+		m.queue(info.Member)
+		m.changed(info.Member)
+	}
+}
+
+// probeIndirect asks other members to probe the target and reports whether any of them reached it
+func (m *Membership) probeIndirect(target string) bool {
+	m.mu.Lock()
+	helpers := m.randomMembers(m.config.IndirectProbes, target)
+	m.mu.Unlock()
+	if len(helpers) == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*m.config.ProbeTimeout)
+	defer cancel()
+	ch := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			client, err := m.client(helper)
+			if err != nil {
+				ch <- false
+				return
+			}
+			resp, err := client.PingReq(ctx, &pb.PingReqRequest{From: m.config.Self, Target: target, Updates: m.piggyback()})
+			if err != nil {
+				ch <- false
+				return
+			}
+			m.merge(resp.Updates)
+			ch <- true
+		}(helper)
+	}
+	for range helpers {
+		if <-ch {
+			return true
+		}
+	}
+	return false
+}
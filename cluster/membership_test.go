@@ -0,0 +1,202 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testNetwork connects in-process members over bufconn listeners keyed by address
+type testNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*bufconn.Listener
+	servers   map[string]*grpc.Server
+}
+
+func newTestNetwork() *testNetwork {
+	return &testNetwork{listeners: map[string]*bufconn.Listener{}, servers: map[string]*grpc.Server{}}
+}
+
+func (n *testNetwork) connect(address string) (*grpc.ClientConn, error) {
+	return grpc.NewClient("passthrough:///"+address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			n.mu.Lock()
+			lis, ok := n.listeners[address]
+			n.mu.Unlock()
+			if !ok {
+				return nil, fmt.Errorf("%s is down", address)
+			}
+			return lis.DialContext(ctx)
+		}))
+}
+
+func (n *testNetwork) start(t *testing.T, address string, seeds ...string) *Membership {
+	m := NewMembership(MembershipConfig{
+		Self:           address,
+		Seeds:          seeds,
+		Connect:        n.connect,
+		ProbeInterval:  20 * time.Millisecond,
+		ProbeTimeout:   20 * time.Millisecond,
+		SuspectTimeout: 150 * time.Millisecond,
+	})
+	n.serve(t, address, func(s *grpc.Server) {
+		pb.RegisterMembershipServiceServer(s, m)
+	})
+	m.Start()
+	return m
+}
+
+// serve starts a server reachable at the address with the services registered by register
+func (n *testNetwork) serve(t *testing.T, address string, register func(s *grpc.Server)) {
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	register(s)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	n.mu.Lock()
+	n.listeners[address] = lis
+	n.servers[address] = s
+	n.mu.Unlock()
+}
+
+// kill makes the member unreachable without it leaving the cluster
+func (n *testNetwork) kill(address string) {
+	n.mu.Lock()
+	s := n.servers[address]
+	delete(n.listeners, address)
+	delete(n.servers, address)
+	n.mu.Unlock()
+	s.Stop()
+}
+
+func stateOf(m *Membership, address string) (MemberState, bool) {
+	for _, member := range m.Members() {
+		if member.Address == address {
+			return member.State, true
+		}
+	}
+	return 0, false
+}
+
+func TestMembershipJoinAndFailure(t *testing.T) {
+	network := newTestNetwork()
+	a := network.start(t, "a")
+	defer a.Stop()
+	b := network.start(t, "b", "a")
+	defer b.Stop()
+	c := network.start(t, "c", "a")
+
+	// c joined through a, b learns about it from the gossip
+	assert.Eventually(t, func() bool {
+		state, ok := stateOf(b, "c")
+		return ok && state == MemberAlive
+	}, 2*time.Second, 10*time.Millisecond)
+
+	var mu sync.Mutex
+	seen := map[string][]MemberState{}
+	a.Subscribe(func(member Member) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[member.Address] = append(seen[member.Address], member.State)
+	})
+
+	network.kill("c")
+	c.Stop()
+	for _, m := range []*Membership{a, b} {
+		assert.Eventually(t, func() bool {
+			state, _ := stateOf(m, "c")
+			return state == MemberDead
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// the subscription replays the known members and then reports the changes in order
+	assert.Equal(t, []MemberState{MemberAlive}, seen["b"])
+	if assert.NotEmpty(t, seen["c"]) {
+		assert.Equal(t, MemberAlive, seen["c"][0])
+		assert.Equal(t, MemberDead, seen["c"][len(seen["c"])-1])
+	}
+}
+
+func TestMembershipLeave(t *testing.T) {
+	network := newTestNetwork()
+	a := network.start(t, "a")
+	defer a.Stop()
+	b := network.start(t, "b", "a")
+	assert.Eventually(t, func() bool {
+		state, ok := stateOf(a, "b")
+		return ok && state == MemberAlive
+	}, 2*time.Second, 10*time.Millisecond)
+
+	b.Leave(context.Background())
+	state, _ := stateOf(a, "b")
+	assert.Equal(t, MemberLeft, state)
+}
+
+func TestMembershipRefutesSuspicion(t *testing.T) {
+	network := newTestNetwork()
+	a := network.start(t, "a")
+	defer a.Stop()
+	b := network.start(t, "b", "a")
+	defer b.Stop()
+	assert.Eventually(t, func() bool {
+		state, ok := stateOf(a, "b")
+		return ok && state == MemberAlive
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// a wrongly suspects b, b hears about it and refutes with a higher incarnation
+	a.mu.Lock()
+	suspected := a.members["b"].Member
+	a.mu.Unlock()
+	suspected.State = MemberSuspect
+	a.merge([]*pb.Member{suspected.toPB()})
+	assert.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		info := a.members["b"]
+		return info.State == MemberAlive && info.Incarnation > suspected.Incarnation
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestMembershipProbesDeadMembersAgain(t *testing.T) {
+	network := newTestNetwork()
+	a := network.start(t, "a")
+	defer a.Stop()
+	b := network.start(t, "b")
+	defer b.Stop()
+
+	// a declared b dead during a partition and neither of them gossips with the other anymore, a probes
+	// b again, b refutes its death and both know each other once more
+	b.mu.Lock()
+	dead := b.self
+	b.mu.Unlock()
+	dead.State = MemberDead
+	a.merge([]*pb.Member{dead.toPB()})
+	assert.Eventually(t, func() bool {
+		state, _ := stateOf(a, "b")
+		return state == MemberAlive
+	}, 2*time.Second, 10*time.Millisecond)
+	state, ok := stateOf(b, "a")
+	assert.True(t, ok)
+	assert.Equal(t, MemberAlive, state)
+}
+
+func TestMemberSupersedes(t *testing.T) {
+	alive := Member{Address: "a", State: MemberAlive, Incarnation: 2}
+	assert.True(t, Member{Address: "a", State: MemberSuspect, Incarnation: 2}.supersedes(alive))
+	assert.False(t, Member{Address: "a", State: MemberAlive, Incarnation: 2}.supersedes(alive))
+	assert.True(t, Member{Address: "a", State: MemberAlive, Incarnation: 3}.supersedes(Member{State: MemberDead, Incarnation: 2}))
+	assert.False(t, Member{Address: "a", State: MemberSuspect, Incarnation: 2}.supersedes(Member{State: MemberDead, Incarnation: 2}))
+	assert.True(t, Member{Address: "a", State: MemberLeft, Incarnation: 2}.supersedes(Member{State: MemberDead, Incarnation: 2}))
+	assert.False(t, Member{Address: "a", State: MemberDead, Incarnation: 2}.supersedes(Member{State: MemberLeft, Incarnation: 2}))
+}
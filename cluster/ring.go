@@ -0,0 +1,162 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of points every member gets on the ring
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent-hash ring, every member is placed on it at many virtual nodes so that keys
+// spread evenly and adding or removing a member moves only the keys of its neighbours
+type Ring struct {
+	mu      sync.RWMutex
+	vnodes  int
+	points  []uint64
+	owners  map[uint64]string
+	members map[string]struct{}
+}
+
+// NewRing creates an empty ring, vnodes <= 0 uses DefaultVirtualNodes
+func NewRing(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &Ring{
+		vnodes:  vnodes,
+		owners:  make(map[uint64]string),
+		members: make(map[string]struct{}),
+	}
+}
+
+// hashKey hashes with FNV-1a followed by the murmur3 finalizer, FNV alone spreads
+// similar short strings like vnode names poorly
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Add places the member on the ring, adding a member twice has no effect
+func (r *Ring) Add(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.members[member]; ok {
+		return
+	}
+	r.members[member] = struct{}{}
+	for i := 0; i < r.vnodes; i++ {
+		point := hashKey(member + "#" + strconv.Itoa(i))
+		if _, taken := r.owners[point]; taken {
+			// a hash collision keeps the first owner
+			continue
+		}
+		r.owners[point] = member
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Remove takes the member off the ring
+func (r *Ring) Remove(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.members[member]; !ok {
+		return
+	}
+	delete(r.members, member)
+	points := r.points[:0]
+	for _, point := range r.points {
+		if r.owners[point] == member {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+// Members returns the members of the ring in sorted order
+func (r *Ring) Members() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	members := make([]string, 0, len(r.members))
+	for member := range r.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Replicas returns the n distinct members owning the key, starting with the first member clockwise
+// from the hash of the key. Fewer members are returned when the ring is smaller than n.
+func (r *Ring) Replicas(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+	replicas := make([]string, 0, n)
+	if n == 0 {
+		return replicas
+	}
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	return r.replicasFrom(start, n, replicas)
+}
+
+// replicasFrom appends the n distinct members clockwise from the point at start, r.mu must be held
+func (r *Ring) replicasFrom(start, n int, replicas []string) []string {
+	for i := 0; i < len(r.points) && len(replicas) < n; i++ {
+		owner := r.owners[r.points[(start+i)%len(r.points)]]
+		seen := false
+		for _, replica := range replicas {
+			if replica == owner {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			replicas = append(replicas, owner)
+		}
+	}
+	return replicas
+}
+
+// Sharing returns the other members which store some keys together with the member when every key is
+// stored on n members, in sorted order
+func (r *Ring) Sharing(member string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+	shared := map[string]bool{}
+	for start := range r.points {
+		replicas := r.replicasFrom(start, n, make([]string, 0, n))
+		if !slices.Contains(replicas, member) {
+			continue
+		}
+		for _, replica := range replicas {
+			if replica != member {
+				shared[replica] = true
+			}
+		}
+	}
+	members := make([]string, 0, len(shared))
+	for m := range shared {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
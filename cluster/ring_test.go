@@ -0,0 +1,91 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingReplicasAreDistinct(t *testing.T) {
+	r := NewRing(16)
+	for i := 0; i < 5; i++ {
+		r.Add(fmt.Sprintf("node%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		replicas := r.Replicas(fmt.Sprintf("key%d", i), 3)
+		assert.Len(t, replicas, 3)
+		assert.NotEqual(t, replicas[0], replicas[1])
+		assert.NotEqual(t, replicas[1], replicas[2])
+		assert.NotEqual(t, replicas[0], replicas[2])
+	}
+	// the ring is smaller than the replication factor
+	assert.Len(t, r.Replicas("key", 10), 5)
+	assert.Empty(t, NewRing(0).Replicas("key", 3))
+}
+
+func TestRingSpreadsKeys(t *testing.T) {
+	r := NewRing(0)
+	for i := 0; i < 4; i++ {
+		r.Add(fmt.Sprintf("node%d", i))
+	}
+	owned := map[string]int{}
+	for i := 0; i < 40000; i++ {
+		owned[r.Replicas(fmt.Sprintf("key%d", i), 1)[0]]++
+	}
+	for member, n := range owned {
+		// an even spread is 10000 keys per member
+		assert.InDelta(t, 10000, n, 2500, "member %s owns %d keys", member, n)
+	}
+}
+
+func TestRingMovesFewKeys(t *testing.T) {
+	r := NewRing(0)
+	for i := 0; i < 4; i++ {
+		r.Add(fmt.Sprintf("node%d", i))
+	}
+	before := map[string]string{}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before[key] = r.Replicas(key, 1)[0]
+	}
+	r.Add("node4")
+	moved := 0
+	for key, owner := range before {
+		now := r.Replicas(key, 1)[0]
+		if now != owner {
+			// keys only move to the new member
+			assert.Equal(t, "node4", now)
+			moved++
+		}
+	}
+	assert.InDelta(t, 2000, moved, 700)
+
+	r.Remove("node4")
+	for key, owner := range before {
+		assert.Equal(t, owner, r.Replicas(key, 1)[0])
+	}
+	assert.Equal(t, []string{"node0", "node1", "node2", "node3"}, r.Members())
+}
+
+func TestRingSharing(t *testing.T) {
+	r := NewRing(1)
+	for i := 0; i < 4; i++ {
+		r.Add(fmt.Sprintf("node%d", i))
+	}
+	// with one point per member a member shares keys with its neighbours only
+	assert.Len(t, r.Sharing("node0", 2), 2)
+	assert.Empty(t, r.Sharing("node0", 1))
+	assert.Len(t, r.Sharing("node0", 4), 3)
+
+	// every member a key is stored together with is reported
+	sharing := r.Sharing("node0", 2)
+	for i := 0; i < 1000; i++ {
+		replicas := r.Replicas(fmt.Sprintf("key%d", i), 2)
+		if replicas[0] == "node0" {
+			assert.Contains(t, sharing, replicas[1])
+		} else if replicas[1] == "node0" {
+			assert.Contains(t, sharing, replicas[0])
+		}
+	}
+}
@@ -9,3 +9,28 @@ type DBStorage interface {
 	Push(batch []*pb.KeyValue) error
 	Get(key string) ([]byte, error)
 }
+
+// MultiGetter is an optional interface for storages able to read many keys in one call.
+// Keys which are not found are absent from the returned map.
+type MultiGetter interface {
+	MultiGet(keys []string) (map[string][]byte, error)
+}
+
+// MultiGet reads keys from storage in one call when it implements MultiGetter,
+// otherwise it falls back to Get for every key
+func MultiGet(storage DBStorage, keys []string) (map[string][]byte, error) {
+	if mg, ok := storage.(MultiGetter); ok {
+		return mg.MultiGet(keys)
+	}
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		value, err := storage.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(value) != 0 {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"errors"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+)
+
+// ErrScanNotSupported is returned by NewIterator for storages which do not implement Scanner
+var ErrScanNotSupported = errors.New("storage does not support scanning")
+
+// Iterator walks over key-value pairs in ascending key order
+type Iterator interface {
+	Next() bool
+	Key() string
+	Value() []byte
+	Err() error
+	Close() error
+}
+
+// Scanner is an optional interface for storages able to iterate keys in order.
+// NewIterator returns keys in range [start, end), an empty end means no upper bound.
+type Scanner interface {
+	NewIterator(start, end string) (Iterator, error)
+}
+
+// NewIterator returns an iterator over storage when it implements Scanner, otherwise ErrScanNotSupported
+func NewIterator(storage DBStorage, start, end string) (Iterator, error) {
+	if s, ok := storage.(Scanner); ok {
+		return s.NewIterator(start, end)
+	}
+	return nil, ErrScanNotSupported
+}
+
+// PrefixEnd returns the first key after all keys starting with prefix, or an empty string when there is none
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// InRange reports whether key is in range [start, end), an empty end means no upper bound
+func InRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+type sliceIterator struct {
+	kvs []*pb.KeyValue
+	pos int
+}
+
+// NewSliceIterator returns an iterator over kvs, which must be sorted by key
+func NewSliceIterator(kvs []*pb.KeyValue) Iterator {
+	return &sliceIterator{kvs: kvs, pos: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.pos < len(it.kvs) {
+		it.pos++
+	}
+	return it.pos < len(it.kvs)
+}
+
+func (it *sliceIterator) Key() string {
+	return string(it.kvs[it.pos].Key)
+}
+
+func (it *sliceIterator) Value() []byte {
+	return it.kvs[it.pos].Value
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+type mergeIterator struct {
+	its   []Iterator
+	valid []bool
+	cur   int
+	err   error
+}
+
+// MergeIterators merges sorted iterators into one, for keys present in several iterators
+// the value of the first iterator wins. Closing the result closes all iterators.
+func MergeIterators(its ...Iterator) Iterator {
+	m := &mergeIterator{its: its, valid: make([]bool, len(its)), cur: -1}
+	for i, it := range its {
+		m.valid[i] = it.Next()
+	}
+	return m
+}
+
+func (m *mergeIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if m.cur >= 0 {
+		// advance every iterator positioned at the current key
+		key := m.its[m.cur].Key()
+		for i, it := range m.its {
+			if m.valid[i] && it.Key() == key {
+				m.valid[i] = it.Next()
+			}
+		}
+	}
+	m.cur = -1
+	for i, it := range m.its {
+		if err := it.Err(); err != nil {
+			m.err = err
+			return false
+		}
+		if m.valid[i] && (m.cur < 0 || it.Key() < m.its[m.cur].Key()) {
+			m.cur = i
+		}
+	}
+	return m.cur >= 0
+}
+
+func (m *mergeIterator) Key() string {
+	return m.its[m.cur].Key()
+}
+
+func (m *mergeIterator) Value() []byte {
+	return m.its[m.cur].Value()
+}
+
+func (m *mergeIterator) Err() error {
+	return m.err
+}
+
+func (m *mergeIterator) Close() error {
+	var errs []error
+	for _, it := range m.its {
+		if err := it.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
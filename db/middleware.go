@@ -0,0 +1,221 @@
+package db
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/radek-ryckowski/ssdc/breaker"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+)
+
+// ErrTimeout is returned by storages wrapped with WithTimeout when a call takes too long
+var ErrTimeout = errors.New("db operation timed out")
+
+var (
+	storageLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_operation_duration_seconds",
+		Help:    "Latency of DB storage operations",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"storage", "operation", "result"})
+
+	storageRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_retries_total",
+		Help: "Total number of retried DB storage operations",
+	}, []string{"operation"})
+
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_circuit_breaker_state",
+		Help: "State of the DB storage circuit breaker (0 closed, 1 open, 2 half-open)",
+	}, []string{"storage"})
+)
+
+// Middleware wraps a DBStorage with additional behaviour
+type Middleware func(DBStorage) DBStorage
+
+// Chain wraps storage with middlewares, the first middleware is the outermost one:
+//
+//	Chain(sql, WithMetrics("sql"), WithCircuitBreaker("sql", cfg), WithTimeout(time.Second), WithRetry(rcfg))
+//
+// measures calls which go through the breaker, which sees the outcome of all retries bounded by one timeout.
+func Chain(storage DBStorage, middlewares ...Middleware) DBStorage {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		storage = middlewares[i](storage)
+	}
+	return storage
+}
+
+// wrapper turns a function applied around every call into a DBStorage
+type wrapper struct {
+	next DBStorage
+	call func(operation string, fn func() error) error
+}
+
+func (w *wrapper) Push(batch []*pb.KeyValue) error {
+	return w.call("push", func() error {
+		return w.next.Push(batch)
+	})
+}
+
+func (w *wrapper) Get(key string) ([]byte, error) {
+	var value []byte
+	err := w.call("get", func() error {
+		var err error
+		value, err = w.next.Get(key)
+		return err
+	})
+	if err != nil {
+		// a timed out call may still write value in the background
+		return nil, err
+	}
+	return value, nil
+}
+
+func (w *wrapper) MultiGet(keys []string) (map[string][]byte, error) {
+	var values map[string][]byte
+	err := w.call("multiget", func() error {
+		var err error
+		values, err = MultiGet(w.next, keys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (w *wrapper) NewIterator(start, end string) (Iterator, error) {
+	if !canScan(w.next) {
+		return nil, ErrScanNotSupported
+	}
+	var it Iterator
+	err := w.call("scan", func() error {
+		var err error
+		it, err = NewIterator(w.next, start, end)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// canScan reports whether NewIterator can succeed on storage, looking through wrappers
+func canScan(storage DBStorage) bool {
+	switch s := storage.(type) {
+	case *wrapper:
+		return canScan(s.next)
+	case *TieredStorage:
+		for _, t := range s.tiers {
+			if canScan(t.Storage) {
+				return true
+			}
+		}
+		return false
+	case Scanner:
+		return true
+	}
+	return false
+}
+
+type RetryConfig struct {
+	// Attempts is the total number of tries including the first one
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// WithRetry retries failed calls with exponential backoff and jitter,
+// calls rejected by an open circuit breaker are not retried
+func WithRetry(config RetryConfig) Middleware {
+	if config.Attempts <= 0 {
+		config.Attempts = 1
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = 10 * time.Millisecond
+	}
+	if config.MaxBackoff < config.InitialBackoff {
+		config.MaxBackoff = config.InitialBackoff
+	}
+	return func(next DBStorage) DBStorage {
+		return &wrapper{next: next, call: func(operation string, fn func() error) error {
+			backoff := config.InitialBackoff
+			var err error
+			for attempt := 0; attempt < config.Attempts; attempt++ {
+				if attempt > 0 {
+					storageRetries.WithLabelValues(operation).Inc()
+					time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+					backoff *= 2
+					if backoff > config.MaxBackoff {
+						backoff = config.MaxBackoff
+					}
+				}
+				if err = fn(); err == nil || errors.Is(err, breaker.ErrOpen) {
+					return err
+				}
+			}
+			return err
+		}}
+	}
+}
+
+// WithTimeout fails calls which do not finish within timeout with ErrTimeout.
+// DBStorage has no way to cancel a call, so the call keeps running in the background and may still
+// succeed after ErrTimeout was returned. The cache does not retry a failed Push, its flush only logs
+// the error, so a timed out Push may or may not have been written. WithTimeout must sit outside
+// WithRetry, otherwise every retry starts while the timed out attempt is still writing the same batch.
+func WithTimeout(timeout time.Duration) Middleware {
+	return func(next DBStorage) DBStorage {
+		return &wrapper{next: next, call: func(operation string, fn func() error) error {
+			done := make(chan error, 1)
+			go func() {
+				done <- fn()
+			}()
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case err := <-done:
+				return err
+			case <-timer.C:
+				return ErrTimeout
+			}
+		}}
+	}
+}
+
+// WithCircuitBreaker stops calling the storage after consecutive failures and probes it again
+// after config.OpenTimeout, rejected calls fail with breaker.ErrOpen
+func WithCircuitBreaker(name string, config breaker.Config) Middleware {
+	onStateChange := config.OnStateChange
+	config.OnStateChange = func(state breaker.State) {
+		breakerState.WithLabelValues(name).Set(float64(state))
+		if onStateChange != nil {
+			onStateChange(state)
+		}
+	}
+	return func(next DBStorage) DBStorage {
+		b := breaker.New(config)
+		breakerState.WithLabelValues(name).Set(float64(breaker.Closed))
+		return &wrapper{next: next, call: func(operation string, fn func() error) error {
+			return b.Do(fn)
+		}}
+	}
+}
+
+// WithMetrics records the latency of every call labeled by storage name, operation and result
+func WithMetrics(name string) Middleware {
+	return func(next DBStorage) DBStorage {
+		return &wrapper{next: next, call: func(operation string, fn func() error) error {
+			start := time.Now()
+			err := fn()
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			storageLatency.WithLabelValues(name, operation, result).Observe(time.Since(start).Seconds())
+			return err
+		}}
+	}
+}
@@ -0,0 +1,56 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/ssdc/breaker"
+	"github.com/radek-ryckowski/ssdc/db"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+type flakyStorage struct {
+	failures int
+	calls    int
+	delay    time.Duration
+}
+
+func (f *flakyStorage) Push(batch []*pb.KeyValue) error {
+	f.calls++
+	time.Sleep(f.delay)
+	if f.calls <= f.failures {
+		return errors.New("push failed")
+	}
+	return nil
+}
+
+func (f *flakyStorage) Get(key string) ([]byte, error) {
+	return []byte(key), f.Push(nil)
+}
+
+func TestChainRetriesAndBreaks(t *testing.T) {
+	storage := &flakyStorage{failures: 2}
+	chained := db.Chain(storage, db.WithMetrics("test"), db.WithRetry(db.RetryConfig{Attempts: 3, InitialBackoff: time.Millisecond}))
+	value, err := chained.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key"), value)
+	assert.Equal(t, 3, storage.calls)
+
+	storage = &flakyStorage{failures: 100}
+	chained = db.Chain(storage,
+		db.WithCircuitBreaker("test", breaker.Config{FailureThreshold: 1, OpenTimeout: time.Hour}),
+		db.WithRetry(db.RetryConfig{Attempts: 2, InitialBackoff: time.Millisecond}),
+	)
+	assert.Error(t, chained.Push(nil))
+	assert.ErrorIs(t, chained.Push(nil), breaker.ErrOpen)
+	assert.Equal(t, 2, storage.calls)
+}
+
+func TestTimeout(t *testing.T) {
+	storage := &flakyStorage{delay: 100 * time.Millisecond}
+	chained := db.Chain(storage, db.WithTimeout(10*time.Millisecond))
+	_, err := chained.Get("key")
+	assert.ErrorIs(t, err, db.ErrTimeout)
+}
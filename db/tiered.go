@@ -0,0 +1,340 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+)
+
+const (
+	// DefaultAsyncQueueSize is the number of batches queued for an async tier before Push blocks
+	DefaultAsyncQueueSize = 64
+)
+
+var (
+	tierLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_tier_duration_seconds",
+		Help:    "Latency of tiered storage operations per tier",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tier", "operation"})
+
+	tierErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_tier_errors_total",
+		Help: "Total number of tiered storage errors per tier",
+	}, []string{"tier", "operation"})
+
+	tierPromotions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_tier_promotions_total",
+		Help: "Total number of keys promoted to a tier after a read hit in a lower tier",
+	}, []string{"tier"})
+
+	tierPromotionsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_tier_promotions_dropped_total",
+		Help: "Total number of keys not promoted to an async tier because its queue was full or closed",
+	}, []string{"tier"})
+)
+
+// ErrTieredClosed is returned by Push after Close
+var ErrTieredClosed = errors.New("tiered storage is closed")
+
+// Tier is a single layer of TieredStorage
+type Tier struct {
+	Name    string
+	Storage DBStorage
+	// Async tiers are written in the background, Push does not wait for them
+	Async bool
+}
+
+// TieredConfig configures TieredStorage, tiers are ordered from the fastest to the most durable one
+type TieredConfig struct {
+	Tiers          []Tier
+	AsyncQueueSize int
+	// OnAsyncError is called when a background write to an async tier fails
+	OnAsyncError func(err *TierError)
+}
+
+// TierError describes a failure of a single tier
+type TierError struct {
+	Tier      string
+	Operation string
+	Err       error
+}
+
+func (e *TierError) Error() string {
+	return fmt.Sprintf("tier %s: %s: %v", e.Tier, e.Operation, e.Err)
+}
+
+func (e *TierError) Unwrap() error {
+	return e.Err
+}
+
+// TieredError aggregates errors of all failed tiers
+type TieredError struct {
+	Errors []*TierError
+}
+
+func (e *TieredError) Error() string {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errors.Join(errs...).Error()
+}
+
+func (e *TieredError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+func (e *TieredError) add(err *TierError) {
+	e.Errors = append(e.Errors, err)
+}
+
+func (e *TieredError) errOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+type tier struct {
+	Tier
+	queue chan []*pb.KeyValue
+}
+
+// TieredStorage is a DBStorage which writes to several tiers and reads through them in order,
+// promoting read hits to the tiers above
+type TieredStorage struct {
+	tiers        []*tier
+	onAsyncError func(err *TierError)
+	wg           sync.WaitGroup
+	// mu guards closed, the queues of async tiers are sent to only while it is read-locked and not closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewTieredStorage creates a TieredStorage and starts the writers of async tiers
+func NewTieredStorage(config *TieredConfig) (*TieredStorage, error) {
+	if len(config.Tiers) == 0 {
+		return nil, errors.New("tiered storage requires at least one tier")
+	}
+	queueSize := config.AsyncQueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultAsyncQueueSize
+	}
+	ts := &TieredStorage{
+		onAsyncError: config.OnAsyncError,
+	}
+	hasSync := false
+	for i, t := range config.Tiers {
+		if t.Storage == nil {
+			return nil, fmt.Errorf("tier %d has no storage", i)
+		}
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("tier%d", i)
+		}
+		tt := &tier{Tier: t}
+		if t.Async {
+			tt.queue = make(chan []*pb.KeyValue, queueSize)
+			ts.wg.Add(1)
+			go ts.asyncWriter(tt)
+		} else {
+			hasSync = true
+		}
+		ts.tiers = append(ts.tiers, tt)
+	}
+	if !hasSync {
+		return nil, errors.New("tiered storage requires at least one synchronous tier")
+	}
+	return ts, nil
+}
+
+func (ts *TieredStorage) asyncWriter(t *tier) {
+	defer ts.wg.Done()
+	for batch := range t.queue {
+		if err := t.push(batch); err != nil && ts.onAsyncError != nil {
+			ts.onAsyncError(err)
+		}
+	}
+}
+
+func (t *tier) push(batch []*pb.KeyValue) *TierError {
+	start := time.Now()
+	err := t.Storage.Push(batch)
+	tierLatency.WithLabelValues(t.Name, "push").Observe(time.Since(start).Seconds())
+	if err != nil {
+		tierErrors.WithLabelValues(t.Name, "push").Inc()
+		return &TierError{Tier: t.Name, Operation: "push", Err: err}
+	}
+	return nil
+}
+
+// Push writes the batch to all synchronous tiers concurrently and queues it for async tiers.
+// It returns a TieredError listing the synchronous tiers which failed.
+func (ts *TieredStorage) Push(batch []*pb.KeyValue) error {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if ts.closed {
+		return ErrTieredClosed
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	tErr := &TieredError{}
+	for _, t := range ts.tiers {
+		if t.Async {
+			t.queue <- batch
+			continue
+		}
+		wg.Add(1)
+		go func(t *tier) {
+			defer wg.Done()
+			if err := t.push(batch); err != nil {
+				mu.Lock()
+				tErr.add(err)
+				mu.Unlock()
+			}
+		}(t)
+	}
+	wg.Wait()
+	return tErr.errOrNil()
+}
+
+// Get reads the key from tiers in order, the first hit is promoted to all tiers above it.
+// An error is returned only if no tier has the key and at least one tier failed.
+func (ts *TieredStorage) Get(key string) ([]byte, error) {
+	tErr := &TieredError{}
+	for i, t := range ts.tiers {
+		start := time.Now()
+		value, err := t.Storage.Get(key)
+		tierLatency.WithLabelValues(t.Name, "get").Observe(time.Since(start).Seconds())
+		if err != nil {
+			tierErrors.WithLabelValues(t.Name, "get").Inc()
+			tErr.add(&TierError{Tier: t.Name, Operation: "get", Err: err})
+			continue
+		}
+		if len(value) != 0 {
+			ts.promote(i, []*pb.KeyValue{{Key: []byte(key), Value: value}})
+			return value, nil
+		}
+	}
+	return nil, tErr.errOrNil()
+}
+
+// MultiGet reads keys through the tiers in order, each tier is asked only for keys not found above it
+func (ts *TieredStorage) MultiGet(keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	missing := keys
+	tErr := &TieredError{}
+	for i, t := range ts.tiers {
+		if len(missing) == 0 {
+			break
+		}
+		start := time.Now()
+		found, err := MultiGet(t.Storage, missing)
+		tierLatency.WithLabelValues(t.Name, "multiget").Observe(time.Since(start).Seconds())
+		if err != nil {
+			tierErrors.WithLabelValues(t.Name, "multiget").Inc()
+			tErr.add(&TierError{Tier: t.Name, Operation: "multiget", Err: err})
+			continue
+		}
+		promote := []*pb.KeyValue{}
+		next := []string{}
+		for _, key := range missing {
+			if value, ok := found[key]; ok && len(value) != 0 {
+				values[key] = value
+				promote = append(promote, &pb.KeyValue{Key: []byte(key), Value: value})
+			} else {
+				next = append(next, key)
+			}
+		}
+		ts.promote(i, promote)
+		missing = next
+	}
+	if len(missing) != 0 && len(tErr.Errors) != 0 {
+		return nil, tErr
+	}
+	return values, nil
+}
+
+// NewIterator merges iterators of all tiers able to scan, values from upper tiers win
+func (ts *TieredStorage) NewIterator(start, end string) (Iterator, error) {
+	its := []Iterator{}
+	for _, t := range ts.tiers {
+		if !canScan(t.Storage) {
+			continue
+		}
+		it, err := NewIterator(t.Storage, start, end)
+		if err != nil {
+			tierErrors.WithLabelValues(t.Name, "scan").Inc()
+			for _, it := range its {
+				it.Close()
+			}
+			return nil, &TierError{Tier: t.Name, Operation: "scan", Err: err}
+		}
+		its = append(its, it)
+	}
+	if len(its) == 0 {
+		return nil, ErrScanNotSupported
+	}
+	return MergeIterators(its...), nil
+}
+
+// promote writes entries found in tier n to all tiers above it, failures are only counted. Promotion runs on
+// the read path, a batch for an async tier whose queue is full or closed is dropped rather than waited for.
+func (ts *TieredStorage) promote(n int, batch []*pb.KeyValue) {
+	if len(batch) == 0 {
+		return
+	}
+	for _, t := range ts.tiers[:n] {
+		if t.Async {
+			if !ts.enqueue(t, batch) {
+				tierPromotionsDropped.WithLabelValues(t.Name).Add(float64(len(batch)))
+				continue
+			}
+		} else if err := t.push(batch); err != nil {
+			continue
+		}
+		tierPromotions.WithLabelValues(t.Name).Add(float64(len(batch)))
+	}
+}
+
+// enqueue queues the batch for the async tier without blocking, it reports whether the batch was queued
+func (ts *TieredStorage) enqueue(t *tier, batch []*pb.KeyValue) bool {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if ts.closed {
+		return false
+	}
+	select {
+	case t.queue <- batch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close waits until all queued async writes are done, the tiers themselves are not closed.
+// Push fails and reads stop promoting to async tiers after Close.
+func (ts *TieredStorage) Close() {
+	ts.mu.Lock()
+	if ts.closed {
+		ts.mu.Unlock()
+		return
+	}
+	ts.closed = true
+	for _, t := range ts.tiers {
+		if t.Async {
+			close(t.queue)
+		}
+	}
+	ts.mu.Unlock()
+	ts.wg.Wait()
+}
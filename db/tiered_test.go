@@ -0,0 +1,118 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/radek-ryckowski/ssdc/db"
+	exampledb "github.com/radek-ryckowski/ssdc/examples/db"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingStorage struct{}
+
+func (failingStorage) Push(batch []*pb.KeyValue) error { return errors.New("push failed") }
+func (failingStorage) Get(key string) ([]byte, error)  { return nil, errors.New("get failed") }
+
+func TestTieredStoragePromotesHits(t *testing.T) {
+	hot := exampledb.NewInMemoryDatabase()
+	cold := exampledb.NewInMemoryDatabase()
+	cold.Push([]*pb.KeyValue{{Key: []byte("key"), Value: []byte("value")}})
+	ts, err := db.NewTieredStorage(&db.TieredConfig{Tiers: []db.Tier{
+		{Name: "hot", Storage: hot},
+		{Name: "cold", Storage: cold},
+	}})
+	assert.NoError(t, err)
+	defer ts.Close()
+
+	value, err := ts.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+	promoted, _ := hot.Get("key")
+	assert.Equal(t, []byte("value"), promoted)
+
+	values, err := ts.MultiGet([]string{"key", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"key": []byte("value")}, values)
+}
+
+func TestTieredStorageReportsTierErrors(t *testing.T) {
+	var asyncErr *db.TierError
+	done := make(chan struct{})
+	ts, err := db.NewTieredStorage(&db.TieredConfig{
+		Tiers: []db.Tier{
+			{Name: "local", Storage: exampledb.NewInMemoryDatabase()},
+			{Name: "remote", Storage: failingStorage{}, Async: true},
+			{Name: "durable", Storage: failingStorage{}},
+		},
+		OnAsyncError: func(err *db.TierError) {
+			asyncErr = err
+			close(done)
+		},
+	})
+	assert.NoError(t, err)
+
+	err = ts.Push([]*pb.KeyValue{{Key: []byte("key"), Value: []byte("value")}})
+	var tErr *db.TieredError
+	assert.True(t, errors.As(err, &tErr))
+	assert.Len(t, tErr.Errors, 1)
+	assert.Equal(t, "durable", tErr.Errors[0].Tier)
+	<-done
+	ts.Close()
+	assert.Equal(t, "remote", asyncErr.Tier)
+
+	// the key is served from the healthy tier even though others fail
+	value, err := ts.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+	_, err = ts.Get("missing")
+	assert.Error(t, err)
+}
+
+// blockingStorage holds every Push until release is closed
+type blockingStorage struct {
+	pushed  chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) Push(batch []*pb.KeyValue) error {
+	s.pushed <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *blockingStorage) Get(key string) ([]byte, error) { return nil, errors.New("not found") }
+
+func TestTieredStorageDropsPromotionsToFullQueue(t *testing.T) {
+	hot := &blockingStorage{pushed: make(chan struct{}, 10), release: make(chan struct{})}
+	cold := exampledb.NewInMemoryDatabase()
+	cold.Push([]*pb.KeyValue{{Key: []byte("key"), Value: []byte("value")}})
+	ts, err := db.NewTieredStorage(&db.TieredConfig{
+		Tiers: []db.Tier{
+			{Name: "hot", Storage: hot, Async: true},
+			{Name: "cold", Storage: cold},
+		},
+		AsyncQueueSize: 1,
+	})
+	assert.NoError(t, err)
+
+	// the writer holds the first promotion, the second fills the queue and later ones must not block the read
+	_, err = ts.Get("key")
+	assert.NoError(t, err)
+	<-hot.pushed
+	for i := 0; i < 3; i++ {
+		value, err := ts.Get("key")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("value"), value)
+	}
+	close(hot.release)
+	ts.Close()
+
+	// reads after Close still work without promoting, writes are refused
+	value, err := ts.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+	assert.ErrorIs(t, ts.Push([]*pb.KeyValue{{Key: []byte("other"), Value: []byte("value")}}), db.ErrTieredClosed)
+	ts.Close()
+}
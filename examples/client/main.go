@@ -7,22 +7,27 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/radek-ryckowski/ssdc/client"
 	pbData "github.com/radek-ryckowski/ssdc/examples/proto/data"
 	pb "github.com/radek-ryckowski/ssdc/proto/cache"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
-	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/grpc/status"
 )
 
 var (
-	address = flag.String("address", "127.0.0.1:50051", "the address to connect to")
+	address = flag.String("address", "127.0.0.1:50051", "comma separated addresses of the nodes to connect to")
 	key     = flag.String("key", "exampleKey", "the key to set")
 	value   = flag.String("value", "exampleValue", "the value to set")
 	getFlg  = flag.Bool("get", false, "get operation")
 	setFlg  = flag.Bool("set", false, "set operation")
+	level   = flag.String("consistency", "QUORUM", "consistency level: ONE, QUORUM, ALL or LOCAL_ONLY")
+	hedge   = flag.Duration("hedge", 0, "delay after which a read is sent to another node as well, 0 disables hedging")
 
 	kacp = keepalive.ClientParameters{
 		Time:                10 * time.Second, // send pings every 10 seconds if there is no activity
@@ -31,14 +36,36 @@ var (
 	}
 )
 
+// printQuorumFailure prints the replicas which failed when the error carries a QuorumFailure
+func printQuorumFailure(err error) {
+	for _, detail := range status.Convert(err).Details() {
+		failure, ok := detail.(*pb.QuorumFailure)
+		if !ok {
+			continue
+		}
+		fmt.Printf("quorum: %d of %d nodes, timed out: %v\n", failure.Achieved, failure.Required, failure.TimedOut)
+		for _, peer := range failure.FailedPeers {
+			fmt.Printf("  %s: %s (%s)\n", peer.Address, codes.Code(peer.Code), peer.Message)
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
-	conn, err := grpc.NewClient(*address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithKeepaliveParams(kacp))
+	consistency, ok := pb.Consistency_value[*level]
+	if !ok {
+		log.Fatalf("unknown consistency level %s", *level)
+	}
+	c, err := client.New(client.Config{
+		Addresses:   strings.Split(*address, ","),
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithKeepaliveParams(kacp)},
+		Consistency: pb.Consistency(consistency),
+		HedgeDelay:  *hedge,
+	})
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
-	defer conn.Close()
-	c := pb.NewCacheServiceClient(conn)
+	defer c.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
@@ -55,35 +82,25 @@ func main() {
 			Sum:   sha256Sum,
 		}
 
-		any, err := anypb.New(payload)
-		if err != nil {
-			log.Fatalf("could not create anypb: %v", err)
-		}
-		fmt.Println("debug: ", any)
-		resp, err := c.Set(ctx, &pb.SetRequest{Uuid: *key, Value: any})
+		version, err := client.Set(ctx, c, *key, payload)
 		if err != nil {
+			printQuorumFailure(err)
 			log.Fatalf("could not set value: %v", err)
 		}
-		fmt.Printf("Response.Nodes: %v\n", resp.ConsistentNodes)
-		fmt.Printf("Response.Succes: %v\n", resp.Success)
+		fmt.Printf("Response.Version: %v\n", version)
 		os.Exit(1)
 	}
 	if *getFlg {
-		resp, err := c.Get(ctx, &pb.GetRequest{Uuid: *key})
+		payload, found, err := client.Get[*pbData.Payload](ctx, c, *key)
 		if err != nil {
+			printQuorumFailure(err)
 			log.Fatalf("could not get value: %v", err)
 			os.Exit(2)
 		}
-		if !resp.Found {
+		if !found {
 			fmt.Println("Client GET KEY not found")
 			os.Exit(1)
 		}
-		payload := &pbData.Payload{}
-		err = resp.Value.UnmarshalTo(payload)
-		if err != nil {
-			log.Fatalf("could not unmarshal anypb: %v", err)
-			os.Exit(2)
-		}
 		fmt.Printf("Client GET Response.Value: %v\n", payload.Value)
 		os.Exit(0)
 	}
@@ -0,0 +1,306 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sync"
+
+	pb "github.com/radek-ryckowski/ssdc/examples/proto/data"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const typeURLPrefix = "type.googleapis.com/"
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Column maps a message field to a table column
+type Column struct {
+	Name string
+	// Type is the SQL column definition, e.g. "TEXT NOT NULL"
+	Type string
+}
+
+// RowMapper maps messages of one Any type to rows of one table, the key is always stored in the uuid column
+type RowMapper struct {
+	TypeURL string
+	Table   string
+	Columns []Column
+	// ToRow returns the column values of msg in Columns order
+	ToRow func(msg proto.Message) ([]interface{}, error)
+	// FromRow rebuilds the message, scan reads the columns in Columns order
+	FromRow func(scan func(dest ...interface{}) error) (proto.Message, error)
+}
+
+func (m *RowMapper) validate() error {
+	if m.TypeURL == "" || m.ToRow == nil || m.FromRow == nil {
+		return fmt.Errorf("mapper for table %s is incomplete", m.Table)
+	}
+	if !identifier.MatchString(m.Table) {
+		return fmt.Errorf("invalid table name %q", m.Table)
+	}
+	if len(m.Columns) == 0 {
+		return fmt.Errorf("mapper for table %s has no columns", m.Table)
+	}
+	for _, c := range m.Columns {
+		if !identifier.MatchString(c.Name) || c.Name == "uuid" {
+			return fmt.Errorf("invalid column name %q in table %s", c.Name, m.Table)
+		}
+	}
+	return nil
+}
+
+// MapperRegistry maps Any type URLs to row mappers
+type MapperRegistry struct {
+	mu      sync.RWMutex
+	byType  map[string]*RowMapper
+	mappers []*RowMapper
+}
+
+func NewMapperRegistry() *MapperRegistry {
+	return &MapperRegistry{
+		byType: make(map[string]*RowMapper),
+	}
+}
+
+// DefaultRegistry returns a registry with the Payload message mapped to the nodes table
+func DefaultRegistry() *MapperRegistry {
+	r := NewMapperRegistry()
+	if err := r.Register(PayloadMapper()); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Register adds a hand written mapper
+func (r *MapperRegistry) Register(m *RowMapper) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byType[m.TypeURL]; ok {
+		return fmt.Errorf("type %s is already registered", m.TypeURL)
+	}
+	for _, other := range r.mappers {
+		if other.Table == m.Table {
+			return fmt.Errorf("table %s is already used by %s", m.Table, other.TypeURL)
+		}
+	}
+	r.byType[m.TypeURL] = m
+	r.mappers = append(r.mappers, m)
+	return nil
+}
+
+// RegisterMessage derives a mapper for the type of msg with ReflectMapper and adds it
+func (r *MapperRegistry) RegisterMessage(msg proto.Message, table string) error {
+	m, err := ReflectMapper(msg, table)
+	if err != nil {
+		return err
+	}
+	return r.Register(m)
+}
+
+// Lookup returns the mapper registered for typeURL
+func (r *MapperRegistry) Lookup(typeURL string) (*RowMapper, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.byType[typeURL]
+	return m, ok
+}
+
+// Mappers returns all registered mappers in registration order
+func (r *MapperRegistry) Mappers() []*RowMapper {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*RowMapper{}, r.mappers...)
+}
+
+// PayloadMapper maps data.Payload to the nodes table
+func PayloadMapper() *RowMapper {
+	return &RowMapper{
+		TypeURL: typeURLPrefix + string((&pb.Payload{}).ProtoReflect().Descriptor().FullName()),
+		Table:   "nodes",
+		Columns: []Column{
+			{Name: "value", Type: "TEXT NOT NULL"},
+			{Name: "sum", Type: "TEXT NOT NULL"},
+			{Name: "id", Type: "INT64 NOT NULL"},
+		},
+		ToRow: func(msg proto.Message) ([]interface{}, error) {
+			p := msg.(*pb.Payload)
+			return []interface{}{p.Value, p.Sum, p.Id}, nil
+		},
+		FromRow: func(scan func(dest ...interface{}) error) (proto.Message, error) {
+			p := &pb.Payload{}
+			if err := scan(&p.Value, &p.Sum, &p.Id); err != nil {
+				return nil, err
+			}
+			return p, nil
+		},
+	}
+}
+
+// ReflectMapper derives a mapper from the message descriptor, every field becomes a column named after it.
+// Scalar fields keep their type, message fields are stored marshalled as BLOB.
+// Repeated and map fields are not supported, such messages need a hand written mapper.
+func ReflectMapper(msg proto.Message, table string) (*RowMapper, error) {
+	md := msg.ProtoReflect().Descriptor()
+	fields := md.Fields()
+	columns := make([]Column, 0, fields.Len())
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if fd.IsList() || fd.IsMap() {
+			return nil, fmt.Errorf("%s: repeated field %s cannot be mapped to a column", md.FullName(), fd.Name())
+		}
+		columns = append(columns, Column{Name: string(fd.Name()), Type: columnType(fd)})
+	}
+	msgType := msg.ProtoReflect().Type()
+	return &RowMapper{
+		TypeURL: typeURLPrefix + string(md.FullName()),
+		Table:   table,
+		Columns: columns,
+		ToRow: func(msg proto.Message) ([]interface{}, error) {
+			m := msg.ProtoReflect()
+			row := make([]interface{}, fields.Len())
+			for i := 0; i < fields.Len(); i++ {
+				value, err := columnValue(m, fields.Get(i))
+				if err != nil {
+					return nil, err
+				}
+				row[i] = value
+			}
+			return row, nil
+		},
+		FromRow: func(scan func(dest ...interface{}) error) (proto.Message, error) {
+			dest := make([]interface{}, fields.Len())
+			for i := 0; i < fields.Len(); i++ {
+				dest[i] = scanDest(fields.Get(i))
+			}
+			if err := scan(dest...); err != nil {
+				return nil, err
+			}
+			m := msgType.New()
+			for i := 0; i < fields.Len(); i++ {
+				if err := setField(m, fields.Get(i), dest[i]); err != nil {
+					return nil, err
+				}
+			}
+			return m.Interface(), nil
+		},
+	}, nil
+}
+
+func columnType(fd protoreflect.FieldDescriptor) string {
+	switch fd.Kind() {
+	case protoreflect.BoolKind, protoreflect.EnumKind,
+		protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return "INTEGER"
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return "REAL"
+	case protoreflect.StringKind:
+		return "TEXT"
+	}
+	return "BLOB"
+}
+
+func columnValue(m protoreflect.Message, fd protoreflect.FieldDescriptor) (interface{}, error) {
+	if fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+		if !m.Has(fd) {
+			return nil, nil
+		}
+		return proto.Marshal(m.Get(fd).Message().Interface())
+	}
+	v := m.Get(fd)
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool(), nil
+	case protoreflect.EnumKind:
+		return int64(v.Enum()), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return v.Int(), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return int64(v.Uint()), nil
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float(), nil
+	case protoreflect.StringKind:
+		return v.String(), nil
+	}
+	return v.Bytes(), nil
+}
+
+func scanDest(fd protoreflect.FieldDescriptor) interface{} {
+	switch columnType(fd) {
+	case "INTEGER":
+		return &sql.NullInt64{}
+	case "REAL":
+		return &sql.NullFloat64{}
+	case "TEXT":
+		return &sql.NullString{}
+	}
+	return &[]byte{}
+}
+
+func setField(m protoreflect.Message, fd protoreflect.FieldDescriptor, dest interface{}) error {
+	switch d := dest.(type) {
+	case *sql.NullInt64:
+		if !d.Valid {
+			return nil
+		}
+		switch fd.Kind() {
+		case protoreflect.BoolKind:
+			m.Set(fd, protoreflect.ValueOfBool(d.Int64 != 0))
+		case protoreflect.EnumKind:
+			m.Set(fd, protoreflect.ValueOfEnum(protoreflect.EnumNumber(d.Int64)))
+		case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+			m.Set(fd, protoreflect.ValueOfInt32(int32(d.Int64)))
+		case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+			m.Set(fd, protoreflect.ValueOfInt64(d.Int64))
+		case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+			m.Set(fd, protoreflect.ValueOfUint32(uint32(d.Int64)))
+		default:
+			m.Set(fd, protoreflect.ValueOfUint64(uint64(d.Int64)))
+		}
+	case *sql.NullFloat64:
+		if !d.Valid {
+			return nil
+		}
+		if fd.Kind() == protoreflect.FloatKind {
+			m.Set(fd, protoreflect.ValueOfFloat32(float32(d.Float64)))
+		} else {
+			m.Set(fd, protoreflect.ValueOfFloat64(d.Float64))
+		}
+	case *sql.NullString:
+		if d.Valid {
+			m.Set(fd, protoreflect.ValueOfString(d.String))
+		}
+	case *[]byte:
+		if *d == nil {
+			return nil
+		}
+		if fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+			field := m.NewField(fd)
+			if err := proto.Unmarshal(*d, field.Message().Interface()); err != nil {
+				return err
+			}
+			m.Set(fd, field)
+		} else {
+			m.Set(fd, protoreflect.ValueOfBytes(*d))
+		}
+	}
+	return nil
+}
+
+// marshalAny wraps msg into Any and marshals it the way the cache stores values
+func marshalAny(msg proto.Message) ([]byte, error) {
+	anypbData, err := anypb.New(msg)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(anypbData)
+}
@@ -1,8 +1,10 @@
 package db
 
 import (
+	"sort"
 	"sync"
 
+	ssdcdb "github.com/radek-ryckowski/ssdc/db"
 	pb "github.com/radek-ryckowski/ssdc/proto/cache"
 )
 
@@ -34,3 +36,31 @@ func (db *InMemoryDatabase) Get(key string) ([]byte, error) {
 	}
 	return nil, nil
 }
+
+func (db *InMemoryDatabase) MultiGet(keys []string) (map[string][]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if v, ok := db.data[key]; ok {
+			values[key] = v
+		}
+	}
+	return values, nil
+}
+
+// NewIterator returns a snapshot iterator over keys in range [start, end)
+func (db *InMemoryDatabase) NewIterator(start, end string) (ssdcdb.Iterator, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	kvs := []*pb.KeyValue{}
+	for k, v := range db.data {
+		if ssdcdb.InRange(k, start, end) {
+			kvs = append(kvs, &pb.KeyValue{Key: []byte(k), Value: v})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return string(kvs[i].Key) < string(kvs[j].Key)
+	})
+	return ssdcdb.NewSliceIterator(kvs), nil
+}
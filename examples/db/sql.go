@@ -1,13 +1,14 @@
 package db
 
 import (
-	"context"
 	"database/sql"
 	"fmt"
 	"runtime"
+	"strings"
+	"sync"
 
 	_ "github.com/mattn/go-sqlite3"
-	pb "github.com/radek-ryckowski/ssdc/examples/proto/data"
+	ssdcdb "github.com/radek-ryckowski/ssdc/db"
 	cachepb "github.com/radek-ryckowski/ssdc/proto/cache"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
@@ -21,108 +22,335 @@ func annotateError(err error) error {
 
 // DBStorage struct to interact with SQLite database
 type SQLDBStorage struct {
-	db *sql.DB
+	db       *sql.DB
+	registry *MapperRegistry
+	mu       sync.Mutex
+	tables   map[string]bool
 }
 
 // NewDBStorage initializes the SQLite database and returns a DBStorage instance
 func NewSQLDBStorage(dataSourceName string) (*SQLDBStorage, error) {
+	return NewSQLDBStorageWithRegistry(dataSourceName, DefaultRegistry())
+}
+
+// NewSQLDBStorageWithRegistry initializes the SQLite database storing every registered message type in its own table
+func NewSQLDBStorageWithRegistry(dataSourceName string, registry *MapperRegistry) (*SQLDBStorage, error) {
 	db, err := sql.Open("sqlite3", dataSourceName)
 	if err != nil {
 		return nil, annotateError(err)
 	}
-	// Create table if not exists
+	// Create key index table if not exists, it records which table holds the key
 	createTableQuery := `
-	CREATE TABLE IF NOT EXISTS nodes (
+	CREATE TABLE IF NOT EXISTS ssdc_keys (
 		uuid STRING PRIMARY KEY,
-		value TEXT NOT NULL,
-		sum TEXT NOT NULL,
-		id INT64 NOT NULL
+		type_url TEXT NOT NULL
 	);`
 	_, err = db.Exec(createTableQuery)
 	if err != nil {
 		return nil, annotateError(err)
 	}
+	s := &SQLDBStorage{
+		db:       db,
+		registry: registry,
+		tables:   make(map[string]bool),
+	}
+	for _, m := range registry.Mappers() {
+		if err := s.ensureTable(m); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// ensureTable creates the table of a mapper if not exists
+func (s *SQLDBStorage) ensureTable(m *RowMapper) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tables[m.Table] {
+		return nil
+	}
+	columns := make([]string, len(m.Columns))
+	for i, c := range m.Columns {
+		columns[i] = c.Name + " " + c.Type
+	}
+	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (uuid STRING PRIMARY KEY, %s);", m.Table, strings.Join(columns, ", "))
+	if _, err := s.db.Exec(createTableQuery); err != nil {
+		return annotateError(err)
+	}
+	// rows written before the key index existed are indexed once so reads only consult the index
+	indexQuery := fmt.Sprintf(`INSERT OR IGNORE INTO ssdc_keys (uuid, type_url) SELECT uuid, ? FROM %s`, m.Table)
+	if _, err := s.db.Exec(indexQuery, m.TypeURL); err != nil {
+		return annotateError(err)
+	}
+	s.tables[m.Table] = true
+	return nil
+}
 
-	return &SQLDBStorage{db: db}, nil
+type mappedRow struct {
+	mapper *RowMapper
+	values []interface{}
 }
 
-// Push inserts a batch of key-value pairs into the database
+// Push inserts a batch of key-value pairs, each value goes to the table registered for its type
 func (s *SQLDBStorage) Push(batch []*cachepb.KeyValue) error {
-	dbData := make(map[string]*pb.Payload)
+	dbData := make(map[string]*mappedRow)
 	for _, kv := range batch {
 		anyEntry := anypb.Any{}
 		if err := proto.Unmarshal(kv.Value, &anyEntry); err != nil {
 			return annotateError(err)
 		}
-		payload := &pb.Payload{}
-		err := anyEntry.UnmarshalTo(payload)
+		mapper, ok := s.registry.Lookup(anyEntry.TypeUrl)
+		if !ok {
+			return annotateError(fmt.Errorf("no row mapper registered for %s", anyEntry.TypeUrl))
+		}
+		msg, err := anyEntry.UnmarshalNew()
 		if err != nil {
 			return annotateError(err)
 		}
-		dbData[string(kv.Key)] = payload
+		values, err := mapper.ToRow(msg)
+		if err != nil {
+			return annotateError(err)
+		}
+		if len(values) != len(mapper.Columns) {
+			return annotateError(fmt.Errorf("mapper for %s returned %d values for %d columns", mapper.TypeURL, len(values), len(mapper.Columns)))
+		}
+		if err := s.ensureTable(mapper); err != nil {
+			return err
+		}
+		dbData[string(kv.Key)] = &mappedRow{mapper: mapper, values: values}
 	}
-	// check and remove all keys which already exist in the database
-	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+
+	tx, err := s.db.Begin()
 	if err != nil {
 		return annotateError(err)
 	}
-	for k := range dbData {
-		selectQuery := `SELECT uuid FROM nodes WHERE uuid = ?`
+	for k, row := range dbData {
+		// keys which already exist in the database are not overwritten
 		var uuid string
-		err := tx.QueryRow(selectQuery, k).Scan(&uuid)
-		if err != nil {
-			if err != sql.ErrNoRows {
-				continue
-			}
-		} else {
-			delete(dbData, k)
+		err := tx.QueryRow(`SELECT uuid FROM ssdc_keys WHERE uuid = ?`, k).Scan(&uuid)
+		if err == nil {
+			continue
+		}
+		if err != sql.ErrNoRows {
+			tx.Rollback()
+			return annotateError(err)
+		}
+		if _, err := tx.Exec(`INSERT INTO ssdc_keys (uuid, type_url) VALUES (?, ?)`, k, row.mapper.TypeURL); err != nil {
+			tx.Rollback()
+			return annotateError(err)
+		}
+		columns := make([]string, len(row.mapper.Columns))
+		for i, c := range row.mapper.Columns {
+			columns[i] = c.Name
+		}
+		insertQuery := fmt.Sprintf(`INSERT INTO %s (uuid, %s) VALUES (?%s)`,
+			row.mapper.Table, strings.Join(columns, ", "), strings.Repeat(", ?", len(columns)))
+		if _, err := tx.Exec(insertQuery, append([]interface{}{k}, row.values...)...); err != nil {
+			tx.Rollback()
+			return annotateError(err)
 		}
 	}
-	err = tx.Commit()
+	return tx.Commit()
+}
+
+func (s *SQLDBStorage) Get(key string) ([]byte, error) {
+	values, err := s.MultiGet([]string{key})
 	if err != nil {
-		return annotateError(err)
+		return nil, err
 	}
+	return values[key], nil
+}
 
-	tx, err = s.db.Begin()
-	if err != nil {
-		return annotateError(err)
+// multiGetChunk limits the number of placeholders in one query (SQLite allows 999 by default)
+const multiGetChunk = 500
+
+func placeholders(n int) string {
+	return "?" + strings.Repeat(", ?", n-1)
+}
+
+func stringArgs(keys []string) []interface{} {
+	args := make([]interface{}, len(keys))
+	for i, k := range keys {
+		args[i] = k
+	}
+	return args
+}
+
+// MultiGet reads a batch of keys from the database, keys which are not in the key index or whose type has no
+// registered mapper are not found
+func (s *SQLDBStorage) MultiGet(keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	for start := 0; start < len(keys); start += multiGetChunk {
+		end := start + multiGetChunk
+		if end > len(keys) {
+			end = len(keys)
+		}
+		chunk := keys[start:end]
+		byMapper := make(map[*RowMapper][]string)
+		rows, err := s.db.Query(`SELECT uuid, type_url FROM ssdc_keys WHERE uuid IN (`+placeholders(len(chunk))+`)`, stringArgs(chunk)...)
+		if err != nil {
+			return nil, annotateError(err)
+		}
+		for rows.Next() {
+			var uuid, typeURL string
+			if err := rows.Scan(&uuid, &typeURL); err != nil {
+				rows.Close()
+				return nil, annotateError(err)
+			}
+			if mapper, ok := s.registry.Lookup(typeURL); ok {
+				byMapper[mapper] = append(byMapper[mapper], uuid)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, annotateError(err)
+		}
+		for mapper, mapperKeys := range byMapper {
+			if err := s.readRows(mapper, mapperKeys, values); err != nil {
+				return nil, err
+			}
+		}
 	}
-	insertQuery := `INSERT INTO nodes (uuid, value, sum, id) VALUES (?, ?, ?, ?)`
-	stmt, err := tx.Prepare(insertQuery)
+	return values, nil
+}
+
+// readRows reads keys from the table of mapper and stores them as marshalled Any in values
+func (s *SQLDBStorage) readRows(mapper *RowMapper, keys []string, values map[string][]byte) error {
+	columns := make([]string, len(mapper.Columns))
+	for i, c := range mapper.Columns {
+		columns[i] = c.Name
+	}
+	selectQuery := fmt.Sprintf(`SELECT uuid, %s FROM %s WHERE uuid IN (%s)`, strings.Join(columns, ", "), mapper.Table, placeholders(len(keys)))
+	rows, err := s.db.Query(selectQuery, stringArgs(keys)...)
 	if err != nil {
 		return annotateError(err)
 	}
-	defer stmt.Close()
-	for k, v := range dbData {
-		_, err = stmt.Exec(k, v.Value, v.Sum, v.Id)
+	defer rows.Close()
+	for rows.Next() {
+		var uuid string
+		msg, err := mapper.FromRow(func(dest ...interface{}) error {
+			return rows.Scan(append([]interface{}{&uuid}, dest...)...)
+		})
+		if err != nil {
+			return annotateError(err)
+		}
+		if _, ok := values[uuid]; ok {
+			continue
+		}
+		data, err := marshalAny(msg)
 		if err != nil {
-			tx.Rollback()
 			return annotateError(err)
 		}
+		values[uuid] = data
 	}
-	return tx.Commit()
+	if err := rows.Err(); err != nil {
+		return annotateError(err)
+	}
+	return nil
 }
-func (s *SQLDBStorage) Get(key string) ([]byte, error) {
-	selectQuery := `SELECT value, sum, id FROM nodes WHERE uuid = ?`
-	var value, sum string
-	var id int64
-	err := s.db.QueryRow(selectQuery, key).Scan(&value, &sum, &id)
+
+// scanPageSize is the number of keys read from the key index at once by iterators
+const scanPageSize = 500
+
+// NewIterator returns an iterator over keys in range [start, end), keys are read in pages from the key index
+func (s *SQLDBStorage) NewIterator(start, end string) (ssdcdb.Iterator, error) {
+	return &sqlIterator{s: s, start: start, end: end, first: true, pos: -1}, nil
+}
+
+type sqlIterator struct {
+	s      *SQLDBStorage
+	start  string
+	end    string
+	first  bool
+	done   bool
+	keys   []string
+	values map[string][]byte
+	pos    int
+	err    error
+}
+
+// fetch reads the next page of keys after the last returned one
+func (it *sqlIterator) fetch() error {
+	op := ">"
+	from := it.start
+	if it.first {
+		op = ">="
+	} else {
+		from = it.keys[len(it.keys)-1]
+	}
+	query := `SELECT uuid FROM ssdc_keys WHERE uuid ` + op + ` ?`
+	args := []interface{}{from}
+	if it.end != "" {
+		query += ` AND uuid < ?`
+		args = append(args, it.end)
+	}
+	query += fmt.Sprintf(` ORDER BY uuid LIMIT %d`, scanPageSize)
+	rows, err := it.s.db.Query(query, args...)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+		return annotateError(err)
+	}
+	keys := []string{}
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			rows.Close()
+			return annotateError(err)
 		}
-		return nil, annotateError(err)
+		keys = append(keys, uuid)
 	}
-	data := &pb.Payload{
-		Value: value,
-		Sum:   sum,
-		Id:    id,
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return annotateError(err)
+	}
+	it.first = false
+	it.done = len(keys) < scanPageSize
+	if len(keys) == 0 {
+		it.keys = nil
+		return nil
 	}
-	anypbData, err := anypb.New(data)
+	values, err := it.s.MultiGet(keys)
 	if err != nil {
-		return nil, annotateError(err)
+		return err
 	}
-	return proto.Marshal(anypbData)
+	it.keys, it.values, it.pos = keys, values, -1
+	return nil
+}
+
+func (it *sqlIterator) Next() bool {
+	for it.err == nil {
+		it.pos++
+		if it.pos < len(it.keys) {
+			if _, ok := it.values[it.keys[it.pos]]; ok {
+				return true
+			}
+			continue
+		}
+		if it.done && !it.first {
+			return false
+		}
+		if it.err = it.fetch(); it.err != nil || len(it.keys) == 0 {
+			return false
+		}
+	}
+	return false
+}
+
+func (it *sqlIterator) Key() string {
+	return it.keys[it.pos]
+}
+
+func (it *sqlIterator) Value() []byte {
+	return it.values[it.keys[it.pos]]
+}
+
+func (it *sqlIterator) Err() error {
+	return it.err
+}
+
+func (it *sqlIterator) Close() error {
+	return nil
 }
 
 // Close closes the database connection
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	pb "github.com/radek-ryckowski/ssdc/examples/proto/data"
+	cachepb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func marshalledAny(t *testing.T, msg proto.Message) []byte {
+	data, err := marshalAny(msg)
+	if err != nil {
+		t.Fatalf("Failed to marshal %v: %v", msg, err)
+	}
+	return data
+}
+
+func TestSQLDBStorageMapsTypesToTables(t *testing.T) {
+	registry := DefaultRegistry()
+	assert.NoError(t, registry.RegisterMessage(&durationpb.Duration{}, "durations"))
+	storage, err := NewSQLDBStorageWithRegistry(path.Join(t.TempDir(), "test.db"), registry)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+
+	payload := &pb.Payload{Value: "value", Sum: "sum", Id: 1}
+	duration := durationpb.New(90 * time.Second)
+	err = storage.Push([]*cachepb.KeyValue{
+		{Key: []byte("payload"), Value: marshalledAny(t, payload)},
+		{Key: []byte("duration"), Value: marshalledAny(t, duration)},
+	})
+	assert.NoError(t, err)
+
+	var seconds int64
+	assert.NoError(t, storage.db.QueryRow(`SELECT seconds FROM durations WHERE uuid = ?`, "duration").Scan(&seconds))
+	assert.Equal(t, int64(90), seconds)
+
+	values, err := storage.MultiGet([]string{"payload", "duration", "missing"})
+	assert.NoError(t, err)
+	assert.Len(t, values, 2)
+	for key, expected := range map[string]proto.Message{"payload": payload, "duration": duration} {
+		any := &anypb.Any{}
+		assert.NoError(t, proto.Unmarshal(values[key], any))
+		msg, err := any.UnmarshalNew()
+		assert.NoError(t, err)
+		assert.True(t, proto.Equal(expected, msg), "unexpected value for %s: %v", key, msg)
+	}
+
+	// keys which already exist are not overwritten
+	assert.NoError(t, storage.Push([]*cachepb.KeyValue{{Key: []byte("payload"), Value: marshalledAny(t, duration)}}))
+	var count int
+	assert.NoError(t, storage.db.QueryRow(`SELECT COUNT(*) FROM durations`).Scan(&count))
+	assert.Equal(t, 1, count)
+	value, err := storage.Get("payload")
+	assert.NoError(t, err)
+	assert.Equal(t, marshalledAny(t, payload), value)
+}
+
+func TestSQLDBStorageIndexesRowsWrittenBeforeKeyIndex(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "test.db")
+	legacy, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = legacy.Exec(`CREATE TABLE nodes (uuid STRING PRIMARY KEY, value TEXT NOT NULL, sum TEXT NOT NULL, id INT64 NOT NULL);
+	INSERT INTO nodes (uuid, value, sum, id) VALUES ('legacy', 'value', 'sum', 7);`)
+	assert.NoError(t, err)
+	assert.NoError(t, legacy.Close())
+
+	storage, err := NewSQLDBStorage(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+	values, err := storage.MultiGet([]string{"legacy", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"legacy": marshalledAny(t, &pb.Payload{Value: "value", Sum: "sum", Id: 7})}, values)
+}
+
+func TestSQLDBStorageIterator(t *testing.T) {
+	storage, err := NewSQLDBStorage(path.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+	defer storage.Close()
+	batch := []*cachepb.KeyValue{}
+	for i := 0; i < scanPageSize+10; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		batch = append(batch, &cachepb.KeyValue{Key: []byte(key), Value: marshalledAny(t, &pb.Payload{Value: key})})
+	}
+	assert.NoError(t, storage.Push(batch))
+
+	it, err := storage.NewIterator("key0005", "key0600")
+	assert.NoError(t, err)
+	defer it.Close()
+	keys := []string{}
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	assert.NoError(t, it.Err())
+	assert.Len(t, keys, scanPageSize+5)
+	assert.Equal(t, "key0005", keys[0])
+	assert.Equal(t, fmt.Sprintf("key%04d", scanPageSize+9), keys[len(keys)-1])
+}
@@ -1,23 +1,30 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/radek-ryckowski/ssdc/breaker"
 	"github.com/radek-ryckowski/ssdc/cache"
 	"github.com/radek-ryckowski/ssdc/cluster"
+	ssdcdb "github.com/radek-ryckowski/ssdc/db"
 	"github.com/radek-ryckowski/ssdc/examples/db"
+	"github.com/radek-ryckowski/ssdc/raft"
 	cacheService "github.com/radek-ryckowski/ssdc/server"
+	synclog "github.com/radek-ryckowski/ssdc/sync"
 
 	pb "github.com/radek-ryckowski/ssdc/proto/cache"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
 )
 
@@ -29,6 +36,26 @@ var (
 	slogPath    = flag.String("slog", "/tmp/slog", "the path to the sync log directory")
 	dbPath      = flag.String("db", "/tmp/test.db", "the path to the SQLite database")
 	syncDelay   = flag.Int("sync", 1800, "maximum delay in sec before WAL is flushed")
+	readQuorum  = flag.Int("read-quorum", 0, "number of nodes which have to answer a read, 0 means a majority")
+	self        = flag.String("self", "", "the address peers reach this node at, required with -replication")
+	replication = flag.Int("replication", 0, "number of nodes storing every key, 0 stores every key on every node")
+	vnodes      = flag.Int("vnodes", 0, "virtual nodes per member on the hash ring, 0 means the default")
+	membership  = flag.String("membership", "", "file persisting the peers changed at runtime, its peers replace -peers when it exists")
+	gossip      = flag.Bool("gossip", false, "discover peers with gossip, -peers are then only the seeds to join through")
+	antiEntropy = flag.Duration("anti-entropy", 10*time.Minute, "interval between anti-entropy rounds with the peers, 0 disables them")
+	repairRate  = flag.Int("repair-rate", 0, "keys per second repaired by anti-entropy, 0 means the default")
+	nodeIDPath  = flag.String("node-id", "/tmp/ssdc-node-id", "file keeping the persistent id of this node, it is generated on first start")
+	bootstrap   = flag.Bool("bootstrap", false, "copy the keys of this node from the peers before reporting ready")
+	bootState   = flag.String("bootstrap-state", "/tmp/bootstrap.json", "file keeping the bootstrap progress, an interrupted bootstrap resumes from it")
+	bootRate    = flag.Int("bootstrap-rate", 0, "keys per second copied while bootstrapping, 0 means the default")
+	raftPrefix  = flag.String("raft-prefixes", "", "comma-separated key prefixes written through the Raft log, requires -self")
+	raftPeers   = flag.String("raft-peers", "", "comma-separated addresses of the other Raft members, defaults to -peers")
+	raftDir     = flag.String("raft-dir", "/tmp/raft", "the path to the Raft log and snapshots")
+	hintMaxAge  = flag.Duration("hint-max-age", 0, "how long a hint for a peer is kept in the sync log, 0 keeps it until it is replayed")
+	hintMaxSize = flag.Int64("hint-max-bytes", 0, "maximum size of the hints kept for one peer, the oldest are evicted first, 0 means no limit")
+	deadLetter  = flag.Bool("hint-dead-letter", false, "keep the evicted hints in the dead-letter part of the sync log instead of dropping them")
+	deadMaxAge  = flag.Duration("dead-letter-max-age", 0, "how long an evicted hint is kept as a dead letter, 0 uses -hint-max-age")
+	deadMaxSize = flag.Int64("dead-letter-max-bytes", 0, "maximum size of the dead letters kept for one peer, 0 uses -hint-max-bytes")
 
 	kaep = keepalive.EnforcementPolicy{
 		MinTime:             5 * time.Second, // If a client pings more than once every 5 seconds, terminate the connection
@@ -67,6 +94,13 @@ func main() {
 		log.Fatalf("failed to create SQLDBStorage: %v", err)
 	}
 
+	storage := ssdcdb.Chain(sqldb,
+		ssdcdb.WithMetrics("sqlite"),
+		ssdcdb.WithCircuitBreaker("sqlite", breaker.Config{FailureThreshold: 5, OpenTimeout: 30 * time.Second}),
+		ssdcdb.WithTimeout(10*time.Second),
+		ssdcdb.WithRetry(ssdcdb.RetryConfig{Attempts: 3, InitialBackoff: 50 * time.Millisecond, MaxBackoff: time.Second}),
+	)
+
 	tickerDelay := time.Duration(*syncDelay) * time.Second
 
 	config := &cache.CacheConfig{
@@ -74,7 +108,7 @@ func main() {
 		RoCacheSize:       65536,
 		MaxSizeOfChannel:  8192,
 		WalPath:           *walPath,
-		DBStorage:         sqldb,
+		DBStorage:         storage,
 		Logger:            logger,
 		SlogPath:          *slogPath,
 		WalSegmentSize:    1024 * 1024 * 10,
@@ -86,31 +120,109 @@ func main() {
 		log.Fatal("Error creating cache")
 		return
 	}
+	cServer.SetHintLimits(synclog.Limits{
+		MaxAge:                 *hintMaxAge,
+		MaxNodeBytes:           *hintMaxSize,
+		DeadLetter:             *deadLetter,
+		DeadLetterMaxAge:       *deadMaxAge,
+		DeadLetterMaxNodeBytes: *deadMaxSize,
+	})
 	peerList := strings.Split(*peers, ",")
 
 	if *peers == "" {
 		log.Fatalf("no peers provided")
 	}
-	peers := make([]*cluster.CacheClient, 0)
-	for node, peer := range peerList {
-		ccc := &cluster.CacheClient{
-			Address: peer,
-			Active:  true,
-			Connect: func(address string) (*grpc.ClientConn, error) {
-				conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithKeepaliveParams(kacp))
-				return conn, err
-			},
+	if err := cServer.MigrateLegacyHints(peerList); err != nil {
+		log.Printf("failed to migrate legacy hints: %v", err)
+	}
+	connect := func(address string) (*grpc.ClientConn, error) {
+		conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithKeepaliveParams(kacp))
+		return conn, err
+	}
+	nodeID, err := cluster.LoadNodeID(*nodeIDPath)
+	if err != nil {
+		log.Fatalf("failed to load node id: %v", err)
+	}
+	log.Printf("node id %s", nodeID)
+	cServer.SetNodeID(nodeID)
+	cServer.SetReadQuorum(*readQuorum)
+	if err := cServer.SetAntiEntropy(cacheService.AntiEntropyConfig{Interval: *antiEntropy, KeysPerSecond: *repairRate}); err != nil {
+		log.Fatalf("invalid anti-entropy settings: %v", err)
+	}
+	if *replication > 0 || *gossip {
+		if *self == "" {
+			log.Fatalf("-self is required with -replication and -gossip")
+		}
+		cServer.SetReplication(*self, *replication, *vnodes)
+	}
+	if *gossip {
+		membership := cluster.NewMembership(cluster.MembershipConfig{
+			Self:    *self,
+			Seeds:   peerList,
+			Connect: connect,
+		})
+		pb.RegisterMembershipServiceServer(s, membership)
+		cServer.FollowMembership(membership, connect)
+		membership.Start()
+	} else {
+		peers := make([]*cluster.CacheClient, 0)
+		for _, peer := range peerList {
+			peers = append(peers, &cluster.CacheClient{
+				Address: peer,
+				Connect: connect,
+			})
+		}
+		if *membership != "" {
+			stored, err := cacheService.LoadPeers(*membership, connect)
+			if err != nil {
+				log.Fatalf("failed to load membership: %v", err)
+			}
+			if len(stored) != 0 {
+				peers = stored
+			}
+		}
+		for _, ccc := range peers {
+			ccc.Lock()
+			err := ccc.Init()
+			ccc.Unlock()
+			if err != nil {
+				log.Printf("could not connect to peer %s: %v", ccc.Address, err)
+			}
+		}
+		cServer.SetPeers(peers)
+	}
+	if *membership != "" {
+		if err := cServer.SetMembershipFile(*membership); err != nil {
+			log.Fatalf("failed to persist membership: %v", err)
+		}
+	}
+
+	if *raftPrefix != "" {
+		if *self == "" {
+			log.Fatalf("-self is required with -raft-prefixes")
 		}
-		ccc.Lock()
-		ccc.Node = node
-		err := ccc.Init()
-		ccc.Unlock()
+		members := peerList
+		if *raftPeers != "" {
+			members = strings.Split(*raftPeers, ",")
+		}
+		machine, err := cServer.RaftStateMachine(filepath.Join(*raftDir, "applied"))
+		if err != nil {
+			log.Fatalf("failed to load raft state: %v", err)
+		}
+		node, err := raft.NewNode(raft.Config{
+			ID:           *self,
+			Peers:        members,
+			Dir:          *raftDir,
+			Transport:    raft.NewGRPCTransport(connect),
+			StateMachine: machine,
+		})
 		if err != nil {
-			log.Printf("could not connect to peer %s: %v", peer, err)
+			log.Fatalf("failed to start raft: %v", err)
 		}
-		peers = append(peers, ccc)
+		cServer.SetRaft(node, strings.Split(*raftPrefix, ","))
+		pb.RegisterRaftServiceServer(s, node)
+		node.Start()
 	}
-	cServer.SetPeers(peers)
 
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
@@ -121,6 +233,25 @@ func main() {
 	}()
 	cServer.Start()
 	pb.RegisterCacheServiceServer(s, cServer)
+	pb.RegisterAdminServiceServer(s, cacheService.NewAdminServer(cServer, connect))
+	healthpb.RegisterHealthServer(s, cServer.HealthServer())
+	identity := cluster.NewIdentity(nodeID)
+	identity.SetOnHello(cServer.PeerHello)
+	pb.RegisterNodeServiceServer(s, identity)
+	pb.RegisterAntiEntropyServiceServer(s, cacheService.NewAntiEntropyServer(cServer))
+	if *bootstrap {
+		bootConfig := cacheService.BootstrapConfig{StatePath: *bootState, KeysPerSecond: *bootRate}
+		if err := cServer.BeginBootstrap(bootConfig); err != nil {
+			log.Fatalf("failed to load the bootstrap state: %v", err)
+		}
+		go func() {
+			err := cServer.Bootstrap(context.Background(), bootConfig)
+			if err != nil {
+				log.Fatalf("bootstrap failed, restart to resume: %v", err)
+			}
+			log.Printf("bootstrap done")
+		}()
+	}
 	log.Printf("server listening at %v", lis.Addr())
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
@@ -0,0 +1,836 @@
+// Package raft replicates a log of commands between a fixed set of members with the Raft consensus
+// algorithm: leader election, log replication, snapshots and linearizable reads through a read index.
+package raft
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DefaultElectionTimeout   = 500 * time.Millisecond
+	DefaultHeartbeatInterval = 50 * time.Millisecond
+	DefaultSnapshotThreshold = 8192
+	// maxAppendEntries bounds the entries sent in one AppendEntries call
+	maxAppendEntries = 256
+)
+
+var (
+	// ErrNotLeader is returned by Propose on a node which is not the leader
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrNoLeader is returned when no leader is known, e.g. during an election
+	ErrNoLeader = errors.New("raft: no leader")
+	// ErrLost is returned by Propose when a new leader replaced the entry before it was committed
+	ErrLost = errors.New("raft: entry lost to a leader change")
+	// ErrStopped is returned once the node is stopped
+	ErrStopped = errors.New("raft: node stopped")
+)
+
+var (
+	raftTerm = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "raft_term",
+		Help: "Current Raft term of the node",
+	})
+
+	raftCommitIndex = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "raft_commit_index",
+		Help: "Index of the last committed Raft entry known to the node",
+	})
+
+	raftLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "raft_leader",
+		Help: "1 while the node is the Raft leader",
+	})
+
+	raftElections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "raft_elections_total",
+		Help: "Total number of elections started by the node",
+	})
+
+	raftSnapshots = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "raft_snapshots_total",
+		Help: "Total number of snapshots taken or installed by the node",
+	})
+)
+
+// Role is the role of a node in its current term
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// StateMachine is the state the log is applied to. A state machine which survives restarts remembers the
+// index of the last entry it applied, so that no entry is applied twice.
+type StateMachine interface {
+	// Apply applies the data of the committed entry at index, the result is returned by Propose on the leader
+	Apply(index uint64, data []byte) (any, error)
+	// Applied returns the index of the last entry reflected in the state, 0 when the state is empty
+	Applied() uint64
+	// Snapshot returns the whole state, it is called between applies
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with a snapshot taken at index
+	Restore(index uint64, data []byte) error
+}
+
+// Config configures a node, zero durations and thresholds use the defaults
+type Config struct {
+	// ID of this node, the Transport reaches the members by their ids
+	ID string
+	// Peers are the ids of the other members
+	Peers []string
+	// Dir keeps the log, the snapshot and the vote of the node
+	Dir          string
+	Transport    Transport
+	StateMachine StateMachine
+	// ElectionTimeout is the minimum time without a leader before an election, the actual timeout is random up to twice as long
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is the number of applied entries after which the log is compacted into a snapshot
+	SnapshotThreshold uint64
+}
+
+type result struct {
+	value any
+	err   error
+}
+
+// waiter is a Propose waiting for its entry to be applied
+type waiter struct {
+	term uint64
+	ch   chan result
+}
+
+// Node is a member of a Raft group, it serves RaftService for the other members
+type Node struct {
+	pb.UnimplementedRaftServiceServer
+	config  Config
+	mu      sync.Mutex
+	storage *storage
+	role    Role
+	term    uint64
+	// votedFor is the candidate this node voted for in term
+	votedFor    string
+	leader      string
+	commitIndex uint64
+	lastApplied uint64
+	// nextIndex and matchIndex are kept by the leader for every peer
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicating map[string]bool
+	deadline    time.Time
+	waiters     map[uint64]waiter
+	// applied is closed and replaced whenever lastApplied moves
+	applied chan struct{}
+	// applyMu serializes the state machine between applying entries and installing snapshots
+	applyMu  sync.Mutex
+	apply    chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewNode restores the node from its directory, Start makes it take part in the group
+func NewNode(config Config) (*Node, error) {
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+	s, state, err := openStorage(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config:      config,
+		storage:     s,
+		term:        state.Term,
+		votedFor:    state.VotedFor,
+		nextIndex:   map[string]uint64{},
+		matchIndex:  map[string]uint64{},
+		replicating: map[string]bool{},
+		waiters:     map[uint64]waiter{},
+		applied:     make(chan struct{}),
+		apply:       make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	// entries the state machine applied before the restart are committed and not applied again
+	applied := config.StateMachine.Applied()
+	if applied < s.snapshot.Index {
+		if err := config.StateMachine.Restore(s.snapshot.Index, s.snapshot.Data); err != nil {
+			s.close()
+			return nil, err
+		}
+		applied = s.snapshot.Index
+	}
+	n.commitIndex = applied
+	n.lastApplied = applied
+	n.resetDeadline()
+	return n, nil
+}
+
+// Start runs the election timer, the heartbeats and the applying of committed entries
+func (n *Node) Start() {
+	n.wg.Add(2)
+	go n.run()
+	go n.applyCommitted()
+}
+
+// Stop stops the node and closes its log, pending proposals fail with ErrStopped. Stopping twice is a no-op.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+		n.wg.Wait()
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for index, w := range n.waiters {
+			w.ch <- result{err: ErrStopped}
+			delete(n.waiters, index)
+		}
+		n.storage.close()
+	})
+}
+
+// Leader returns the id of the current leader, empty when it is not known
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// Role returns the role of the node
+func (n *Node) Role() Role {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role
+}
+
+// Size returns the number of members of the group
+func (n *Node) Size() int {
+	return len(n.config.Peers) + 1
+}
+
+func (n *Node) stopped() bool {
+	select {
+	case <-n.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *Node) quorum() int {
+	return n.Size()/2 + 1
+}
+
+// resetDeadline starts a new random election timeout, it must be called with mu held
+func (n *Node) resetDeadline() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// persist saves the term and the vote, it must be called with mu held
+func (n *Node) persist() {
+	if err := n.storage.saveState(hardState{Term: n.term, VotedFor: n.votedFor}); err != nil {
+		log.Printf("raft: could not save state: %v", err)
+	}
+	raftTerm.Set(float64(n.term))
+}
+
+// becomeFollower steps down, a higher term clears the vote; it must be called with mu held
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		n.persist()
+	}
+	if n.role == Leader {
+		raftLeader.Set(0)
+	}
+	n.role = Follower
+	n.resetDeadline()
+}
+
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.role == Leader:
+			n.broadcast()
+		case time.Now().After(n.deadline):
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection asks the peers for their votes, it must be called with mu held
+func (n *Node) startElection() {
+	raftElections.Inc()
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.config.ID
+	n.leader = ""
+	n.persist()
+	n.resetDeadline()
+	term := n.term
+	req := &pb.RequestVoteRequest{
+		Term:         term,
+		CandidateId:  n.config.ID,
+		LastLogIndex: n.storage.lastIndex(),
+		LastLogTerm:  n.storage.lastTerm(),
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.config.Peers {
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+			defer cancel()
+			resp, err := n.config.Transport.RequestVote(ctx, peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term)
+				return
+			}
+			if n.role != Candidate || n.term != term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over the group and appends an empty entry which commits the entries of
+// earlier terms, it must be called with mu held
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leader = n.config.ID
+	raftLeader.Set(1)
+	next := n.storage.lastIndex() + 1
+	for _, peer := range n.config.Peers {
+		n.nextIndex[peer] = next
+		n.matchIndex[peer] = 0
+	}
+	if err := n.storage.append(&pb.RaftEntry{Index: next, Term: n.term}); err != nil {
+		log.Printf("raft: could not append to the log: %v", err)
+	}
+	n.advanceCommit()
+	n.broadcast()
+}
+
+// broadcast sends the missing entries or a heartbeat to every peer, it must be called with mu held
+func (n *Node) broadcast() {
+	for _, peer := range n.config.Peers {
+		if !n.replicating[peer] {
+			n.replicating[peer] = true
+			go n.replicate(peer)
+		}
+	}
+}
+
+// replicate sends one AppendEntries or InstallSnapshot to the peer and keeps going while it lags behind
+func (n *Node) replicate(peer string) {
+	for {
+		n.mu.Lock()
+		if n.role != Leader || n.stopped() {
+			n.replicating[peer] = false
+			n.mu.Unlock()
+			return
+		}
+		term := n.term
+		next := n.nextIndex[peer]
+		if next <= n.storage.snapshot.Index {
+			snapshot := n.storage.snapshot
+			n.mu.Unlock()
+			ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+			resp, err := n.config.Transport.InstallSnapshot(ctx, peer, &pb.InstallSnapshotRequest{Term: term, LeaderId: n.config.ID, Snapshot: snapshot})
+			cancel()
+			n.mu.Lock()
+			if err == nil {
+				if resp.Term > n.term {
+					n.becomeFollower(resp.Term)
+				} else if n.role == Leader && n.term == term {
+					n.matchIndex[peer] = max(n.matchIndex[peer], snapshot.Index)
+					n.nextIndex[peer] = snapshot.Index + 1
+					n.mu.Unlock()
+					continue
+				}
+			}
+			n.replicating[peer] = false
+			n.mu.Unlock()
+			return
+		}
+		prev := next - 1
+		prevTerm, _ := n.storage.term(prev)
+		entries := n.storage.slice(next, maxAppendEntries)
+		req := &pb.AppendEntriesRequest{
+			Term:         term,
+			LeaderId:     n.config.ID,
+			PrevLogIndex: prev,
+			PrevLogTerm:  prevTerm,
+			Entries:      entries,
+			LeaderCommit: n.commitIndex,
+		}
+		n.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), n.config.ElectionTimeout)
+		resp, err := n.config.Transport.AppendEntries(ctx, peer, req)
+		cancel()
+
+		n.mu.Lock()
+		if err != nil || resp.Term > n.term || n.role != Leader || n.term != term {
+			if err == nil && resp.Term > n.term {
+				n.becomeFollower(resp.Term)
+			}
+			n.replicating[peer] = false
+			n.mu.Unlock()
+			return
+		}
+		if resp.Success {
+			match := prev + uint64(len(entries))
+			n.matchIndex[peer] = max(n.matchIndex[peer], match)
+			n.nextIndex[peer] = match + 1
+			n.advanceCommit()
+		} else {
+			n.nextIndex[peer] = max(1, min(resp.ConflictIndex, next-1))
+		}
+		// stop once the peer has everything, the next heartbeat or proposal starts again
+		if resp.Success && n.nextIndex[peer] > n.storage.lastIndex() {
+			n.replicating[peer] = false
+			n.mu.Unlock()
+			return
+		}
+		n.mu.Unlock()
+	}
+}
+
+// advanceCommit commits the newest entry of the current term stored on a quorum, it must be called with mu held
+func (n *Node) advanceCommit() {
+	for index := n.storage.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.storage.term(index); term != n.term {
+			break
+		}
+		count := 1
+		for _, peer := range n.config.Peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.setCommitIndex(index)
+			return
+		}
+	}
+}
+
+// setCommitIndex moves the commit index and wakes up the applier, it must be called with mu held
+func (n *Node) setCommitIndex(index uint64) {
+	if index <= n.commitIndex {
+		return
+	}
+	n.commitIndex = index
+	raftCommitIndex.Set(float64(index))
+	select {
+	case n.apply <- struct{}{}:
+	default:
+	}
+}
+
+// applyCommitted applies committed entries in order and compacts the log into snapshots
+func (n *Node) applyCommitted() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.apply:
+		}
+		n.applyMu.Lock()
+		for {
+			n.mu.Lock()
+			if n.lastApplied >= n.commitIndex {
+				n.mu.Unlock()
+				break
+			}
+			index := n.lastApplied + 1
+			entry := n.storage.entry(index)
+			n.mu.Unlock()
+			if entry == nil {
+				// compacted by an installed snapshot meanwhile
+				break
+			}
+			var res result
+			if len(entry.Data) != 0 {
+				res.value, res.err = n.config.StateMachine.Apply(index, entry.Data)
+			}
+			n.mu.Lock()
+			n.lastApplied = index
+			if w, ok := n.waiters[index]; ok {
+				if w.term != entry.Term {
+					res = result{err: ErrLost}
+				}
+				w.ch <- res
+				delete(n.waiters, index)
+			}
+			close(n.applied)
+			n.applied = make(chan struct{})
+			n.mu.Unlock()
+		}
+		n.snapshotIfNeeded()
+		n.applyMu.Unlock()
+	}
+}
+
+// snapshotIfNeeded compacts the log once enough entries were applied, it must be called with applyMu held
+func (n *Node) snapshotIfNeeded() {
+	n.mu.Lock()
+	index := n.lastApplied
+	term, ok := n.storage.term(index)
+	due := ok && index-n.storage.snapshot.Index >= n.config.SnapshotThreshold
+	n.mu.Unlock()
+	if !due {
+		return
+	}
+	data, err := n.config.StateMachine.Snapshot()
+	if err != nil {
+		log.Printf("raft: could not take a snapshot: %v", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.storage.saveSnapshot(&pb.RaftSnapshot{Index: index, Term: term, Data: data}); err != nil {
+		log.Printf("raft: could not save the snapshot: %v", err)
+		return
+	}
+	raftSnapshots.Inc()
+}
+
+// Propose appends the data to the log and waits until it is applied, it returns the result of the
+// state machine. Only the leader accepts proposals.
+func (n *Node) Propose(ctx context.Context, data []byte) (any, error) {
+	n.mu.Lock()
+	if n.stopped() {
+		n.mu.Unlock()
+		return nil, ErrStopped
+	}
+	if n.role != Leader {
+		n.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	entry := &pb.RaftEntry{Index: n.storage.lastIndex() + 1, Term: n.term, Data: data}
+	if err := n.storage.append(entry); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	ch := make(chan result, 1)
+	n.waiters[entry.Index] = waiter{term: entry.Term, ch: ch}
+	n.advanceCommit()
+	n.broadcast()
+	n.mu.Unlock()
+	select {
+	case res := <-ch:
+		return res.value, res.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	case <-n.stop:
+		return nil, ErrStopped
+	}
+}
+
+// LinearizableRead waits until the state machine reflects every write committed before the call,
+// a read of the local state afterwards is linearizable. Followers ask the leader for its read index.
+func (n *Node) LinearizableRead(ctx context.Context) error {
+	n.mu.Lock()
+	if n.stopped() {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	role, leader := n.role, n.leader
+	n.mu.Unlock()
+	var index uint64
+	var err error
+	switch {
+	case role == Leader:
+		index, err = n.readIndex(ctx)
+	case leader == "":
+		return ErrNoLeader
+	default:
+		index, err = n.config.Transport.ReadIndex(ctx, leader)
+	}
+	if err != nil {
+		return err
+	}
+	return n.waitApplied(ctx, index)
+}
+
+// readIndex returns the commit index once the node confirmed it is still the leader
+func (n *Node) readIndex(ctx context.Context) (uint64, error) {
+	// the commit index is only known to be current once an entry of this term committed
+	for {
+		n.mu.Lock()
+		if n.role != Leader {
+			n.mu.Unlock()
+			return 0, ErrNotLeader
+		}
+		term, _ := n.storage.term(n.commitIndex)
+		applied := n.applied
+		n.mu.Unlock()
+		if term == n.currentTerm() {
+			break
+		}
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-n.stop:
+			return 0, ErrStopped
+		}
+	}
+	n.mu.Lock()
+	index, term := n.commitIndex, n.term
+	n.mu.Unlock()
+	if !n.confirmLeadership(ctx, term) {
+		return 0, ErrNotLeader
+	}
+	return index, nil
+}
+
+func (n *Node) currentTerm() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.term
+}
+
+// confirmLeadership sends a heartbeat round and reports whether a quorum still follows this node in term
+func (n *Node) confirmLeadership(ctx context.Context, term uint64) bool {
+	acks := make(chan bool, len(n.config.Peers))
+	for _, peer := range n.config.Peers {
+		go func(peer string) {
+			n.mu.Lock()
+			prev := n.nextIndex[peer] - 1
+			prevTerm, _ := n.storage.term(prev)
+			req := &pb.AppendEntriesRequest{Term: term, LeaderId: n.config.ID, PrevLogIndex: prev, PrevLogTerm: prevTerm, LeaderCommit: n.commitIndex}
+			n.mu.Unlock()
+			hbCtx, cancel := context.WithTimeout(ctx, n.config.ElectionTimeout)
+			defer cancel()
+			resp, err := n.config.Transport.AppendEntries(hbCtx, peer, req)
+			if err != nil {
+				acks <- false
+				return
+			}
+			if resp.Term > term {
+				n.mu.Lock()
+				n.becomeFollower(resp.Term)
+				n.mu.Unlock()
+				acks <- false
+				return
+			}
+			// a failed consistency check still acknowledges the term
+			acks <- true
+		}(peer)
+	}
+	count := 1
+	for i := 0; i < len(n.config.Peers) && count < n.quorum(); i++ {
+		if <-acks {
+			count++
+		}
+	}
+	return count >= n.quorum()
+}
+
+// waitApplied waits until the entry at index is applied
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.mu.Lock()
+		done := n.lastApplied >= index
+		applied := n.applied
+		n.mu.Unlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.stop:
+			return ErrStopped
+		}
+	}
+}
+
+// RequestVote method grants the vote to a candidate whose log is at least as up to date as this node's
+func (n *Node) RequestVote(ctx context.Context, req *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+	}
+	resp := &pb.RequestVoteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.CandidateId) {
+		return resp, nil
+	}
+	lastTerm := n.storage.lastTerm()
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < n.storage.lastIndex()) {
+		return resp, nil
+	}
+	n.votedFor = req.CandidateId
+	n.persist()
+	n.resetDeadline()
+	resp.VoteGranted = true
+	return resp, nil
+}
+
+// AppendEntries method appends the leader's entries after checking that the logs agree up to them
+func (n *Node) AppendEntries(ctx context.Context, req *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		return &pb.AppendEntriesResponse{Term: n.term}, nil
+	}
+	if req.Term > n.term || n.role != Follower {
+		n.becomeFollower(req.Term)
+	}
+	n.leader = req.LeaderId
+	n.resetDeadline()
+	resp := &pb.AppendEntriesResponse{Term: n.term}
+	last := n.storage.lastIndex()
+	if req.PrevLogIndex > last {
+		resp.ConflictIndex = last + 1
+		return resp, nil
+	}
+	if term, ok := n.storage.term(req.PrevLogIndex); ok && term != req.PrevLogTerm {
+		// skip the whole conflicting term at once
+		index := req.PrevLogIndex
+		for index > n.storage.snapshot.Index+1 {
+			if t, _ := n.storage.term(index - 1); t != term {
+				break
+			}
+			index--
+		}
+		resp.ConflictIndex = index
+		return resp, nil
+	}
+	var entries []*pb.RaftEntry
+	for i, entry := range req.Entries {
+		if entry.Index <= n.storage.snapshot.Index {
+			continue
+		}
+		if term, ok := n.storage.term(entry.Index); ok && term == entry.Term {
+			continue
+		}
+		// the first new or conflicting entry replaces the rest of the log
+		entries = req.Entries[i:]
+		break
+	}
+	if len(entries) != 0 {
+		if entries[0].Index <= n.commitIndex {
+			return resp, status.Error(codes.Internal, "leader overwrites committed entries")
+		}
+		if err := n.storage.append(entries...); err != nil {
+			return resp, status.Error(codes.Internal, err.Error())
+		}
+	}
+	n.setCommitIndex(min(req.LeaderCommit, req.PrevLogIndex+uint64(len(req.Entries))))
+	resp.Success = true
+	return resp, nil
+}
+
+// InstallSnapshot method replaces the state of a follower too far behind the leader's log
+func (n *Node) InstallSnapshot(ctx context.Context, req *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return &pb.InstallSnapshotResponse{Term: n.term}, nil
+	}
+	if req.Term > n.term || n.role != Follower {
+		n.becomeFollower(req.Term)
+	}
+	n.leader = req.LeaderId
+	n.resetDeadline()
+	term := n.term
+	if req.Snapshot.Index <= n.lastApplied {
+		n.mu.Unlock()
+		return &pb.InstallSnapshotResponse{Term: term}, nil
+	}
+	n.mu.Unlock()
+
+	if err := n.config.StateMachine.Restore(req.Snapshot.Index, req.Snapshot.Data); err != nil {
+		return &pb.InstallSnapshotResponse{Term: term}, status.Error(codes.Internal, err.Error())
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.storage.saveSnapshot(req.Snapshot); err != nil {
+		return &pb.InstallSnapshotResponse{Term: n.term}, status.Error(codes.Internal, err.Error())
+	}
+	raftSnapshots.Inc()
+	n.lastApplied = req.Snapshot.Index
+	if req.Snapshot.Index > n.commitIndex {
+		n.commitIndex = req.Snapshot.Index
+		raftCommitIndex.Set(float64(n.commitIndex))
+	}
+	close(n.applied)
+	n.applied = make(chan struct{})
+	return &pb.InstallSnapshotResponse{Term: n.term}, nil
+}
+
+// ReadIndex method returns the read index of the leader
+func (n *Node) ReadIndex(ctx context.Context, req *pb.ReadIndexRequest) (*pb.ReadIndexResponse, error) {
+	index, err := n.readIndex(ctx)
+	if errors.Is(err, ErrNotLeader) {
+		return &pb.ReadIndexResponse{}, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return &pb.ReadIndexResponse{}, status.FromContextError(err).Err()
+	}
+	return &pb.ReadIndexResponse{Index: index}, nil
+}
@@ -0,0 +1,339 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+// counter is an in-memory state machine which appends the applied data to a list
+type counter struct {
+	mu      sync.Mutex
+	applied []string
+	index   uint64
+}
+
+func (c *counter) Apply(index uint64, data []byte) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.applied = append(c.applied, string(data))
+	c.index = index
+	return len(c.applied), nil
+}
+
+func (c *counter) Applied() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.index
+}
+
+func (c *counter) Snapshot() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return []byte(strings.Join(c.applied, ",")), nil
+}
+
+func (c *counter) Restore(index uint64, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index = index
+	c.applied = nil
+	if len(data) != 0 {
+		c.applied = strings.Split(string(data), ",")
+	}
+	return nil
+}
+
+func (c *counter) list() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.applied...)
+}
+
+var errDown = errors.New("node is down")
+
+// memNetwork delivers the messages between nodes in the same process, a node can be cut off
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+func (m *memNetwork) node(from, to string) (*Node, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[to]
+	if !ok || m.down[to] || m.down[from] {
+		return nil, errDown
+	}
+	return n, nil
+}
+
+func (m *memNetwork) setDown(id string, down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down[id] = down
+}
+
+// memTransport is the transport of one node on a memNetwork
+type memTransport struct {
+	network *memNetwork
+	from    string
+}
+
+func (t *memTransport) RequestVote(ctx context.Context, to string, req *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+	n, err := t.network.node(t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	return n.RequestVote(ctx, req)
+}
+
+func (t *memTransport) AppendEntries(ctx context.Context, to string, req *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	n, err := t.network.node(t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	return n.AppendEntries(ctx, req)
+}
+
+func (t *memTransport) InstallSnapshot(ctx context.Context, to string, req *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+	n, err := t.network.node(t.from, to)
+	if err != nil {
+		return nil, err
+	}
+	return n.InstallSnapshot(ctx, req)
+}
+
+func (t *memTransport) ReadIndex(ctx context.Context, to string) (uint64, error) {
+	n, err := t.network.node(t.from, to)
+	if err != nil {
+		return 0, err
+	}
+	index, err := n.readIndex(ctx)
+	return index, err
+}
+
+// testCluster is a group of nodes on a memNetwork
+type testCluster struct {
+	t        *testing.T
+	network  *memNetwork
+	ids      []string
+	dirs     map[string]string
+	machines map[string]*counter
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{
+		t:        t,
+		network:  &memNetwork{nodes: map[string]*Node{}, down: map[string]bool{}},
+		dirs:     map[string]string{},
+		machines: map[string]*counter{},
+	}
+	for i := 0; i < size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("node%d", i))
+	}
+	for _, id := range c.ids {
+		c.dirs[id] = t.TempDir()
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, id := range c.ids {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start starts the node from its directory with an empty state machine
+func (c *testCluster) start(id string) *Node {
+	var peers []string
+	for _, other := range c.ids {
+		if other != id {
+			peers = append(peers, other)
+		}
+	}
+	machine := &counter{}
+	n, err := NewNode(Config{
+		ID:                id,
+		Peers:             peers,
+		Dir:               c.dirs[id],
+		Transport:         &memTransport{network: c.network, from: id},
+		StateMachine:      machine,
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: 5,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.network.mu.Lock()
+	c.network.nodes[id] = n
+	c.network.mu.Unlock()
+	c.machines[id] = machine
+	n.Start()
+	return n
+}
+
+func (c *testCluster) stop(id string) {
+	c.network.mu.Lock()
+	n, ok := c.network.nodes[id]
+	delete(c.network.nodes, id)
+	c.network.mu.Unlock()
+	if ok {
+		n.Stop()
+	}
+}
+
+func (c *testCluster) get(id string) *Node {
+	c.network.mu.Lock()
+	defer c.network.mu.Unlock()
+	return c.network.nodes[id]
+}
+
+// leader waits for a leader among the nodes which are up
+func (c *testCluster) leader() *Node {
+	var leader *Node
+	assert.Eventually(c.t, func() bool {
+		for _, id := range c.ids {
+			c.network.mu.Lock()
+			n, down := c.network.nodes[id], c.network.down[id]
+			c.network.mu.Unlock()
+			if n != nil && !down && n.Role() == Leader {
+				leader = n
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	if leader == nil {
+		c.t.FailNow()
+	}
+	return leader
+}
+
+func propose(t *testing.T, n *Node, data string) any {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := n.Propose(ctx, []byte(data))
+	assert.NoError(t, err)
+	return result
+}
+
+func TestElectsLeader(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+	for _, id := range c.ids {
+		id := id
+		assert.Eventually(t, func() bool { return c.get(id).Leader() == leader.config.ID }, 5*time.Second, 10*time.Millisecond)
+	}
+	for _, id := range c.ids {
+		if n := c.get(id); n != leader {
+			_, err := n.Propose(context.Background(), []byte("x"))
+			assert.ErrorIs(t, err, ErrNotLeader)
+		}
+	}
+}
+
+func TestReplicatesToEveryNode(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, i, propose(t, leader, strconv.Itoa(i)))
+	}
+	for _, id := range c.ids {
+		machine := c.machines[id]
+		assert.Eventually(t, func() bool { return len(machine.list()) == 3 }, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, []string{"1", "2", "3"}, machine.list())
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	first := c.leader()
+	propose(t, first, "a")
+	c.network.setDown(first.config.ID, true)
+
+	second := c.leader()
+	assert.NotEqual(t, first.config.ID, second.config.ID)
+	propose(t, second, "b")
+	assert.Equal(t, []string{"a", "b"}, c.machines[second.config.ID].list())
+
+	// the old leader steps down and catches up once it is back
+	c.network.setDown(first.config.ID, false)
+	assert.Eventually(t, func() bool { return len(c.machines[first.config.ID].list()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"a", "b"}, c.machines[first.config.ID].list())
+	assert.NotEqual(t, Leader, first.Role())
+}
+
+func TestSnapshotCatchesUpFollower(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+	var lagging string
+	for _, id := range c.ids {
+		if id != leader.config.ID {
+			lagging = id
+			break
+		}
+	}
+	c.network.setDown(lagging, true)
+	var want []string
+	for i := 0; i < 12; i++ {
+		want = append(want, strconv.Itoa(i))
+		propose(t, leader, strconv.Itoa(i))
+	}
+	// the entries the lagging node misses are compacted into a snapshot
+	assert.Eventually(t, func() bool {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.storage.snapshot.Index > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	c.network.setDown(lagging, false)
+	assert.Eventually(t, func() bool { return len(c.machines[lagging].list()) == len(want) }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, want, c.machines[lagging].list())
+
+	// a restarted node recovers its state from its snapshot and log
+	c.stop(lagging)
+	c.start(lagging)
+	propose(t, c.leader(), "last")
+	want = append(want, "last")
+	assert.Eventually(t, func() bool { return len(c.machines[lagging].list()) == len(want) }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, want, c.machines[lagging].list())
+}
+
+func TestLinearizableRead(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.leader()
+	propose(t, leader, "a")
+	for _, id := range c.ids {
+		n := c.get(id)
+		assert.Eventually(t, func() bool { return n.Leader() != "" }, 5*time.Second, 10*time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		assert.NoError(t, n.LinearizableRead(ctx))
+		cancel()
+		// after the read the node has applied every write acknowledged before it
+		assert.Equal(t, []string{"a"}, c.machines[id].list())
+	}
+
+	// a leader cut off from the quorum cannot serve reads
+	c.network.setDown(leader.config.ID, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	assert.Error(t, leader.LinearizableRead(ctx))
+}
+
+func TestSingleNode(t *testing.T) {
+	c := newTestCluster(t, 1)
+	leader := c.leader()
+	assert.Equal(t, 1, propose(t, leader, "a"))
+	assert.NoError(t, leader.LinearizableRead(context.Background()))
+}
@@ -0,0 +1,256 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/rosedblabs/wal"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	stateFile    = "state.json"
+	snapshotFile = "snapshot"
+	logDir       = "log"
+	// logSegmentSize is the size of the WAL segments of the Raft log
+	logSegmentSize = 64 * wal.MB
+)
+
+// hardState is the state a node has to remember across restarts besides its log
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// storage keeps the Raft log in a WAL next to the last snapshot. The WAL is append only, an entry
+// written again with the index of an earlier one replaces it and every entry after it on replay.
+type storage struct {
+	dir      string
+	wal      *wal.WAL
+	snapshot *pb.RaftSnapshot
+	// entries follow the snapshot, entries[i].Index is snapshot.Index+1+i
+	entries []*pb.RaftEntry
+}
+
+func walOptions(dir string) wal.Options {
+	options := wal.DefaultOptions
+	options.DirPath = dir
+	options.SegmentSize = logSegmentSize
+	return options
+}
+
+// openStorage loads the state, the snapshot and the log kept in dir
+func openStorage(dir string) (*storage, hardState, error) {
+	var state hardState
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, state, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, state, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, state, err
+		}
+	}
+	s := &storage{dir: dir, snapshot: &pb.RaftSnapshot{}}
+	data, err = os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, state, err
+	}
+	if err == nil {
+		if err := proto.Unmarshal(data, s.snapshot); err != nil {
+			return nil, state, err
+		}
+	}
+	// a compaction interrupted before the new log was complete, the old one is still valid
+	old := filepath.Join(dir, logDir+".old")
+	if _, err := os.Stat(old); err == nil {
+		if err := os.RemoveAll(filepath.Join(dir, logDir)); err != nil {
+			return nil, state, err
+		}
+		if err := os.Rename(old, filepath.Join(dir, logDir)); err != nil {
+			return nil, state, err
+		}
+	}
+	s.wal, err = wal.Open(walOptions(filepath.Join(dir, logDir)))
+	if err != nil {
+		return nil, state, err
+	}
+	reader := s.wal.NewReader()
+	for {
+		data, _, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, state, err
+		}
+		entry := &pb.RaftEntry{}
+		if err := proto.Unmarshal(data, entry); err != nil {
+			return nil, state, err
+		}
+		if err := s.place(entry); err != nil {
+			return nil, state, err
+		}
+	}
+	return s, state, nil
+}
+
+// place puts the entry into the in-memory log, dropping the entries it replaces
+func (s *storage) place(entry *pb.RaftEntry) error {
+	if entry.Index <= s.snapshot.Index {
+		return nil
+	}
+	pos := entry.Index - s.snapshot.Index - 1
+	if pos > uint64(len(s.entries)) {
+		return fmt.Errorf("raft log has a gap before index %d", entry.Index)
+	}
+	s.entries = append(s.entries[:pos], entry)
+	return nil
+}
+
+func (s *storage) lastIndex() uint64 {
+	return s.snapshot.Index + uint64(len(s.entries))
+}
+
+func (s *storage) lastTerm() uint64 {
+	if len(s.entries) == 0 {
+		return s.snapshot.Term
+	}
+	return s.entries[len(s.entries)-1].Term
+}
+
+// term returns the term of the entry at index, false when the entry is compacted or does not exist
+func (s *storage) term(index uint64) (uint64, bool) {
+	if index == s.snapshot.Index {
+		return s.snapshot.Term, true
+	}
+	if index < s.snapshot.Index || index > s.lastIndex() {
+		return 0, false
+	}
+	return s.entries[index-s.snapshot.Index-1].Term, true
+}
+
+// slice returns at most max entries starting at index, which must follow the snapshot
+func (s *storage) slice(index uint64, max int) []*pb.RaftEntry {
+	if index <= s.snapshot.Index || index > s.lastIndex() {
+		return nil
+	}
+	entries := s.entries[index-s.snapshot.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]*pb.RaftEntry(nil), entries...)
+}
+
+// entry returns the entry at index, nil when it is compacted or does not exist
+func (s *storage) entry(index uint64) *pb.RaftEntry {
+	if index <= s.snapshot.Index || index > s.lastIndex() {
+		return nil
+	}
+	return s.entries[index-s.snapshot.Index-1]
+}
+
+// append writes the entries to the WAL and syncs it, entries replace the log from their index on
+func (s *storage) append(entries ...*pb.RaftEntry) error {
+	for _, entry := range entries {
+		data, err := proto.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := s.wal.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.place(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *storage) saveState(state hardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, stateFile), data)
+}
+
+// saveSnapshot stores the snapshot and compacts the log, entries after the snapshot are kept
+// when the log agrees with the snapshot about its last entry
+func (s *storage) saveSnapshot(snapshot *pb.RaftSnapshot) error {
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, snapshotFile), data); err != nil {
+		return err
+	}
+	var kept []*pb.RaftEntry
+	if term, ok := s.term(snapshot.Index); ok && term == snapshot.Term && snapshot.Index < s.lastIndex() {
+		kept = append(kept, s.entries[snapshot.Index-s.snapshot.Index:]...)
+	}
+	s.snapshot = snapshot
+	s.entries = nil
+	return s.rewrite(kept)
+}
+
+// rewrite replaces the WAL by one holding only the entries
+func (s *storage) rewrite(entries []*pb.RaftEntry) error {
+	current := filepath.Join(s.dir, logDir)
+	old := current + ".old"
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(current, old); err != nil {
+		return err
+	}
+	var err error
+	s.wal, err = wal.Open(walOptions(current))
+	if err != nil {
+		return err
+	}
+	if err := s.append(entries...); err != nil {
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+func (s *storage) close() error {
+	return s.wal.Close()
+}
+
+// writeFileAtomic replaces the file with data through a temporary file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
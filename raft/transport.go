@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Transport carries the messages of a node to the other members, identified by their ids
+type Transport interface {
+	RequestVote(ctx context.Context, to string, req *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, to string, req *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, to string, req *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error)
+	// ReadIndex asks the leader for its read index
+	ReadIndex(ctx context.Context, to string) (uint64, error)
+}
+
+// GRPCTransport reaches the members through RaftService, the member ids are their addresses
+type GRPCTransport struct {
+	connect func(address string) (*grpc.ClientConn, error)
+	mu      sync.Mutex
+	clients map[string]pb.RaftServiceClient
+}
+
+// NewGRPCTransport returns a transport which connects to the members with connect
+func NewGRPCTransport(connect func(address string) (*grpc.ClientConn, error)) *GRPCTransport {
+	return &GRPCTransport{connect: connect, clients: map[string]pb.RaftServiceClient{}}
+}
+
+func (t *GRPCTransport) client(address string) (pb.RaftServiceClient, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if client, ok := t.clients[address]; ok {
+		return client, nil
+	}
+	conn, err := t.connect(address)
+	if err != nil {
+		return nil, err
+	}
+	client := pb.NewRaftServiceClient(conn)
+	t.clients[address] = client
+	return client, nil
+}
+
+func (t *GRPCTransport) RequestVote(ctx context.Context, to string, req *pb.RequestVoteRequest) (*pb.RequestVoteResponse, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return nil, err
+	}
+	return client.RequestVote(ctx, req)
+}
+
+func (t *GRPCTransport) AppendEntries(ctx context.Context, to string, req *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return nil, err
+	}
+	return client.AppendEntries(ctx, req)
+}
+
+func (t *GRPCTransport) InstallSnapshot(ctx context.Context, to string, req *pb.InstallSnapshotRequest) (*pb.InstallSnapshotResponse, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return nil, err
+	}
+	return client.InstallSnapshot(ctx, req)
+}
+
+func (t *GRPCTransport) ReadIndex(ctx context.Context, to string) (uint64, error) {
+	client, err := t.client(to)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.ReadIndex(ctx, &pb.ReadIndexRequest{})
+	if status.Code(err) == codes.FailedPrecondition {
+		// the member lost its leadership since this node heard from it
+		return 0, ErrNotLeader
+	}
+	if err != nil {
+		return 0, err
+	}
+	return resp.Index, nil
+}
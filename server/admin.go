@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// peerRecord is a peer as stored in the membership file
+type peerRecord struct {
+	Address string `json:"address"`
+	NodeID  string `json:"node_id,omitempty"`
+}
+
+// LoadPeers reads the peers stored in the membership file, a missing file returns no peers and no error.
+// connect is used to dial the peers.
+func LoadPeers(path string, connect func(address string) (*grpc.ClientConn, error)) ([]*cluster.CacheClient, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := []peerRecord{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	peers := make([]*cluster.CacheClient, len(records))
+	for i, record := range records {
+		peers[i] = &cluster.CacheClient{Address: record.Address, Node: record.NodeID, Connect: connect}
+	}
+	return peers, nil
+}
+
+// SetMembershipFile makes the server persist its peers to the file on every change
+func (s *Server) SetMembershipFile(path string) error {
+	s.peersMu.Lock()
+	s.membershipFile = path
+	s.peersMu.Unlock()
+	return s.savePeers()
+}
+
+// savePeers writes the peers to the membership file, replacing it atomically
+func (s *Server) savePeers() error {
+	s.peersMu.RLock()
+	path, peers := s.membershipFile, s.peers
+	s.peersMu.RUnlock()
+	if path == "" {
+		return nil
+	}
+	records := make([]peerRecord, len(peers))
+	for i, peer := range peers {
+		peer.RLock()
+		records[i] = peerRecord{Address: peer.Address, NodeID: peer.Node}
+		peer.RUnlock()
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces the file with data through a temporary file, readers see the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// AdminServer implements AdminService on top of a Server
+type AdminServer struct {
+	pb.UnimplementedAdminServiceServer
+	s       *Server
+	connect func(address string) (*grpc.ClientConn, error)
+}
+
+// NewAdminServer creates the admin service of the server, connect dials added peers
+func NewAdminServer(s *Server, connect func(address string) (*grpc.ClientConn, error)) *AdminServer {
+	return &AdminServer{s: s, connect: connect}
+}
+
+func peerInfo(peer *cluster.CacheClient) *pb.PeerInfo {
+	peer.RLock()
+	defer peer.RUnlock()
+	info := &pb.PeerInfo{
+		Address:             peer.Address,
+		NodeId:              peer.Node,
+		Active:              peer.Active,
+		LatencyUs:           peer.Latency.Microseconds(),
+		ConsecutiveFailures: int32(peer.ConsecutiveFailures),
+	}
+	if !peer.LastSuccess.IsZero() {
+		info.LastSuccess = peer.LastSuccess.Unix()
+	}
+	return info
+}
+
+// AddPeer method connects to the peer and starts replicating to it
+func (a *AdminServer) AddPeer(ctx context.Context, req *pb.AddPeerRequest) (*pb.AddPeerResponse, error) {
+	if req.Address == "" {
+		return &pb.AddPeerResponse{}, status.Error(codes.InvalidArgument, "empty address")
+	}
+	if a.s.peer(req.Address) != nil {
+		return &pb.AddPeerResponse{}, status.Errorf(codes.AlreadyExists, "peer %s exists", req.Address)
+	}
+	peer := &cluster.CacheClient{Address: req.Address, Connect: a.connect}
+	peer.Lock()
+	err := peer.Init()
+	peer.Unlock()
+	if err != nil {
+		// the peer is added anyway, the health checks keep trying
+		nodeErrors.WithLabelValues(req.Address).Inc()
+	}
+	if !a.s.addPeer(peer) {
+		if peer.Conn != nil {
+			peer.Conn.Close()
+		}
+		return &pb.AddPeerResponse{}, status.Errorf(codes.AlreadyExists, "peer %s exists", req.Address)
+	}
+	if err == nil {
+		a.s.identify(peer)
+	}
+	if err := a.s.savePeers(); err != nil {
+		return &pb.AddPeerResponse{}, status.Errorf(codes.Internal, "peer added but not persisted: %v", err)
+	}
+	return &pb.AddPeerResponse{Peer: peerInfo(peer)}, nil
+}
+
+// RemovePeer method stops replicating to the peer and closes the connection
+func (a *AdminServer) RemovePeer(ctx context.Context, req *pb.RemovePeerRequest) (*pb.RemovePeerResponse, error) {
+	peer := a.s.removePeer(req.Address)
+	if peer == nil {
+		return &pb.RemovePeerResponse{}, status.Errorf(codes.NotFound, "peer %s not found", req.Address)
+	}
+	a.s.slog.RemovePeer(peer)
+	if err := a.s.savePeers(); err != nil {
+		return &pb.RemovePeerResponse{}, status.Errorf(codes.Internal, "peer removed but not persisted: %v", err)
+	}
+	return &pb.RemovePeerResponse{}, nil
+}
+
+// ListPeers method reports the peers and their state
+func (a *AdminServer) ListPeers(ctx context.Context, req *pb.ListPeersRequest) (*pb.ListPeersResponse, error) {
+	resp := &pb.ListPeersResponse{}
+	for _, peer := range a.s.GetPeers() {
+		resp.Peers = append(resp.Peers, peerInfo(peer))
+	}
+	return resp, nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdminPeers(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	connect := func(address string) (*grpc.ClientConn, error) {
+		return grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	path := filepath.Join(t.TempDir(), "membership.json")
+	assert.NoError(t, s.SetMembershipFile(path))
+	admin := NewAdminServer(s, connect)
+	ctx := context.Background()
+
+	resp, err := admin.AddPeer(ctx, &pb.AddPeerRequest{Address: "10.0.0.1:50051"})
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:50051", resp.Peer.Address)
+	assert.True(t, resp.Peer.Active)
+	_, err = admin.AddPeer(ctx, &pb.AddPeerRequest{Address: "10.0.0.2:50051"})
+	assert.NoError(t, err)
+
+	_, err = admin.AddPeer(ctx, &pb.AddPeerRequest{Address: "10.0.0.1:50051"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = admin.AddPeer(ctx, &pb.AddPeerRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	list, err := admin.ListPeers(ctx, &pb.ListPeersRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, list.Peers, 2)
+
+	_, err = admin.RemovePeer(ctx, &pb.RemovePeerRequest{Address: "10.0.0.1:50051"})
+	assert.NoError(t, err)
+	_, err = admin.RemovePeer(ctx, &pb.RemovePeerRequest{Address: "10.0.0.1:50051"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// the membership file holds the peers left after the changes
+	peers, err := LoadPeers(path, connect)
+	assert.NoError(t, err)
+	if assert.Len(t, peers, 1) {
+		assert.Equal(t, "10.0.0.2:50051", peers[0].Address)
+		assert.Equal(t, s.GetPeers()[0].Node, peers[0].Node)
+	}
+
+	peers, err = LoadPeers(filepath.Join(t.TempDir(), "missing.json"), connect)
+	assert.NoError(t, err)
+	assert.Empty(t, peers)
+}
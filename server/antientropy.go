@@ -0,0 +1,479 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	// DefaultMerkleDepth gives trees of 1024 leaves
+	DefaultMerkleDepth = 10
+	// MaxMerkleDepth bounds the size of the trees exchanged, a tree of 2^16-1 hashes of 32 bytes is about
+	// 2.2 MB and stays below the default 4 MB limit of a gRPC message
+	MaxMerkleDepth = 15
+	// DefaultAntiEntropyKeysPerSecond is the default number of keys repaired per second
+	DefaultAntiEntropyKeysPerSecond = 1000
+	// antiEntropyPageSize is the number of entries read at once while hashing or streaming the shared keys
+	antiEntropyPageSize = 1000
+)
+
+var (
+	antiEntropyRounds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anti_entropy_rounds_total",
+		Help: "Total number of anti-entropy rounds by peer and result",
+	}, []string{"peer", "result"})
+
+	antiEntropyOutOfSync = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anti_entropy_out_of_sync_leaves",
+		Help: "Number of Merkle tree leaves which differed from the peer in the last round",
+	}, []string{"peer"})
+
+	antiEntropyCompared = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anti_entropy_keys_compared_total",
+		Help: "Total number of keys of differing leaves compared with the peer",
+	}, []string{"peer"})
+
+	antiEntropyRepaired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anti_entropy_keys_repaired_total",
+		Help: "Total number of keys repaired by anti-entropy, pulled from or pushed to the peer",
+	}, []string{"peer", "direction"})
+
+	antiEntropyConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "anti_entropy_conflicts_total",
+		Help: "Total number of keys with different values under the same version, they are left alone",
+	}, []string{"peer"})
+
+	antiEntropyLastRound = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "anti_entropy_last_round_timestamp_seconds",
+		Help: "Unix time of the last completed anti-entropy round with the peer",
+	}, []string{"peer"})
+)
+
+// AntiEntropyConfig configures the background reconciliation of replicas
+type AntiEntropyConfig struct {
+	// Interval between rounds, every round compares this node with each peer in turn. 0 disables anti-entropy.
+	Interval time.Duration
+	// Depth of the Merkle trees, a tree has 2^Depth leaves
+	Depth int
+	// KeysPerSecond limits the keys pulled and pushed, rates above one key per nanosecond are not limited further
+	KeysPerSecond int
+}
+
+// SetAntiEntropy configures anti-entropy, it must be called before Start
+func (s *Server) SetAntiEntropy(config AntiEntropyConfig) error {
+	if config.Depth == 0 {
+		config.Depth = DefaultMerkleDepth
+	}
+	if config.Depth < 1 || config.Depth > MaxMerkleDepth {
+		return fmt.Errorf("merkle depth %d out of range 1..%d", config.Depth, MaxMerkleDepth)
+	}
+	if config.KeysPerSecond <= 0 {
+		config.KeysPerSecond = DefaultAntiEntropyKeysPerSecond
+	}
+	s.antiEntropy = config
+	return nil
+}
+
+// merkleTree holds the hashes of a tree in heap order, the children of node i are 2i+1 and 2i+2
+type merkleTree struct {
+	depth int
+	nodes [][]byte
+}
+
+// leafOf returns the leaf of the key in a tree of the depth
+func leafOf(key []byte, depth int) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint32(sum[:4]) >> (32 - depth)
+}
+
+// newMerkleTree hashes the entries into a tree
+func newMerkleTree(kvs []*pb.KeyValue, depth int) *merkleTree {
+	t := newEmptyMerkleTree(depth)
+	for _, kv := range kvs {
+		t.add(kv)
+	}
+	t.hash()
+	return t
+}
+
+// newEmptyMerkleTree creates a tree of empty leaves, entries are added with add and the inner nodes
+// computed by hash
+func newEmptyMerkleTree(depth int) *merkleTree {
+	n := 1 << depth
+	nodes := make([][]byte, 2*n-1)
+	for i := n - 1; i < len(nodes); i++ {
+		nodes[i] = make([]byte, sha256.Size)
+	}
+	return &merkleTree{depth: depth, nodes: nodes}
+}
+
+// add hashes the entry into its leaf. A leaf is the XOR of the hashes of its entries so the order of the
+// entries does not matter. Versions are left out, values of older releases were flushed without one.
+func (t *merkleTree) add(kv *pb.KeyValue) {
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(kv.Key))))
+	h.Write(kv.Key)
+	h.Write(kv.Value)
+	leaf := t.nodes[len(t.nodes)/2+int(leafOf(kv.Key, t.depth))]
+	for i, b := range h.Sum(nil) {
+		leaf[i] ^= b
+	}
+}
+
+// hash computes the inner nodes from the leaves
+func (t *merkleTree) hash() {
+	for i := len(t.nodes)/2 - 1; i >= 0; i-- {
+		h := sha256.New()
+		h.Write(t.nodes[2*i+1])
+		h.Write(t.nodes[2*i+2])
+		t.nodes[i] = h.Sum(nil)
+	}
+}
+
+func (t *merkleTree) root() []byte {
+	return t.nodes[0]
+}
+
+// diff returns the leaves which differ from the remote tree, it descends only into differing subtrees
+func (t *merkleTree) diff(remote [][]byte) []uint32 {
+	first := len(t.nodes) / 2
+	leaves := []uint32{}
+	var walk func(i int)
+	walk = func(i int) {
+		if bytes.Equal(t.nodes[i], remote[i]) {
+			return
+		}
+		if i >= first {
+			leaves = append(leaves, uint32(i-first))
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return leaves
+}
+
+// forEachShared calls fn with the local entries of the keys replicated on both this node and the peer, every
+// entry when the keys are not partitioned or the peer is not known. The entries are read a page at a time,
+// linearizable keys are left out.
+func (s *Server) forEachShared(peer string, fn func(kv *pb.KeyValue) error) error {
+	s.peersMu.RLock()
+	ring, factor, self, nodes := s.ring, s.replicationFactor, s.self, len(s.peers)
+	s.peersMu.RUnlock()
+	partitioned := peer != "" && ring != nil && factor > 0 && factor <= nodes
+	start := ""
+	for {
+		kvs, err := s.c.Scan(start, "", antiEntropyPageSize)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			// the Raft log keeps the linearizable keys in sync
+			if s.linearizable(string(kv.Key)) {
+				continue
+			}
+			if partitioned {
+				replicas := ring.Replicas(string(kv.Key), factor)
+				if !slices.Contains(replicas, self) || !slices.Contains(replicas, peer) {
+					continue
+				}
+			}
+			if err := fn(kv); err != nil {
+				return err
+			}
+		}
+		if len(kvs) < antiEntropyPageSize {
+			return nil
+		}
+		start = string(kvs[len(kvs)-1].Key) + "\x00"
+	}
+}
+
+// cachedTree is a Merkle tree of the keys shared with a peer, valid while the ring is the same and nothing
+// was written since the revision it was built at
+type cachedTree struct {
+	ring     *cluster.Ring
+	revision int64
+	tree     *merkleTree
+}
+
+// sharedTree returns the Merkle tree of the keys shared with the peer. The tree is cached so that the round of
+// every peer and the calls of the peers reuse it until the next write, without partitioning all peers share it.
+func (s *Server) sharedTree(peer string, depth int) (*merkleTree, error) {
+	s.peersMu.RLock()
+	ring := s.ring
+	if ring == nil || s.replicationFactor <= 0 || s.replicationFactor > len(s.peers) {
+		peer = ""
+	}
+	s.peersMu.RUnlock()
+	key := fmt.Sprintf("%s/%d", peer, depth)
+	// the revision is read first, a write racing with the build makes the next call build again
+	revision := s.c.Revision()
+	s.treesMu.Lock()
+	cached, ok := s.trees[key]
+	s.treesMu.Unlock()
+	if ok && cached.ring == ring && cached.revision == revision {
+		return cached.tree, nil
+	}
+	tree := newEmptyMerkleTree(depth)
+	err := s.forEachShared(peer, func(kv *pb.KeyValue) error {
+		tree.add(kv)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	tree.hash()
+	s.treesMu.Lock()
+	defer s.treesMu.Unlock()
+	if s.trees == nil {
+		s.trees = map[string]*cachedTree{}
+	}
+	s.trees[key] = &cachedTree{ring: ring, revision: revision, tree: tree}
+	return tree, nil
+}
+
+// runAntiEntropy compares this node with every peer once per interval
+func (s *Server) runAntiEntropy() {
+	ticker := time.NewTicker(s.antiEntropy.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, peer := range s.GetPeers() {
+			if err := s.syncPeer(context.Background(), peer); err != nil {
+				antiEntropyRounds.WithLabelValues(peerLabel(peer), "failed").Inc()
+				log.Printf("anti-entropy with %s failed: %v", peer.Address, err)
+			}
+		}
+	}
+}
+
+// syncPeer runs one anti-entropy round with the peer. The Merkle trees of the shared keys are compared
+// and the entries of the differing leaves are streamed from the peer, the newer version of every key wins.
+// Keys only this node has are pushed to the peer. Inactive peers are skipped.
+func (s *Server) syncPeer(ctx context.Context, peer *cluster.CacheClient) error {
+	peer.RLock()
+	active, client, service, label := peer.Active, peer.AntiEntropyClient, peer.ServiceClient, peer.ID()
+	peer.RUnlock()
+	if !active || client == nil {
+		return nil
+	}
+	depth := s.antiEntropy.Depth
+	tree, err := s.sharedTree(peer.Address, depth)
+	if err != nil {
+		return err
+	}
+	treeCtx, cancel := context.WithTimeout(ctx, GetTimeout)
+	resp, err := client.MerkleTree(treeCtx, &pb.MerkleTreeRequest{From: s.self, Depth: int32(depth), Root: tree.root()})
+	cancel()
+	if err != nil {
+		peerFailed(peer, err)
+		return err
+	}
+	if len(resp.Nodes) == 0 {
+		antiEntropyOutOfSync.WithLabelValues(label).Set(0)
+		antiEntropyRounds.WithLabelValues(label, "in_sync").Inc()
+		antiEntropyLastRound.WithLabelValues(label).SetToCurrentTime()
+		return nil
+	}
+	if len(resp.Nodes) != len(tree.nodes) {
+		return fmt.Errorf("peer sent a tree of %d nodes, expected %d", len(resp.Nodes), len(tree.nodes))
+	}
+	leaves := tree.diff(resp.Nodes)
+	antiEntropyOutOfSync.WithLabelValues(label).Set(float64(len(leaves)))
+	differing := make(map[uint32]bool, len(leaves))
+	for _, leaf := range leaves {
+		differing[leaf] = true
+	}
+	local := map[string]*pb.KeyValue{}
+	err = s.forEachShared(peer.Address, func(kv *pb.KeyValue) error {
+		if differing[leafOf(kv.Key, depth)] {
+			local[string(kv.Key)] = kv
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	limit := time.NewTicker(keyInterval(s.antiEntropy.KeysPerSecond))
+	defer limit.Stop()
+	wait := func() error {
+		select {
+		case <-limit.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	syncCtx, cancelSync := context.WithCancel(ctx)
+	defer cancelSync()
+	stream, err := client.SyncRanges(syncCtx, &pb.SyncRangesRequest{From: s.self, Depth: int32(depth), Leaves: leaves})
+	if err != nil {
+		peerFailed(peer, err)
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			peerFailed(peer, err)
+			return err
+		}
+		for _, remote := range resp.Entries {
+			antiEntropyCompared.WithLabelValues(label).Inc()
+			mine, ok := local[string(remote.Key)]
+			delete(local, string(remote.Key))
+			if ok && bytes.Equal(mine.Value, remote.Value) {
+				continue
+			}
+			switch {
+			case !ok || remote.Version > mine.Version:
+				if err := wait(); err != nil {
+					return err
+				}
+				if err := s.pull(remote); err != nil {
+					return err
+				}
+				antiEntropyRepaired.WithLabelValues(label, "pulled").Inc()
+			case mine.Version > remote.Version:
+				if err := wait(); err != nil {
+					return err
+				}
+				if err := push(ctx, peer, service, mine); err != nil {
+					return err
+				}
+				antiEntropyRepaired.WithLabelValues(label, "pushed").Inc()
+			default:
+				antiEntropyConflicts.WithLabelValues(label).Inc()
+			}
+		}
+	}
+	// what is left the peer does not have at all
+	for _, mine := range local {
+		if err := wait(); err != nil {
+			return err
+		}
+		if err := push(ctx, peer, service, mine); err != nil {
+			return err
+		}
+		antiEntropyRepaired.WithLabelValues(label, "pushed").Inc()
+	}
+	antiEntropyRounds.WithLabelValues(label, "repaired").Inc()
+	antiEntropyLastRound.WithLabelValues(label).SetToCurrentTime()
+	return nil
+}
+
+// keyInterval returns the time between two keys at the rate, at least the nanosecond a ticker needs
+func keyInterval(keysPerSecond int) time.Duration {
+	return max(time.Second/time.Duration(keysPerSecond), time.Nanosecond)
+}
+
+// pull stores an entry of a peer locally unless a newer version was written meanwhile
+func (s *Server) pull(kv *pb.KeyValue) error {
+	unlock := s.keys.Lock(string(kv.Key))
+	defer unlock()
+	_, err := s.c.StoreVersion(kv.Key, kv.Value, kv.Version)
+	return err
+}
+
+// push writes a local entry to the peer only
+func push(ctx context.Context, peer *cluster.CacheClient, client pb.CacheServiceClient, kv *pb.KeyValue) error {
+	value := &anypb.Any{}
+	if err := proto.Unmarshal(kv.Value, value); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, GetTimeout)
+	defer cancel()
+	_, err := client.Set(ctx, &pb.SetRequest{Uuid: string(kv.Key), Value: value, Local: true, Version: kv.Version})
+	if err != nil {
+		peerFailed(peer, err)
+	}
+	return err
+}
+
+// AntiEntropyServer implements AntiEntropyService on top of a Server
+type AntiEntropyServer struct {
+	pb.UnimplementedAntiEntropyServiceServer
+	s *Server
+}
+
+// NewAntiEntropyServer creates the anti-entropy service of the server
+func NewAntiEntropyServer(s *Server) *AntiEntropyServer {
+	return &AntiEntropyServer{s: s}
+}
+
+func checkDepth(depth int32) error {
+	if depth < 1 || depth > MaxMerkleDepth {
+		return status.Errorf(codes.InvalidArgument, "depth %d out of range 1..%d", depth, MaxMerkleDepth)
+	}
+	return nil
+}
+
+// MerkleTree method returns the tree of the keys shared with the caller, or no nodes when the roots match
+func (a *AntiEntropyServer) MerkleTree(ctx context.Context, req *pb.MerkleTreeRequest) (*pb.MerkleTreeResponse, error) {
+	if err := checkDepth(req.Depth); err != nil {
+		return &pb.MerkleTreeResponse{}, err
+	}
+	tree, err := a.s.sharedTree(req.From, int(req.Depth))
+	if err != nil {
+		return &pb.MerkleTreeResponse{}, toStatus(err)
+	}
+	if bytes.Equal(tree.root(), req.Root) {
+		return &pb.MerkleTreeResponse{}, nil
+	}
+	return &pb.MerkleTreeResponse{Nodes: tree.nodes}, nil
+}
+
+// SyncRanges method streams the entries of the keys shared with the caller in the requested leaves
+func (a *AntiEntropyServer) SyncRanges(req *pb.SyncRangesRequest, stream grpc.ServerStreamingServer[pb.SyncRangesResponse]) error {
+	if err := checkDepth(req.Depth); err != nil {
+		return err
+	}
+	leaves := make(map[uint32]bool, len(req.Leaves))
+	for _, leaf := range req.Leaves {
+		if leaf >= 1<<req.Depth {
+			return status.Errorf(codes.InvalidArgument, "leaf %d out of range", leaf)
+		}
+		leaves[leaf] = true
+	}
+	resp := &pb.SyncRangesResponse{}
+	err := a.s.forEachShared(req.From, func(kv *pb.KeyValue) error {
+		if !leaves[leafOf(kv.Key, int(req.Depth))] {
+			return nil
+		}
+		resp.Entries = append(resp.Entries, kv)
+		if len(resp.Entries) < scanChunkSize {
+			return nil
+		}
+		err := stream.Send(resp)
+		resp = &pb.SyncRangesResponse{}
+		return err
+	})
+	if err != nil {
+		return toStatus(err)
+	}
+	if len(resp.Entries) == 0 {
+		return nil
+	}
+	return stream.Send(resp)
+}
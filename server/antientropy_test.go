@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// servePeer serves the server over an in-memory listener and returns it as a connected peer
+func servePeer(t *testing.T, s *Server, address string) *cluster.CacheClient {
+	lis := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	pb.RegisterCacheServiceServer(gs, s)
+	pb.RegisterAntiEntropyServiceServer(gs, NewAntiEntropyServer(s))
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	peer := &cluster.CacheClient{Address: address, Connect: func(string) (*grpc.ClientConn, error) {
+		return grpc.NewClient("passthrough:///"+address,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}))
+	}}
+	assert.NoError(t, peer.Init())
+	t.Cleanup(func() { peer.Conn.Close() })
+	return peer
+}
+
+func storeString(t *testing.T, s *Server, key, value string, version int64) {
+	data, err := proto.Marshal(stringValue(t, value))
+	assert.NoError(t, err)
+	_, err = s.c.StoreVersion([]byte(key), data, version)
+	assert.NoError(t, err)
+}
+
+func localString(t *testing.T, s *Server, key string) string {
+	resp, err := s.getLocal([]byte(key))
+	if !assert.NoError(t, err) || !resp.Found {
+		return ""
+	}
+	return unwrapString(t, resp.Value)
+}
+
+func unwrapString(t *testing.T, any *anypb.Any) string {
+	value := &wrapperspb.StringValue{}
+	assert.NoError(t, any.UnmarshalTo(value))
+	return value.Value
+}
+
+func TestMerkleTreeDiff(t *testing.T) {
+	kvs := []*pb.KeyValue{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}}
+	local := newMerkleTree(kvs, 4)
+	// the order of the entries does not change the tree
+	assert.Equal(t, local.nodes, newMerkleTree([]*pb.KeyValue{kvs[1], kvs[0]}, 4).nodes)
+
+	changed := newMerkleTree([]*pb.KeyValue{kvs[0], {Key: []byte("b"), Value: []byte("3")}}, 4)
+	assert.Equal(t, []uint32{leafOf([]byte("b"), 4)}, local.diff(changed.nodes))
+	assert.Empty(t, local.diff(local.nodes))
+}
+
+func TestAntiEntropyReconcilesReplicas(t *testing.T) {
+	a, cleanupA := newTestServer(t)
+	defer cleanupA()
+	b, cleanupB := newTestServer(t)
+	defer cleanupB()
+	assert.NoError(t, a.SetAntiEntropy(AntiEntropyConfig{Depth: 6, KeysPerSecond: 10000}))
+	peer := servePeer(t, b, "b")
+
+	storeString(t, a, "same", "v", 10)
+	storeString(t, b, "same", "v", 10)
+	storeString(t, a, "only-a", "a", 10)
+	storeString(t, b, "only-b", "b", 10)
+	storeString(t, a, "newer-on-a", "new", 20)
+	storeString(t, b, "newer-on-a", "old", 10)
+	storeString(t, a, "newer-on-b", "old", 10)
+	storeString(t, b, "newer-on-b", "new", 20)
+
+	assert.NoError(t, a.syncPeer(context.Background(), peer))
+	for _, s := range []*Server{a, b} {
+		assert.Equal(t, "a", localString(t, s, "only-a"))
+		assert.Equal(t, "b", localString(t, s, "only-b"))
+		assert.Equal(t, "new", localString(t, s, "newer-on-a"))
+		assert.Equal(t, "new", localString(t, s, "newer-on-b"))
+	}
+
+	// the replicas agree now, the next round only compares the roots
+	tree, err := a.sharedTree("b", 6)
+	assert.NoError(t, err)
+	resp, err := NewAntiEntropyServer(b).MerkleTree(context.Background(), &pb.MerkleTreeRequest{Depth: 6, Root: tree.root()})
+	assert.NoError(t, err)
+	assert.Empty(t, resp.Nodes)
+
+	// the tree is built once until the next write
+	cached, err := a.sharedTree("b", 6)
+	assert.NoError(t, err)
+	assert.Same(t, tree, cached)
+	storeString(t, a, "later", "v", 30)
+	rebuilt, err := a.sharedTree("b", 6)
+	assert.NoError(t, err)
+	assert.NotEqual(t, tree.root(), rebuilt.root())
+}
+
+func TestKeyInterval(t *testing.T) {
+	assert.Equal(t, time.Millisecond, keyInterval(1000))
+	// a rate above one key per nanosecond does not give a ticker a zero interval
+	assert.Equal(t, time.Nanosecond, keyInterval(2e9))
+}
+
+func TestSharedEntriesArePaged(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	kvs := []*pb.KeyValue{}
+	for i := 0; i < 2*antiEntropyPageSize+1; i++ {
+		key := fmt.Sprintf("k%05d", i)
+		storeString(t, s, key, key, 1)
+		value, _, err := s.c.GetVersion([]byte(key))
+		assert.NoError(t, err)
+		kvs = append(kvs, &pb.KeyValue{Key: []byte(key), Value: value})
+	}
+	seen := 0
+	assert.NoError(t, s.forEachShared("", func(kv *pb.KeyValue) error {
+		seen++
+		return nil
+	}))
+	assert.Equal(t, len(kvs), seen)
+	tree, err := s.sharedTree("", 8)
+	assert.NoError(t, err)
+	assert.Equal(t, newMerkleTree(kvs, 8).root(), tree.root())
+
+	// the largest tree fits into a gRPC message of the default size
+	size := proto.Size(&pb.MerkleTreeResponse{Nodes: newEmptyMerkleTree(MaxMerkleDepth).nodes})
+	assert.Less(t, size, 4*1024*1024)
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/radek-ryckowski/ssdc/cache"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultBootstrapPageSize is the number of keys requested from a peer at once
+	DefaultBootstrapPageSize = 500
+	// DefaultBootstrapKeysPerSecond is the default number of keys copied per second
+	DefaultBootstrapKeysPerSecond = 2000
+	// DefaultBootstrapRetryInterval is how often peers which could not be copied from are tried again
+	DefaultBootstrapRetryInterval = 5 * time.Second
+)
+
+var (
+	bootstrapKeys = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bootstrap_keys_total",
+		Help: "Total number of keys copied from peers while bootstrapping",
+	})
+
+	bootstrapInProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bootstrap_in_progress",
+		Help: "1 while the node copies its keys from the peers",
+	})
+)
+
+// BootstrapConfig configures Bootstrap
+type BootstrapConfig struct {
+	// StatePath persists the progress, an interrupted bootstrap resumes from it. Empty keeps no progress.
+	StatePath string
+	// PageSize is the number of keys requested from a peer at once
+	PageSize int
+	// KeysPerSecond limits the keys copied so the peers are not overloaded, rates above one key per
+	// nanosecond are not limited further
+	KeysPerSecond int
+	// RetryInterval is how often a partitioned node tries again the peers it shares keys with and could
+	// not copy from yet
+	RetryInterval time.Duration
+}
+
+// bootstrapState is the progress stored in the state file. Tokens are the scan continuation tokens and
+// Finished the completed scans, both keyed by peer address or by "" when every peer holds every key.
+type bootstrapState struct {
+	Done     bool              `json:"done"`
+	Tokens   map[string]string `json:"tokens"`
+	Finished map[string]bool   `json:"finished"`
+}
+
+func loadBootstrapState(path string) (*bootstrapState, error) {
+	state := &bootstrapState{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, state); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if state.Tokens == nil {
+		state.Tokens = map[string]string{}
+	}
+	if state.Finished == nil {
+		state.Finished = map[string]bool{}
+	}
+	return state, nil
+}
+
+func (b *bootstrapState) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// BeginBootstrap makes the node report NOT_SERVING on its health service until Bootstrap finishes, unless
+// the bootstrap saved in config.StatePath is done. It is called before the node starts serving, so no probe
+// sees an empty node as ready.
+func (s *Server) BeginBootstrap(config BootstrapConfig) error {
+	state, err := loadBootstrapState(config.StatePath)
+	if err != nil {
+		return err
+	}
+	if !state.Done {
+		s.health.SetServingStatus(HealthService, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	return nil
+}
+
+// Bootstrap copies the keys this node replicates from its active peers, the node reports NOT_SERVING on its
+// health service until it is done. Without partitioning the keys are copied from one peer, the next peer
+// continues where a failed one stopped. With partitioning every peer sharing keys with this node on the ring
+// is scanned for them, peers which are down or fail are tried again every config.RetryInterval until ctx is
+// done. Progress is saved after every page, a finished bootstrap is not repeated.
+func (s *Server) Bootstrap(ctx context.Context, config BootstrapConfig) error {
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = DefaultBootstrapRetryInterval
+	}
+	if config.PageSize <= 0 {
+		config.PageSize = DefaultBootstrapPageSize
+	}
+	if config.PageSize > MaxScanLimit {
+		config.PageSize = MaxScanLimit
+	}
+	if config.KeysPerSecond <= 0 {
+		config.KeysPerSecond = DefaultBootstrapKeysPerSecond
+	}
+	state, err := loadBootstrapState(config.StatePath)
+	if err != nil {
+		return err
+	}
+	if state.Done {
+		return nil
+	}
+	s.health.SetServingStatus(HealthService, healthpb.HealthCheckResponse_NOT_SERVING)
+	bootstrapInProgress.Set(1)
+	defer bootstrapInProgress.Set(0)
+
+	limit := time.NewTicker(keyInterval(config.KeysPerSecond))
+	defer limit.Stop()
+	b := &bootstrap{s: s, config: config, state: state, limit: limit}
+	if s.partitioned() {
+		if err := b.copyShared(ctx); err != nil {
+			return err
+		}
+	} else if !state.Finished[""] && len(s.GetPeers()) != 0 {
+		// the first node of a cluster has nothing to copy
+		err = errors.New("no active peer")
+		for _, peer := range s.GetPeers() {
+			if !isActive(peer) {
+				continue
+			}
+			if err = b.copyFrom(ctx, peer, ""); err == nil {
+				break
+			}
+			log.Printf("bootstrap from %s failed, trying the next peer: %v", peer.Address, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	state.Done = true
+	if err := state.save(config.StatePath); err != nil {
+		return err
+	}
+	s.health.SetServingStatus(HealthService, healthpb.HealthCheckResponse_SERVING)
+	return nil
+}
+
+// partitioned reports whether keys are stored on a subset of the nodes only
+func (s *Server) partitioned() bool {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+	return s.ring != nil && s.replicationFactor > 0 && s.replicationFactor <= len(s.peers)
+}
+
+func isActive(peer *cluster.CacheClient) bool {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.Active && peer.ServiceClient != nil
+}
+
+// bootstrap is one run of Bootstrap
+type bootstrap struct {
+	s      *Server
+	config BootstrapConfig
+	state  *bootstrapState
+	limit  *time.Ticker
+}
+
+// copyShared copies from every peer sharing keys with this node, it waits for the peers which are down or
+// fail until all of them are copied from
+func (b *bootstrap) copyShared(ctx context.Context) error {
+	for {
+		pending := []string{}
+		for _, peer := range b.s.sharingPeers() {
+			if b.state.Finished[peer.Address] {
+				continue
+			}
+			if !isActive(peer) {
+				pending = append(pending, peer.Address)
+				continue
+			}
+			if err := b.copyFrom(ctx, peer, peer.Address); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Printf("bootstrap from %s failed, trying again later: %v", peer.Address, err)
+				pending = append(pending, peer.Address)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		log.Printf("bootstrap waits for peers %v", pending)
+		select {
+		case <-time.After(b.config.RetryInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("bootstrap from %v: %w", pending, ctx.Err())
+		}
+	}
+}
+
+// sharingPeers returns the peers storing some keys together with this node
+func (s *Server) sharingPeers() []*cluster.CacheClient {
+	s.peersMu.RLock()
+	peers, ring, factor, self := s.peers, s.ring, s.replicationFactor, s.self
+	s.peersMu.RUnlock()
+	sharing := ring.Sharing(self, factor)
+	result := []*cluster.CacheClient{}
+	for _, peer := range peers {
+		if slices.Contains(sharing, peer.Address) {
+			result = append(result, peer)
+		}
+	}
+	return result
+}
+
+// copyFrom scans the peer page by page from the saved token of source and stores the keys this node owns
+func (b *bootstrap) copyFrom(ctx context.Context, peer *cluster.CacheClient, source string) error {
+	for {
+		entries, next, err := b.page(ctx, peer, b.state.Tokens[source])
+		if err != nil {
+			peerFailed(peer, err)
+			return err
+		}
+		for _, entry := range entries {
+			// linearizable keys are copied by the Raft log
+			if _, owner := b.s.replicas(entry.Uuid); !owner || b.s.linearizable(entry.Uuid) {
+				continue
+			}
+			select {
+			case <-b.limit.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if err := b.s.restore(entry); err != nil {
+				return err
+			}
+			bootstrapKeys.Inc()
+		}
+		if next == "" {
+			b.state.Finished[source] = true
+		}
+		b.state.Tokens[source] = next
+		if err := b.state.save(b.config.StatePath); err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+	}
+}
+
+// page reads one page of the peer's keys this node owns, it is read completely before the throttled writes start
+func (b *bootstrap) page(ctx context.Context, peer *cluster.CacheClient, token string) ([]*pb.ScanEntry, string, error) {
+	peer.RLock()
+	client := peer.ServiceClient
+	peer.RUnlock()
+	ctx, cancel := context.WithTimeout(ctx, GetTimeout)
+	defer cancel()
+	// the peer's own keys are read, of them only the ones this node owns
+	req := &pb.ScanRequest{Limit: int32(b.config.PageSize), ContinuationToken: token, Forwarded: true}
+	if b.s.partitioned() {
+		req.Owner = b.s.self
+	}
+	stream, err := client.Scan(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	entries := []*pb.ScanEntry{}
+	next := ""
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return entries, next, nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		entries = append(entries, resp.Entries...)
+		if resp.ContinuationToken != "" {
+			next = resp.ContinuationToken
+		}
+	}
+}
+
+// restore stores a copied entry. A versioned entry loses to a newer local write, an entry the peer read
+// from its storage has no version and is stored only when the key is absent here.
+func (s *Server) restore(entry *pb.ScanEntry) error {
+	value, err := proto.Marshal(entry.Value)
+	if err != nil {
+		return err
+	}
+	unlock := s.keys.Lock(entry.Uuid)
+	defer unlock()
+	if entry.Version != 0 {
+		_, err = s.c.StoreVersion([]byte(entry.Uuid), value, entry.Version)
+		return err
+	}
+	_, err = s.c.CompareAndStore([]byte(entry.Uuid), cache.CASCondition{Absent: true}, value)
+	return err
+}
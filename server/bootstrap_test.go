@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestBootstrapCopiesKeysFromPeer(t *testing.T) {
+	source, cleanupSource := newTestServer(t)
+	defer cleanupSource()
+	for i := 0; i < 7; i++ {
+		storeString(t, source, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i), int64(i+1))
+	}
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.SetPeers([]*cluster.CacheClient{servePeer(t, source, "source")})
+	// a newer local write is not replaced by the copy
+	storeString(t, s, "k0", "local", 100)
+
+	path := filepath.Join(t.TempDir(), "bootstrap.json")
+	config := BootstrapConfig{StatePath: path, PageSize: 2, KeysPerSecond: 10000}
+	assert.NoError(t, s.Bootstrap(context.Background(), config))
+	assert.Equal(t, "local", localString(t, s, "k0"))
+	for i := 1; i < 7; i++ {
+		assert.Equal(t, fmt.Sprintf("v%d", i), localString(t, s, fmt.Sprintf("k%d", i)))
+	}
+	resp, err := s.HealthServer().Check(context.Background(), &healthpb.HealthCheckRequest{Service: HealthService})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	// a finished bootstrap is not repeated
+	storeString(t, source, "k7", "v7", 8)
+	assert.NoError(t, s.Bootstrap(context.Background(), config))
+	assert.Equal(t, "", localString(t, s, "k7"))
+}
+
+func TestBootstrapResumes(t *testing.T) {
+	source, cleanupSource := newTestServer(t)
+	defer cleanupSource()
+	for i := 0; i < 5; i++ {
+		storeString(t, source, fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i), int64(i+1))
+	}
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.SetPeers([]*cluster.CacheClient{servePeer(t, source, "source")})
+
+	// the previous run stopped after copying k0..k2
+	path := filepath.Join(t.TempDir(), "bootstrap.json")
+	token := base64.RawURLEncoding.EncodeToString([]byte("k2"))
+	assert.NoError(t, os.WriteFile(path, []byte(`{"tokens": {"": "`+token+`"}}`), 0644))
+	assert.NoError(t, s.Bootstrap(context.Background(), BootstrapConfig{StatePath: path, PageSize: 2, KeysPerSecond: 10000}))
+	assert.Equal(t, "", localString(t, s, "k2"))
+	assert.Equal(t, "v3", localString(t, s, "k3"))
+	assert.Equal(t, "v4", localString(t, s, "k4"))
+
+	state, err := loadBootstrapState(path)
+	assert.NoError(t, err)
+	assert.True(t, state.Done)
+}
+
+func TestBootstrapCopiesOwnedKeysOnly(t *testing.T) {
+	servers := newTestCluster(t, []string{"a", "b", "c", "d"}, 2)
+	// a holds every key, as it did before d joined
+	owned := map[string]bool{}
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		storeString(t, servers["a"], key, key, 1)
+		if slices.Contains(servers["d"].ring.Replicas(key, 2), "d") {
+			owned[key] = true
+		}
+	}
+
+	// a sends d only the keys d owns, paging over the others
+	client := servePeer(t, servers["a"], "a").ServiceClient
+	scanned := map[string]bool{}
+	token := ""
+	for {
+		stream, err := client.Scan(context.Background(), &pb.ScanRequest{Limit: 3, ContinuationToken: token, Forwarded: true, Owner: "d"})
+		assert.NoError(t, err)
+		token = ""
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				assert.ErrorIs(t, err, io.EOF)
+				break
+			}
+			for _, entry := range resp.Entries {
+				scanned[entry.Uuid] = true
+			}
+			token = resp.ContinuationToken
+		}
+		if token == "" {
+			break
+		}
+	}
+	assert.Equal(t, owned, scanned)
+
+	assert.NoError(t, servers["d"].Bootstrap(context.Background(), BootstrapConfig{PageSize: 4, KeysPerSecond: 1e10}))
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		assert.Equal(t, owned[key], localString(t, servers["d"], key) == key, key)
+	}
+}
+
+func TestBootstrapWaitsForSharingPeers(t *testing.T) {
+	servers := newTestCluster(t, []string{"a", "b", "c", "d"}, 2)
+	d := servers["d"]
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		for _, replica := range d.ring.Replicas(key, 2) {
+			if replica != "d" {
+				storeString(t, servers[replica], key, key, 1)
+			}
+		}
+	}
+	sharing := d.sharingPeers()
+	if !assert.NotEmpty(t, sharing) {
+		return
+	}
+	down := sharing[0]
+	down.Lock()
+	down.Active = false
+	down.Unlock()
+
+	path := filepath.Join(t.TempDir(), "bootstrap.json")
+	config := BootstrapConfig{StatePath: path, PageSize: 4, KeysPerSecond: 1e10, RetryInterval: 10 * time.Millisecond}
+	assert.NoError(t, d.BeginBootstrap(config))
+	health := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := d.HealthServer().Check(context.Background(), &healthpb.HealthCheckRequest{Service: HealthService})
+		assert.NoError(t, err)
+		return resp.Status
+	}
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, health())
+
+	done := make(chan error, 1)
+	go func() { done <- d.Bootstrap(context.Background(), config) }()
+	// the bootstrap is not done while a peer sharing keys with the node is down
+	select {
+	case err := <-done:
+		t.Fatalf("bootstrap finished without %s: %v", down.Address, err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, health())
+	state, err := loadBootstrapState(path)
+	assert.NoError(t, err)
+	assert.False(t, state.Done)
+
+	down.Lock()
+	down.Active = true
+	down.Unlock()
+	assert.NoError(t, <-done)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, health())
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		assert.Equal(t, slices.Contains(d.ring.Replicas(key, 2), "d"), localString(t, d, key) == key, key)
+	}
+
+	// a finished bootstrap does not hold the node back again
+	assert.NoError(t, d.BeginBootstrap(config))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, health())
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// majority returns the number of nodes which form a majority of the replicas of a key,
+// the replicas are this node and the given number of peers
+func majority(peers int) int {
+	return (peers+1)/2 + 1
+}
+
+// writeConsistency validates the consistency of a Set of a key with the given number of replica peers and
+// returns the number of them which have to acknowledge the write, localOnly is set when the write must not be replicated
+func (s *Server) writeConsistency(req *pb.SetRequest, peers int) (acks int, localOnly bool, err error) {
+	if req.Consistency != pb.Consistency_CONSISTENCY_UNSPECIFIED && (req.Local || req.Quorum != 0) {
+		return 0, false, status.Error(codes.InvalidArgument, "consistency cannot be combined with local or quorum")
+	}
+	switch req.Consistency {
+	case pb.Consistency_CONSISTENCY_UNSPECIFIED:
+		return writeQuorum(req.Quorum, peers), req.Local, nil
+	case pb.Consistency_ONE:
+		return 0, false, nil
+	case pb.Consistency_QUORUM:
+		return majority(peers) - 1, false, nil
+	case pb.Consistency_ALL:
+		return peers, false, nil
+	case pb.Consistency_LOCAL_ONLY:
+		return 0, true, nil
+	}
+	return 0, false, status.Errorf(codes.InvalidArgument, "unknown consistency %d", req.Consistency)
+}
+
+// readConsistency validates the consistency of a Get of a key with the given number of replica peers and returns
+// the number of nodes, including this one, which have to answer, localOnly is set when only this node is read
+func (s *Server) readConsistency(req *pb.GetRequest, peers int) (nodes int, localOnly bool, err error) {
+	if req.Consistency != pb.Consistency_CONSISTENCY_UNSPECIFIED && req.Local {
+		return 0, false, status.Error(codes.InvalidArgument, "consistency cannot be combined with local")
+	}
+	switch req.Consistency {
+	case pb.Consistency_CONSISTENCY_UNSPECIFIED:
+		return s.readQuorum(peers), req.Local, nil
+	case pb.Consistency_ONE:
+		return 1, false, nil
+	case pb.Consistency_QUORUM:
+		return majority(peers), false, nil
+	case pb.Consistency_ALL:
+		return peers + 1, false, nil
+	case pb.Consistency_LOCAL_ONLY:
+		return 1, true, nil
+	}
+	return 0, false, status.Errorf(codes.InvalidArgument, "unknown consistency %d", req.Consistency)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/radek-ryckowski/ssdc/breaker"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	"github.com/radek-ryckowski/ssdc/db"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain is the domain of the ErrorInfo details of the errors of this service
+const errorDomain = "ssdc"
+
+// quorumError builds an UNAVAILABLE error with the failure attached as detail,
+// DEADLINE_EXCEEDED is returned instead when one of the failed peers timed out
+func quorumError(msg string, failure *pb.QuorumFailure) error {
+	code := codes.Unavailable
+	for _, peer := range failure.FailedPeers {
+		if codes.Code(peer.Code) == codes.DeadlineExceeded {
+			failure.TimedOut = true
+		}
+	}
+	if failure.TimedOut {
+		code = codes.DeadlineExceeded
+	}
+	st, err := status.New(code, msg).WithDetails(failure)
+	if err != nil {
+		return status.Error(code, msg)
+	}
+	return st.Err()
+}
+
+// unavailable builds an UNAVAILABLE error this node answers with itself, the detail tells it apart from a
+// node which cannot be reached, so callers neither fail the node in their guard nor retry another replica
+func unavailable(reason string, msg string) error {
+	st, err := status.New(codes.Unavailable, msg).WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain})
+	if err != nil {
+		return status.Error(codes.Unavailable, msg)
+	}
+	return st.Err()
+}
+
+// peerFailed records a failed call to the peer and describes the failure. A failed call does not take the
+// peer out of rotation, that is up to the health checks; the guard of the peer fails fast while it keeps failing.
+func peerFailed(peer *cluster.CacheClient, err error) *pb.PeerFailure {
+	st := status.Convert(err)
+	peer.RLock()
+	defer peer.RUnlock()
+	switch {
+	case errors.Is(err, cluster.ErrCircuitOpen):
+		rejectedCalls.WithLabelValues(peer.ID(), "circuit_open").Inc()
+	case errors.Is(err, cluster.ErrOverloaded):
+		rejectedCalls.WithLabelValues(peer.ID(), "overloaded").Inc()
+	case st.Code() != codes.Canceled:
+		// calls canceled by this node after it got its answer elsewhere are no errors
+		nodeErrors.WithLabelValues(peer.ID()).Inc()
+	}
+	return &pb.PeerFailure{Address: peer.Address, Code: int32(st.Code()), Message: st.Message()}
+}
+
+// inactivePeer describes a peer known to be down which was not asked
+func inactivePeer(peer *cluster.CacheClient) *pb.PeerFailure {
+	return &pb.PeerFailure{Address: peer.Address, Code: int32(codes.Unavailable), Message: "peer inactive"}
+}
+
+// toStatus converts errors of the local cache and storage to gRPC status errors
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, db.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, breaker.ErrOpen):
+		return unavailable("STORAGE_UNAVAILABLE", err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// quorumFailure returns the QuorumFailure detail of err
+func quorumFailure(t *testing.T, err error) *pb.QuorumFailure {
+	details := status.Convert(err).Details()
+	if !assert.Len(t, details, 1) {
+		return &pb.QuorumFailure{}
+	}
+	failure, ok := details[0].(*pb.QuorumFailure)
+	assert.True(t, ok, "unexpected detail %v", details[0])
+	return failure
+}
+
+func TestSetMissingQuorumReportsFailure(t *testing.T) {
+	up, down := newFakePeer(), newFakePeer()
+	down.err = status.Error(codes.Unavailable, "connection refused")
+	s, cleanup := newTestServer(t, up, down)
+	defer cleanup()
+
+	resp, err := s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "value"), Consistency: pb.Consistency_ALL})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.False(t, resp.Success)
+	failure := quorumFailure(t, err)
+	assert.Equal(t, int32(3), failure.Required)
+	assert.False(t, failure.TimedOut)
+	if assert.Len(t, failure.FailedPeers, 1) {
+		assert.Equal(t, "peer1", failure.FailedPeers[0].Address)
+		assert.Equal(t, int32(codes.Unavailable), failure.FailedPeers[0].Code)
+	}
+}
+
+func TestTimedOutPeerReturnsDeadlineExceeded(t *testing.T) {
+	refused, timedOut := newFakePeer(), newFakePeer()
+	refused.err = status.Error(codes.Unavailable, "connection refused")
+	timedOut.err = status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+	s, cleanup := newTestServer(t, refused, timedOut)
+	defer cleanup()
+
+	// one of the failed peers timed out, the caller may retry with a longer deadline
+	_, err := s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "value"), Consistency: pb.Consistency_QUORUM})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	failure := quorumFailure(t, err)
+	assert.True(t, failure.TimedOut)
+	assert.Len(t, failure.FailedPeers, 2)
+
+	// peers which refused the call only make it UNAVAILABLE
+	timedOut.err = status.Error(codes.Unavailable, "connection refused")
+	_, err = s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "value"), Consistency: pb.Consistency_QUORUM})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.False(t, quorumFailure(t, err).TimedOut)
+}
+
+func TestBatchSetReportsFailedKeys(t *testing.T) {
+	up, down := newFakePeer(), newFakePeer()
+	down.err = status.Error(codes.Unavailable, "connection refused")
+	s, cleanup := newTestServer(t, up, down)
+	defer cleanup()
+
+	resp, err := s.BatchSet(context.Background(), &pb.BatchSetRequest{Quorum: 3, Entries: []*pb.BatchSetEntry{
+		{Uuid: "a", Value: stringValue(t, "a")},
+		{Uuid: "b", Value: stringValue(t, "b")},
+	}})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.False(t, resp.Success)
+	failure := quorumFailure(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, failure.FailedKeys)
+	assert.Equal(t, int32(3), failure.Required)
+	assert.Equal(t, int32(2), failure.Achieved)
+	if assert.Len(t, failure.FailedPeers, 1) {
+		assert.Equal(t, "peer1", failure.FailedPeers[0].Address)
+	}
+}
+
+func TestGetNotFoundAndUnreachable(t *testing.T) {
+	first, second := newFakePeer(), newFakePeer()
+	s, cleanup := newTestServer(t, first, second)
+	defer cleanup()
+
+	// every node answered without the key, it is not found
+	resp, err := s.Get(context.Background(), &pb.GetRequest{Uuid: "missing"})
+	assert.NoError(t, err)
+	assert.False(t, resp.Found)
+
+	// a single answer cannot tell a missing key from one stored on the unreachable nodes
+	first.err = status.Error(codes.Unavailable, "connection refused")
+	second.err = status.Error(codes.Unavailable, "connection refused")
+	_, err = s.Get(context.Background(), &pb.GetRequest{Uuid: "missing"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	failure := quorumFailure(t, err)
+	assert.Equal(t, int32(1), failure.Achieved)
+	assert.Len(t, failure.FailedPeers, 2)
+}
+
+func TestEmptyUuidIsInvalidArgument(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	value := stringValue(t, "value")
+	ctx := context.Background()
+
+	_, err := s.Set(ctx, &pb.SetRequest{Value: value})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.Get(ctx, &pb.GetRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.CompareAndSet(ctx, &pb.CompareAndSetRequest{Value: value, CreateOnly: true})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.BatchSet(ctx, &pb.BatchSetRequest{Entries: []*pb.BatchSetEntry{{Uuid: "key", Value: value}, {Value: value}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.BatchGet(ctx, &pb.BatchGetRequest{Uuids: []string{"key", ""}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	DefaultHealthCheckInterval = 2 * time.Second
+	DefaultHealthCheckTimeout  = time.Second
+	// maxHealthCheckBackoff caps the exponential backoff of a failing peer at 2^5 intervals
+	maxHealthCheckBackoff = 5
+)
+
+// HealthService is the service name the nodes report and check the health of
+var HealthService = pb.CacheService_ServiceDesc.ServiceName
+
+var (
+	peerUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "peer_up",
+		Help: "Whether the peer answered the last health check as serving",
+	}, []string{"peer"})
+
+	peerLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "peer_health_check_latency_seconds",
+		Help: "Round trip of the last successful health check of the peer",
+	}, []string{"peer"})
+
+	peerLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "peer_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful health check of the peer",
+	}, []string{"peer"})
+
+	peerConsecutiveFailures = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "peer_consecutive_failures",
+		Help: "Number of failed health checks of the peer since its last successful check",
+	}, []string{"peer"})
+
+	peerCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "peer_circuit_state",
+		Help: "State of the circuit breaker of the peer: 0 closed, 1 open, 2 half-open",
+	}, []string{"peer"})
+
+	peerInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "peer_in_flight_calls",
+		Help: "Number of unary calls in flight to the peer",
+	}, []string{"peer"})
+
+	peerCallTimeout = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "peer_call_timeout_seconds",
+		Help: "Timeout of the next call of the method to the peer, derived from its observed latency",
+	}, []string{"peer", "method"})
+)
+
+// HealthServer returns the gRPC health service of the node, it has to be registered on the gRPC server
+func (s *Server) HealthServer() *health.Server {
+	return s.health
+}
+
+// SetHealthCheck sets how often peers are checked and how long a check may take
+func (s *Server) SetHealthCheck(interval, timeout time.Duration) {
+	s.healthInterval = interval
+	s.healthTimeout = timeout
+}
+
+// probePeers checks the health of the peers every health check interval
+func (s *Server) probePeers() {
+	ticker := time.NewTicker(s.healthInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.checkPeers()
+	}
+}
+
+// checkPeers checks all peers concurrently and waits for the checks to finish
+func (s *Server) checkPeers() {
+	var wg sync.WaitGroup
+	for _, peer := range s.GetPeers() {
+		wg.Add(1)
+		go func(peer *cluster.CacheClient) {
+			defer wg.Done()
+			s.checkPeer(peer)
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// checkPeer connects to the peer when needed and asks it for its health. A failing peer is
+// checked with an exponential backoff, a peer coming back is handed to the sync log to get its hints.
+func (s *Server) checkPeer(peer *cluster.CacheClient) {
+	peer.Lock()
+	if peer.ConsecutiveFailures > 0 {
+		backoff := s.healthInterval << min(peer.ConsecutiveFailures-1, maxHealthCheckBackoff)
+		if time.Now().Before(peer.LastFailure.Add(backoff - s.healthInterval)) {
+			peer.Unlock()
+			return
+		}
+	}
+	wasActive := peer.Active
+	if peer.HealthClient == nil && peer.Connect != nil {
+		if err := peer.Init(); err != nil {
+			peer.RecordFailure()
+			nodeErrors.WithLabelValues(peer.ID()).Inc()
+			peer.Unlock()
+			observePeer(peer)
+			return
+		}
+	}
+	client := peer.HealthClient
+	peer.Unlock()
+	if client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.healthTimeout)
+	start := time.Now()
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: HealthService})
+	latency := time.Since(start)
+	cancel()
+	if err == nil && resp.Status != healthpb.HealthCheckResponse_SERVING {
+		err = fmt.Errorf("peer is %s", resp.Status)
+	}
+
+	peer.Lock()
+	if err != nil {
+		peer.RecordFailure()
+		nodeErrors.WithLabelValues(peer.ID()).Inc()
+	} else {
+		peer.RecordSuccess(latency)
+	}
+	back := !wasActive && peer.Active
+	identified := peer.Node != ""
+	peer.Unlock()
+	// a node coming back may have been replaced by a new one at the same address
+	if back || (err == nil && !identified) {
+		s.identify(peer)
+	}
+	observePeer(peer)
+	if back {
+		s.slog.UpdatePeer(peer)
+		s.slog.StartSync()
+	}
+}
+
+// observePeer exports the health state of the peer
+func observePeer(peer *cluster.CacheClient) {
+	peer.RLock()
+	defer peer.RUnlock()
+	up := 0.0
+	if peer.Active {
+		up = 1
+	}
+	peerUp.WithLabelValues(peer.ID()).Set(up)
+	peerConsecutiveFailures.WithLabelValues(peer.ID()).Set(float64(peer.ConsecutiveFailures))
+	if !peer.LastSuccess.IsZero() {
+		peerLatency.WithLabelValues(peer.ID()).Set(peer.Latency.Seconds())
+		peerLastSuccess.WithLabelValues(peer.ID()).Set(float64(peer.LastSuccess.Unix()))
+	}
+	if peer.Guard != nil {
+		peerCircuitState.WithLabelValues(peer.ID()).Set(float64(peer.Guard.State()))
+		peerInFlight.WithLabelValues(peer.ID()).Set(float64(peer.Guard.InFlight()))
+		for method, timeout := range peer.Guard.Timeouts() {
+			peerCallTimeout.WithLabelValues(peer.ID(), method).Set(timeout.Seconds())
+		}
+	}
+}
+
+// forgetPeer drops the metrics of a peer by the label it was known by
+func forgetPeer(label string) {
+	labels := prometheus.Labels{"peer": label}
+	for _, metric := range []*prometheus.GaugeVec{peerUp, peerLatency, peerLastSuccess, peerConsecutiveFailures, peerCircuitState, peerInFlight, peerCallTimeout, antiEntropyOutOfSync, antiEntropyLastRound} {
+		metric.DeletePartialMatch(labels)
+	}
+	for _, metric := range []*prometheus.CounterVec{nodeErrors, rejectedCalls, antiEntropyRounds, antiEntropyCompared, antiEntropyRepaired, antiEntropyConflicts} {
+		metric.DeletePartialMatch(labels)
+	}
+}
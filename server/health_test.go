@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// fakeHealth answers health checks with the status or the error it is set to
+type fakeHealth struct {
+	healthpb.HealthClient
+	mu     sync.Mutex
+	status healthpb.HealthCheckResponse_ServingStatus
+	err    error
+	checks int
+}
+
+func (f *fakeHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest, opts ...grpc.CallOption) (*healthpb.HealthCheckResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checks++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &healthpb.HealthCheckResponse{Status: f.status}, nil
+}
+
+func (f *fakeHealth) set(status healthpb.HealthCheckResponse_ServingStatus, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status, f.err = status, err
+}
+
+func TestHealthServerReportsServing(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	resp, err := s.HealthServer().Check(context.Background(), &healthpb.HealthCheckRequest{Service: HealthService})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func TestCheckPeerTracksHealth(t *testing.T) {
+	s, cleanup := newTestServer(t, newFakePeer())
+	defer cleanup()
+	s.SetHealthCheck(time.Minute, time.Second)
+	peer := s.GetPeers()[0]
+	fake := &fakeHealth{}
+	peer.HealthClient = fake
+
+	fake.set(healthpb.HealthCheckResponse_SERVING, errors.New("connection refused"))
+	s.checkPeer(peer)
+	assert.False(t, peer.Active)
+	assert.Equal(t, 1, peer.ConsecutiveFailures)
+
+	// a peer which is up but not serving is not used either
+	fake.set(healthpb.HealthCheckResponse_NOT_SERVING, nil)
+	s.checkPeer(peer)
+	assert.False(t, peer.Active)
+	assert.Equal(t, 2, peer.ConsecutiveFailures)
+
+	// after two failures the peer is checked every other interval only
+	s.checkPeer(peer)
+	assert.Equal(t, 2, fake.checks)
+	peer.LastFailure = time.Now().Add(-time.Minute)
+
+	fake.set(healthpb.HealthCheckResponse_SERVING, nil)
+	s.checkPeer(peer)
+	assert.Equal(t, 3, fake.checks)
+	assert.True(t, peer.Active)
+	assert.Zero(t, peer.ConsecutiveFailures)
+	assert.False(t, peer.LastSuccess.IsZero())
+	assert.Positive(t, peer.Latency)
+
+	info := peerInfo(peer)
+	assert.True(t, info.Active)
+	assert.Equal(t, peer.LastSuccess.Unix(), info.LastSuccess)
+}
+
+// fakeNode answers Hello with its id
+type fakeNode struct {
+	pb.NodeServiceClient
+	id string
+}
+
+func (f *fakeNode) Hello(ctx context.Context, req *pb.HelloRequest, opts ...grpc.CallOption) (*pb.HelloResponse, error) {
+	return &pb.HelloResponse{NodeId: f.id}, nil
+}
+
+func TestCheckPeerIdentifiesPeer(t *testing.T) {
+	s, cleanup := newTestServer(t, newFakePeer())
+	defer cleanup()
+	s.SetHealthCheck(time.Minute, time.Second)
+	peer := s.GetPeers()[0]
+	peer.Node = ""
+	fake := &fakeHealth{status: healthpb.HealthCheckResponse_SERVING}
+	peer.HealthClient = fake
+	peer.NodeClient = &fakeNode{id: "first"}
+
+	s.checkPeer(peer)
+	assert.Equal(t, "first", peer.Node)
+	assert.Equal(t, "first", peerInfo(peer).NodeId)
+
+	// the node at the address was replaced while it was down
+	fake.set(healthpb.HealthCheckResponse_SERVING, errors.New("connection refused"))
+	s.checkPeer(peer)
+	peer.NodeClient = &fakeNode{id: "second"}
+	fake.set(healthpb.HealthCheckResponse_SERVING, nil)
+	s.checkPeer(peer)
+	assert.Equal(t, "second", peer.Node)
+}
+
+func TestPeerHelloRecordsCaller(t *testing.T) {
+	s, cleanup := newTestServer(t, newFakePeer())
+	defer cleanup()
+	peer := s.GetPeers()[0]
+	peer.Node = ""
+
+	// a caller at an unknown address is ignored
+	s.PeerHello("other", "elsewhere")
+	assert.Equal(t, "", peer.Node)
+
+	identity := cluster.NewIdentity("self")
+	identity.SetOnHello(s.PeerHello)
+	_, err := identity.Hello(context.Background(), &pb.HelloRequest{NodeId: "caller", Address: peer.Address})
+	assert.NoError(t, err)
+	assert.Equal(t, "caller", peer.Node)
+	assert.Equal(t, "caller", peerLabel(peer))
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"log"
+
+	"github.com/radek-ryckowski/ssdc/cluster"
+)
+
+// SetNodeID sets the persistent id this node introduces itself to its peers with
+func (s *Server) SetNodeID(id string) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	s.id = id
+}
+
+// identify learns the node id of the peer. When the id changed, the hints and metrics of the old id
+// are no longer used for the peer and the new id is persisted.
+func (s *Server) identify(peer *cluster.CacheClient) {
+	s.peersMu.RLock()
+	id, self := s.id, s.self
+	s.peersMu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), s.healthTimeout)
+	defer cancel()
+	previous, err := peer.Identify(ctx, id, self)
+	if err != nil {
+		log.Printf("could not identify peer %s: %v", peer.Address, err)
+		return
+	}
+	s.identified(peer, previous)
+}
+
+// PeerHello records the id a peer introduced itself with when it called this node,
+// the peer is matched by the address it is reached at
+func (s *Server) PeerHello(id, address string) {
+	for _, peer := range s.GetPeers() {
+		if peer.Address != address {
+			continue
+		}
+		peer.Lock()
+		previous := peer.Node
+		peer.Node = id
+		peer.Unlock()
+		s.identified(peer, previous)
+		return
+	}
+}
+
+// identified moves the hints and metrics of the peer from the previous id to the current one
+// and persists it when the id changed
+func (s *Server) identified(peer *cluster.CacheClient, previous string) {
+	if peerLabel(peer) == previous {
+		return
+	}
+	if previous == "" {
+		previous = peer.Address
+	}
+	forgetPeer(previous)
+	s.slog.UpdatePeer(peer)
+	if err := s.savePeers(); err != nil {
+		log.Printf("could not persist peers: %v", err)
+	}
+}
+
+// peerLabel returns the id the metrics and hints of the peer are keyed by
+func peerLabel(peer *cluster.CacheClient) string {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.ID()
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyLocksOrderSameKey(t *testing.T) {
+	var locks keyLocks
+	var inside int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.Lock("key")
+			defer unlock()
+			assert.Equal(t, int32(1), atomic.AddInt32(&inside, 1))
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&inside, -1)
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, locks.locks)
+}
+
+func TestKeyLocksDifferentKeys(t *testing.T) {
+	var locks keyLocks
+	unlockA := locks.Lock("a")
+	done := make(chan struct{})
+	go func() {
+		unlock := locks.Lock("b")
+		unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock of another key blocked")
+	}
+	unlockA()
+	assert.Empty(t, locks.locks)
+}
+
+func TestKeyLocksLockAll(t *testing.T) {
+	var locks keyLocks
+	var wg sync.WaitGroup
+	// overlapping key sets in different orders must not deadlock, duplicates are locked once
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			locks.LockAll([]string{"a", "b", "c", "a"})()
+		}()
+		go func() {
+			defer wg.Done()
+			locks.LockAll([]string{"c", "b"})()
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, locks.locks)
+}
+
+// benchmarkSet runs parallel Sets against peers answering after a simulated network round trip,
+// keys returns the key of the n-th write of a goroutine
+func benchmarkSet(b *testing.B, keys func(goroutine, n int) string) {
+	peers := []*fakePeer{newFakePeer(), newFakePeer()}
+	for _, peer := range peers {
+		peer.delay = time.Millisecond
+	}
+	s, cleanup := newTestServer(b, peers...)
+	defer cleanup()
+	value := stringValue(b, "value")
+	var goroutines int32
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		g := int(atomic.AddInt32(&goroutines, 1))
+		for n := 0; p.Next(); n++ {
+			_, err := s.Set(context.Background(), &pb.SetRequest{Uuid: keys(g, n), Value: value, Consistency: pb.Consistency_ALL})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSetDistinctKeys(b *testing.B) {
+	benchmarkSet(b, func(g, n int) string { return fmt.Sprintf("key-%d-%d", g, n) })
+}
+
+// BenchmarkSetSameKey serializes every write like the former server wide lock did
+func BenchmarkSetSameKey(b *testing.B) {
+	benchmarkSet(b, func(g, n int) string { return "key" })
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"log"
+
+	"github.com/radek-ryckowski/ssdc/cluster"
+	"google.golang.org/grpc"
+)
+
+// FollowMembership keeps the peers of the server in line with the gossip membership. Joining and leaving
+// members change the ring, alive members are connected to and added as peers and left members are removed.
+// The liveness of a member does not move keys: a dead member stays on the ring as an inactive peer which gets
+// hints until it is alive again or leaves. connect dials new peers.
+func (s *Server) FollowMembership(m *cluster.Membership, connect func(address string) (*grpc.ClientConn, error)) {
+	m.Subscribe(func(member cluster.Member) {
+		switch member.State {
+		case cluster.MemberAlive:
+			s.memberAlive(member.Address, connect)
+		case cluster.MemberDead:
+			s.memberDead(member.Address)
+		case cluster.MemberLeft:
+			s.removePeer(member.Address)
+		}
+		// suspect members stay active, requests to them fail over like to any unreachable peer
+		if err := s.savePeers(); err != nil {
+			log.Printf("could not persist peers: %v", err)
+		}
+	})
+}
+
+// memberAlive adds the member as a peer or reconnects the peer when it was marked inactive
+func (s *Server) memberAlive(address string, connect func(address string) (*grpc.ClientConn, error)) {
+	peer := s.peer(address)
+	if peer == nil {
+		// the node id is learned from the peer once it answers a health check
+		peer = &cluster.CacheClient{Address: address, Connect: connect}
+		peer.Lock()
+		err := peer.Init()
+		peer.Unlock()
+		if err != nil {
+			nodeErrors.WithLabelValues(address).Inc()
+			log.Printf("could not connect to member %s: %v", address, err)
+		}
+		s.addPeer(peer)
+		return
+	}
+	peer.Lock()
+	if !peer.Active {
+		if peer.Conn != nil {
+			peer.Conn.Close()
+		}
+		if err := peer.Init(); err != nil {
+			nodeErrors.WithLabelValues(peer.ID()).Inc()
+			log.Printf("could not reconnect to member %s: %v", address, err)
+		}
+	}
+	peer.Unlock()
+	s.slog.UpdatePeer(peer)
+}
+
+// memberDead marks the peer of a dead member inactive, it keeps its place on the ring
+func (s *Server) memberDead(address string) {
+	peer := s.peer(address)
+	if peer == nil {
+		return
+	}
+	peer.Lock()
+	peer.Active = false
+	peer.Unlock()
+}
+
+// peer returns the peer with the address, nil when there is none
+func (s *Server) peer(address string) *cluster.CacheClient {
+	for _, peer := range s.GetPeers() {
+		if peer.Address == address {
+			return peer
+		}
+	}
+	return nil
+}
+
+// addPeer adds the peer unless a peer with its address exists
+func (s *Server) addPeer(peer *cluster.CacheClient) bool {
+	s.peersMu.Lock()
+	for _, p := range s.peers {
+		if p.Address == peer.Address {
+			s.peersMu.Unlock()
+			return false
+		}
+	}
+	peers := make([]*cluster.CacheClient, len(s.peers), len(s.peers)+1)
+	copy(peers, s.peers)
+	s.peers = append(peers, peer)
+	s.buildRing()
+	s.peersMu.Unlock()
+	s.slog.UpdatePeer(peer)
+	return true
+}
+
+// removePeer removes the peer with the address and closes its connection, its hints stay in the sync log
+func (s *Server) removePeer(address string) *cluster.CacheClient {
+	s.peersMu.Lock()
+	var removed *cluster.CacheClient
+	peers := make([]*cluster.CacheClient, 0, len(s.peers))
+	for _, peer := range s.peers {
+		if peer.Address == address {
+			removed = peer
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	s.peers = peers
+	s.buildRing()
+	s.peersMu.Unlock()
+	if removed != nil {
+		removed.Lock()
+		removed.Active = false
+		if removed.Conn != nil {
+			removed.Conn.Close()
+		}
+		label := removed.ID()
+		removed.Unlock()
+		forgetPeer(label)
+		forgetPeer(address)
+	}
+	return removed
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/radek-ryckowski/ssdc/cache"
+	"github.com/radek-ryckowski/ssdc/db"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/radek-ryckowski/ssdc/raft"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// SetRaft makes the keys starting with one of the prefixes linearizable: their writes are ordered by the
+// Raft log of node and their reads wait for the read index. Every node of the cluster has to be a member
+// of the group and use the same prefixes, the members are identified by their addresses.
+func (s *Server) SetRaft(node *raft.Node, prefixes []string) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	s.raft = node
+	s.raftPrefixes = prefixes
+}
+
+// linearizable reports whether the key is written through the Raft log
+func (s *Server) linearizable(key string) bool {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+	if s.raft == nil {
+		return false
+	}
+	for _, prefix := range s.raftPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// linearizableRange reports whether a key in the range [start, end) is linearizable, an empty end means no upper bound
+func (s *Server) linearizableRange(start, end string) bool {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
+	if s.raft == nil {
+		return false
+	}
+	for _, prefix := range s.raftPrefixes {
+		prefixEnd := db.PrefixEnd(prefix)
+		if (end == "" || prefix < end) && (prefixEnd == "" || start < prefixEnd) {
+			return true
+		}
+	}
+	return false
+}
+
+// raftSet writes a linearizable key, it is proposed on the leader and forwarded to it from the other nodes.
+// The write is acknowledged by a majority of the members, quorum and consistency of the request are not used.
+func (s *Server) raftSet(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+	if req.Local || req.Consistency == pb.Consistency_LOCAL_ONLY {
+		return &pb.SetResponse{}, status.Error(codes.InvalidArgument, "linearizable keys cannot be written locally")
+	}
+	value, err := proto.Marshal(req.Value)
+	if err != nil {
+		return &pb.SetResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	leader, err := s.raftLeader(req.Forwarded)
+	if err != nil {
+		return &pb.SetResponse{}, err
+	}
+	if leader != nil {
+		fwd := proto.Clone(req).(*pb.SetRequest)
+		fwd.Forwarded = true
+		forwardedRequests.Inc()
+		return leader.Set(ctx, fwd)
+	}
+	result, err := s.propose(ctx, &pb.RaftCommand{Key: []byte(req.Uuid), Value: value})
+	if err != nil {
+		return &pb.SetResponse{}, err
+	}
+	return &pb.SetResponse{Success: true, ConsistentNodes: int32(s.raft.Size()/2 + 1), Version: result.Version}, nil
+}
+
+// raftCompareAndSet evaluates the condition of a CompareAndSet of a linearizable key when the entry is applied
+func (s *Server) raftCompareAndSet(ctx context.Context, req *pb.CompareAndSetRequest) (*pb.CompareAndSetResponse, error) {
+	value, err := proto.Marshal(req.Value)
+	if err != nil {
+		return &pb.CompareAndSetResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cmd := &pb.RaftCommand{
+		Key:             []byte(req.Uuid),
+		Value:           value,
+		Compare:         true,
+		CreateOnly:      req.CreateOnly,
+		ExpectedVersion: req.ExpectedVersion,
+	}
+	if req.ExpectedValue != nil {
+		cmd.ExpectedValue, err = proto.Marshal(req.ExpectedValue)
+		if err != nil {
+			return &pb.CompareAndSetResponse{}, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	leader, err := s.raftLeader(req.Forwarded)
+	if err != nil {
+		return &pb.CompareAndSetResponse{}, err
+	}
+	if leader != nil {
+		fwd := proto.Clone(req).(*pb.CompareAndSetRequest)
+		fwd.Forwarded = true
+		forwardedRequests.Inc()
+		return leader.CompareAndSet(ctx, fwd)
+	}
+	result, err := s.propose(ctx, cmd)
+	if err != nil {
+		return &pb.CompareAndSetResponse{}, err
+	}
+	resp := &pb.CompareAndSetResponse{Found: result.Found, Version: result.Version}
+	if result.Swapped {
+		resp.Swapped = true
+		resp.Success = true
+		resp.ConsistentNodes = int32(s.raft.Size()/2 + 1)
+		return resp, nil
+	}
+	if result.Found {
+		any := &anypb.Any{}
+		if err := proto.Unmarshal(result.Value, any); err != nil {
+			return &pb.CompareAndSetResponse{}, status.Error(codes.Internal, err.Error())
+		}
+		resp.CurrentValue = any
+	}
+	return resp, nil
+}
+
+// raftLeader returns the client of the leader when this node is not the leader. A request forwarded
+// by another node is not forwarded again, the leader changed meanwhile and the client has to retry.
+func (s *Server) raftLeader(forwarded bool) (pb.CacheServiceClient, error) {
+	if s.raft.Role() == raft.Leader {
+		return nil, nil
+	}
+	leader := s.raft.Leader()
+	switch {
+	case leader == "":
+		return nil, unavailable("NO_LEADER", raft.ErrNoLeader.Error())
+	case forwarded:
+		return nil, unavailable("NOT_LEADER", raft.ErrNotLeader.Error())
+	}
+	for _, peer := range s.GetPeers() {
+		if peer.Address != leader {
+			continue
+		}
+		peer.RLock()
+		client := peer.ServiceClient
+		peer.RUnlock()
+		if client != nil {
+			return client, nil
+		}
+	}
+	return nil, unavailable("LEADER_NOT_CONNECTED", fmt.Sprintf("raft leader %s is not a connected peer", leader))
+}
+
+// propose appends the command to the Raft log and returns the result of applying it
+func (s *Server) propose(ctx context.Context, cmd *pb.RaftCommand) (*cache.CASResult, error) {
+	cmd.Version = time.Now().UnixNano()
+	data, err := proto.Marshal(cmd)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	result, err := s.raft.Propose(ctx, data)
+	if err != nil {
+		return nil, raftStatus(err)
+	}
+	return result.(*cache.CASResult), nil
+}
+
+// raftRead waits until this node applied every write of the linearizable keys acknowledged before the call
+func (s *Server) raftRead(ctx context.Context) error {
+	return raftStatus(s.raft.LinearizableRead(ctx))
+}
+
+// raftStatus converts errors of the Raft node to gRPC status errors
+func raftStatus(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrNoLeader), errors.Is(err, raft.ErrStopped):
+		return unavailable("NO_LEADER", err.Error())
+	case errors.Is(err, raft.ErrLost):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return toStatus(err)
+}
+
+// raftStateMachine applies the Raft log to the cache, the index of the last applied entry is kept in a file
+type raftStateMachine struct {
+	s       *Server
+	path    string
+	applied uint64
+}
+
+// RaftStateMachine returns the state machine of the linearizable keys for the Raft node passed to SetRaft,
+// appliedPath keeps the index of the last applied entry so that no entry is applied twice after a restart
+func (s *Server) RaftStateMachine(appliedPath string) (raft.StateMachine, error) {
+	m := &raftStateMachine{s: s, path: appliedPath}
+	data, err := os.ReadFile(appliedPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		m.applied, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Apply stores the value of the command when its condition holds. The version proposed by the leader is used
+// unless it is not newer than the stored one, so every member assigns the same version. The condition and the
+// bump compare against the version the key was last written with by the log, which the cache keeps after the
+// key was flushed to the DB, so the outcome does not depend on whether a member flushed the key already.
+// An entry whose version is already stored was applied before a crash lost the applied index, it is not
+// applied again so the member does not bump the version past the one the other members hold.
+func (m *raftStateMachine) Apply(index uint64, data []byte) (any, error) {
+	cmd := &pb.RaftCommand{}
+	if err := proto.Unmarshal(data, cmd); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	var cond cache.CASCondition
+	if cmd.Compare {
+		cond = cache.CASCondition{Absent: cmd.CreateOnly, Value: cmd.ExpectedValue, Version: cmd.ExpectedVersion}
+	}
+	unlock := m.s.keys.Lock(string(cmd.Key))
+	result, err := m.reapplied(cmd)
+	if result == nil && err == nil {
+		result, err = m.s.c.CompareAndStoreVersion(cmd.Key, cond, cmd.Value, cmd.Version)
+	}
+	unlock()
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return result, m.setApplied(index)
+}
+
+// reapplied returns the stored state of the key when the version of the command is stored already, nil otherwise
+func (m *raftStateMachine) reapplied(cmd *pb.RaftCommand) (*cache.CASResult, error) {
+	if cmd.Version == 0 {
+		return nil, nil
+	}
+	value, version, err := m.s.c.GetVersion(cmd.Key)
+	if status.Code(err) == codes.NotFound || (err == nil && version != cmd.Version) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cache.CASResult{Swapped: true, Found: true, Value: value, Version: version}, nil
+}
+
+func (m *raftStateMachine) Applied() uint64 {
+	return m.applied
+}
+
+func (m *raftStateMachine) setApplied(index uint64) error {
+	if err := writeFileAtomic(m.path, []byte(strconv.FormatUint(index, 10))); err != nil {
+		return err
+	}
+	m.applied = index
+	return nil
+}
+
+// Snapshot returns the linearizable keys with their versions
+func (m *raftStateMachine) Snapshot() ([]byte, error) {
+	m.s.peersMu.RLock()
+	prefixes := m.s.raftPrefixes
+	m.s.peersMu.RUnlock()
+	snapshot := &pb.KeyValue{}
+	for _, prefix := range prefixes {
+		kvs, err := m.s.c.Scan(prefix, db.PrefixEnd(prefix), 0)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Batch = append(snapshot.Batch, kvs...)
+	}
+	return proto.Marshal(snapshot)
+}
+
+// Restore stores the keys of the snapshot, keys already stored with a newer version are kept
+func (m *raftStateMachine) Restore(index uint64, data []byte) error {
+	snapshot := &pb.KeyValue{}
+	if err := proto.Unmarshal(data, snapshot); err != nil {
+		return err
+	}
+	uuids := make([]string, len(snapshot.Batch))
+	for i, kv := range snapshot.Batch {
+		uuids[i] = string(kv.Key)
+	}
+	unlock := m.s.keys.LockAll(uuids)
+	err := m.s.c.StoreBatch(snapshot.Batch)
+	unlock()
+	if err != nil {
+		return err
+	}
+	return m.setApplied(index)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/radek-ryckowski/ssdc/cache"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/radek-ryckowski/ssdc/raft"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// startRaft makes the keys under prefix linearizable with a single member Raft group and waits until it leads
+func startRaft(t *testing.T, s *Server, prefix string) *raft.Node {
+	dir := t.TempDir()
+	machine, err := s.RaftStateMachine(filepath.Join(dir, "applied"))
+	assert.NoError(t, err)
+	node, err := raft.NewNode(raft.Config{
+		ID:              "self",
+		Dir:             filepath.Join(dir, "raft"),
+		StateMachine:    machine,
+		ElectionTimeout: 20 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s.SetRaft(node, []string{prefix})
+	node.Start()
+	t.Cleanup(node.Stop)
+	assert.Eventually(t, func() bool { return node.Role() == raft.Leader }, 5*time.Second, 10*time.Millisecond)
+	return node
+}
+
+func TestRaftLinearizableKeys(t *testing.T) {
+	peer := newFakePeer()
+	s, cleanup := newTestServer(t, peer)
+	defer cleanup()
+	startRaft(t, s, "locked/")
+	ctx := context.Background()
+
+	resp, err := s.Set(ctx, &pb.SetRequest{Uuid: "locked/a", Value: stringValue(t, "v1")})
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.Positive(t, resp.Version)
+	// the Raft log replicates the key, not the quorum fan-out
+	assert.Zero(t, peer.setCount())
+
+	got, err := s.Get(ctx, &pb.GetRequest{Uuid: "locked/a"})
+	assert.NoError(t, err)
+	assert.True(t, got.Found)
+	assert.Equal(t, resp.Version, got.Version)
+	assert.Equal(t, "v1", localString(t, s, "locked/a"))
+
+	cas, err := s.CompareAndSet(ctx, &pb.CompareAndSetRequest{Uuid: "locked/a", Value: stringValue(t, "v2"), ExpectedVersion: resp.Version})
+	assert.NoError(t, err)
+	assert.True(t, cas.Swapped)
+	assert.Greater(t, cas.Version, resp.Version)
+
+	cas, err = s.CompareAndSet(ctx, &pb.CompareAndSetRequest{Uuid: "locked/a", Value: stringValue(t, "v3"), ExpectedVersion: resp.Version})
+	assert.NoError(t, err)
+	assert.False(t, cas.Swapped)
+	assert.True(t, cas.Found)
+	current := &wrapperspb.StringValue{}
+	assert.NoError(t, cas.CurrentValue.UnmarshalTo(current))
+	assert.Equal(t, "v2", current.Value)
+
+	_, err = s.Set(ctx, &pb.SetRequest{Uuid: "locked/a", Value: stringValue(t, "v4"), Local: true})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = s.BatchSet(ctx, &pb.BatchSetRequest{Entries: []*pb.BatchSetEntry{{Uuid: "locked/b", Value: stringValue(t, "v1")}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// other keys keep using quorum replication
+	_, err = s.Set(ctx, &pb.SetRequest{Uuid: "free", Value: stringValue(t, "v1")})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return peer.setCount() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRaftStateMachineRemembersAppliedIndex(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	path := filepath.Join(t.TempDir(), "applied")
+	machine, err := s.RaftStateMachine(path)
+	assert.NoError(t, err)
+	assert.Zero(t, machine.Applied())
+
+	cmd, err := proto.Marshal(&pb.RaftCommand{Key: []byte("k"), Value: []byte("v"), Version: 10})
+	assert.NoError(t, err)
+	_, err = machine.Apply(7, cmd)
+	assert.NoError(t, err)
+
+	machine, err = s.RaftStateMachine(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), machine.Applied())
+
+	// an entry applied before a crash lost the applied index keeps the version it was stored with
+	cmd, err = proto.Marshal(&pb.RaftCommand{Key: []byte("k"), Value: []byte("w"), Compare: true, ExpectedVersion: 10, Version: 20})
+	assert.NoError(t, err)
+	_, err = machine.Apply(8, cmd)
+	assert.NoError(t, err)
+	result, err := machine.Apply(8, cmd)
+	assert.NoError(t, err)
+	assert.True(t, result.(*cache.CASResult).Swapped)
+	value, version, err := s.c.GetVersion([]byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, "w", string(value))
+	assert.Equal(t, int64(20), version)
+	assert.Equal(t, uint64(8), machine.Applied())
+
+	cmd, err = proto.Marshal(&pb.RaftCommand{Key: []byte("k"), Value: []byte("x"), Version: 30})
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = machine.Apply(9, cmd)
+		assert.NoError(t, err)
+	}
+	_, version, err = s.c.GetVersion([]byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), version)
+}
+
+func TestRaftReadsOfLinearizableRanges(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	node := startRaft(t, s, "locked/")
+	assert.True(t, s.linearizableRange("", ""))
+	assert.True(t, s.linearizableRange("locked/a", "locked/b"))
+	assert.True(t, s.linearizableRange("a", "m"))
+	assert.False(t, s.linearizableRange("free/", "free0"))
+	assert.False(t, s.linearizableRange("m", ""))
+
+	// without a leader the linearizable keys cannot be read, the other keys can
+	node.Stop()
+	_, err := s.BatchGet(context.Background(), &pb.BatchGetRequest{Uuids: []string{"free", "locked/a"}})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = s.BatchGet(context.Background(), &pb.BatchGetRequest{Uuids: []string{"free"}, Local: true})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	readRepairs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "read_repairs_total",
+		Help: "Total number of replicas repaired after a read found them stale or missing the key",
+	})
+
+	readRepairErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "read_repair_errors_total",
+		Help: "Total number of read repairs which failed",
+	})
+)
+
+// newestReply returns the found reply with the highest version, nil when no replica has the key
+func newestReply(replies []getResult) *pb.GetResponse {
+	var newest *pb.GetResponse
+	for _, reply := range replies {
+		if !reply.resp.Found || reply.resp.Value == nil {
+			continue
+		}
+		if newest == nil || reply.resp.Version > newest.Version {
+			newest = reply.resp
+		}
+	}
+	return newest
+}
+
+// sameValue tells whether two replicas hold byte-equal values, whatever versions they report
+func sameValue(a, b *pb.GetResponse) bool {
+	return a.Value.GetTypeUrl() == b.Value.GetTypeUrl() && bytes.Equal(a.Value.GetValue(), b.Value.GetValue())
+}
+
+// readRepair collects the replies still pending after Get returned and writes the newest value
+// to every replica which answered with an older version or without the key. Replicas holding the
+// same value are left alone. Values without a version were written before versions were kept, they
+// cannot be ordered and are neither used to repair nor repaired.
+func (s *Server) readRepair(ctx context.Context, uuid string, active []*cluster.CacheClient, replies []getResult, ch <-chan getResult, pending int) {
+wait:
+	for ; pending > 0; pending-- {
+		select {
+		case result := <-ch:
+			if result.err != nil {
+				if result.peer >= 0 {
+					peerFailed(active[result.peer], result.err)
+				}
+				continue
+			}
+			replies = append(replies, result)
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	newest := newestReply(replies)
+	if newest == nil || newest.Version == 0 {
+		return
+	}
+	for _, reply := range replies {
+		if reply.resp.Found && (reply.resp.Version >= newest.Version || reply.resp.Version == 0 || sameValue(reply.resp, newest)) {
+			continue
+		}
+		readRepairs.Inc()
+		if reply.peer < 0 {
+			value, err := proto.Marshal(newest.Value)
+			if err == nil {
+				_, err = s.c.StoreVersion([]byte(uuid), value, newest.Version)
+			}
+			if err != nil {
+				readRepairErrors.Inc()
+			}
+			continue
+		}
+		peer := active[reply.peer]
+		repairCtx, cancel := context.WithTimeout(context.Background(), GetTimeout)
+		_, err := peer.ServiceClient.Set(repairCtx, &pb.SetRequest{Uuid: uuid, Value: newest.Value, Local: true, Version: newest.Version})
+		cancel()
+		if err != nil {
+			readRepairErrors.Inc()
+			peerFailed(peer, err)
+		}
+	}
+}
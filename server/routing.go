@@ -0,0 +1,155 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var forwardedRequests = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "forwarded_requests_total",
+	Help: "Total number of requests forwarded to a replica of the key",
+})
+
+// SetReplication partitions the keys over the nodes with a consistent-hash ring with vnodes virtual
+// nodes per member, every key is stored on factor nodes. self is the address the peers know this node by.
+// factor <= 0 or not smaller than the number of nodes stores every key on every node.
+func (s *Server) SetReplication(self string, factor, vnodes int) {
+	s.peersMu.Lock()
+	defer s.peersMu.Unlock()
+	s.self = self
+	s.replicationFactor = factor
+	s.vnodes = vnodes
+	s.buildRing()
+}
+
+// buildRing places this node and its peers on a new ring, it must be called with peersMu held
+func (s *Server) buildRing() {
+	if s.self == "" {
+		return
+	}
+	ring := cluster.NewRing(s.vnodes)
+	ring.Add(s.self)
+	for _, peer := range s.peers {
+		ring.Add(peer.Address)
+	}
+	s.ring = ring
+}
+
+// replicas returns the peers holding the key and whether this node holds it too,
+// without partitioning every node holds every key
+func (s *Server) replicas(key string) ([]*cluster.CacheClient, bool) {
+	s.peersMu.RLock()
+	all, ring := s.peers, s.ring
+	s.peersMu.RUnlock()
+	if ring == nil || s.replicationFactor <= 0 || s.replicationFactor > len(all) {
+		return all, true
+	}
+	peers := []*cluster.CacheClient{}
+	owner := false
+	for _, address := range ring.Replicas(key, s.replicationFactor) {
+		if address == s.self {
+			owner = true
+			continue
+		}
+		for _, peer := range all {
+			if peer.Address == address {
+				peers = append(peers, peer)
+				break
+			}
+		}
+	}
+	return peers, owner
+}
+
+// firstReplica reports whether this node is the first replica of the key, without partitioning
+// every node is
+func (s *Server) firstReplica(key string) bool {
+	s.peersMu.RLock()
+	ring, factor, self := s.ring, s.replicationFactor, s.self
+	s.peersMu.RUnlock()
+	if ring == nil || factor <= 0 {
+		return true
+	}
+	replicas := ring.Replicas(key, 1)
+	return len(replicas) == 0 || replicas[0] == self
+}
+
+// replicaGroup is a set of keys of a batch held by the same nodes, indexes point into the batch
+type replicaGroup struct {
+	peers   []*cluster.CacheClient
+	owner   bool
+	indexes []int
+}
+
+// groupByReplicas groups the keys of a batch by the nodes holding them, without partitioning all keys
+// form one group held by every node
+func (s *Server) groupByReplicas(keys []string) []*replicaGroup {
+	groups := []*replicaGroup{}
+	byNodes := map[string]*replicaGroup{}
+	for i, key := range keys {
+		peers, owner := s.replicas(key)
+		nodes := make([]string, 0, len(peers)+1)
+		for _, peer := range peers {
+			nodes = append(nodes, peer.Address)
+		}
+		if owner {
+			nodes = append(nodes, s.self)
+		}
+		slices.Sort(nodes)
+		id := strings.Join(nodes, ",")
+		group, ok := byNodes[id]
+		if !ok {
+			group = &replicaGroup{peers: peers, owner: owner}
+			byNodes[id] = group
+			groups = append(groups, group)
+		}
+		group.indexes = append(group.indexes, i)
+	}
+	return groups
+}
+
+// unreachable reports whether the call did not reach the peer, errors returned by the peer
+// itself, like a missed quorum, are not retried on another replica
+func unreachable(err error) bool {
+	st := status.Convert(err)
+	return (st.Code() == codes.Unavailable || st.Code() == codes.DeadlineExceeded) && len(st.Details()) == 0
+}
+
+// forward passes a request for a key this node does not own to the replicas of the key in ring order
+// and returns the answer of the first one which can be reached, replicas the guard rejects the call to
+// are skipped like unreachable ones
+func forward[T any](replicas []*cluster.CacheClient, call func(client pb.CacheServiceClient) (T, error)) (T, error) {
+	var zero T
+	var failures []*pb.PeerFailure
+	for _, peer := range replicas {
+		peer.RLock()
+		active, client := peer.Active, peer.ServiceClient
+		peer.RUnlock()
+		if !active || client == nil {
+			failures = append(failures, inactivePeer(peer))
+			continue
+		}
+		forwardedRequests.Inc()
+		resp, err := call(client)
+		if err == nil {
+			return resp, nil
+		}
+		rejected := errors.Is(err, cluster.ErrOverloaded) || errors.Is(err, cluster.ErrCircuitOpen)
+		if !rejected && !unreachable(err) {
+			return zero, err
+		}
+		failures = append(failures, peerFailed(peer, err))
+	}
+	return zero, quorumError("no replica of the key is reachable", &pb.QuorumFailure{
+		Required:    1,
+		FailedPeers: failures,
+	})
+}
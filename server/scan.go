@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/radek-ryckowski/ssdc/cluster"
+	"github.com/radek-ryckowski/ssdc/db"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	// DefaultScanLimit is the page size used when ScanRequest.Limit is not set
+	DefaultScanLimit = 1000
+	// MaxScanLimit is the largest page size served by Scan
+	MaxScanLimit = 10000
+	// scanChunkSize is the number of entries sent in one stream message
+	scanChunkSize = 100
+)
+
+// scanRange computes the effective key range [start, end) of a scan request
+func scanRange(req *pb.ScanRequest) (string, string, error) {
+	start, end := req.Start, req.End
+	if req.Prefix != "" {
+		if start < req.Prefix {
+			start = req.Prefix
+		}
+		if prefixEnd := db.PrefixEnd(req.Prefix); prefixEnd != "" && (end == "" || prefixEnd < end) {
+			end = prefixEnd
+		}
+	}
+	if req.ContinuationToken != "" {
+		last, err := base64.RawURLEncoding.DecodeString(req.ContinuationToken)
+		if err != nil {
+			return "", "", status.Error(codes.InvalidArgument, "invalid continuation token")
+		}
+		// the next page starts right after the last returned key
+		if next := string(last) + "\x00"; next > start {
+			start = next
+		}
+	}
+	return start, end, nil
+}
+
+// Scan streams one page of keys matching the prefix and range of the request, a range overlapping the
+// linearizable keys is read once this node applied every write acknowledged before the call. In a partitioned
+// cluster the page is merged from the pages of every node.
+func (s *Server) Scan(req *pb.ScanRequest, stream grpc.ServerStreamingServer[pb.ScanResponse]) error {
+	limit := int(req.Limit)
+	if limit < 0 {
+		return status.Error(codes.InvalidArgument, "negative limit")
+	}
+	if limit == 0 {
+		limit = DefaultScanLimit
+	}
+	if limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+	start, end, err := scanRange(req)
+	if err != nil {
+		return err
+	}
+	if end != "" && start >= end {
+		return stream.Send(&pb.ScanResponse{})
+	}
+	if s.linearizableRange(start, end) {
+		if err := s.raftRead(stream.Context()); err != nil {
+			return err
+		}
+	}
+	// read one key more than the page size to know whether there is a next page
+	kvs, err := s.scanLocal(start, end, limit+1, req.Owner)
+	if err != nil {
+		return toStatus(err)
+	}
+	entries := make([]*pb.ScanEntry, 0, len(kvs))
+	for _, kv := range kvs {
+		entry := &pb.ScanEntry{Uuid: string(kv.Key), Version: kv.Version}
+		if !req.KeysOnly {
+			any := &anypb.Any{}
+			if err := proto.Unmarshal(kv.Value, any); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			entry.Value = any
+		}
+		entries = append(entries, entry)
+	}
+	more := false
+	if !req.Forwarded && s.partitioned() {
+		entries, more, err = s.scanPeers(stream.Context(), req, start, end, limit, entries)
+		if err != nil {
+			return err
+		}
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		more = true
+	}
+	token := ""
+	if more {
+		token = base64.RawURLEncoding.EncodeToString([]byte(entries[len(entries)-1].Uuid))
+	}
+	resp := &pb.ScanResponse{}
+	for i, entry := range entries {
+		resp.Entries = append(resp.Entries, entry)
+		if len(resp.Entries) == scanChunkSize && i != len(entries)-1 {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			resp = &pb.ScanResponse{}
+		}
+	}
+	resp.ContinuationToken = token
+	return stream.Send(resp)
+}
+
+// scanLocal reads up to limit local entries of the range, with an owner in a partitioned cluster only the keys
+// the owner is a replica of. The local keys are then read a page at a time until limit of them matched.
+func (s *Server) scanLocal(start, end string, limit int, owner string) ([]*pb.KeyValue, error) {
+	s.peersMu.RLock()
+	ring, factor, nodes := s.ring, s.replicationFactor, len(s.peers)
+	s.peersMu.RUnlock()
+	if owner == "" || ring == nil || factor <= 0 || factor > nodes {
+		return s.c.Scan(start, end, limit)
+	}
+	owned := []*pb.KeyValue{}
+	for {
+		kvs, err := s.c.Scan(start, end, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			if slices.Contains(ring.Replicas(string(kv.Key), factor), owner) {
+				owned = append(owned, kv)
+				if len(owned) == limit {
+					return owned, nil
+				}
+			}
+		}
+		if len(kvs) < limit {
+			return owned, nil
+		}
+		start = string(kvs[len(kvs)-1].Key) + "\x00"
+	}
+}
+
+// scanPage is the page of one node read by scanPeers, complete is set when the node has no keys after it
+type scanPage struct {
+	entries  []*pb.ScanEntry
+	complete bool
+}
+
+// scanPeers merges the page of the local entries with the pages of every peer of a partitioned cluster, keeping the
+// newest version of keys held by several replicas. Keys after the last key of a node which has more keys are left
+// for the next page, more is set when there is one. The scan fails when every replica of some key may be missing.
+func (s *Server) scanPeers(ctx context.Context, req *pb.ScanRequest, start, end string, limit int, local []*pb.ScanEntry) ([]*pb.ScanEntry, bool, error) {
+	s.peersMu.RLock()
+	peers, factor := s.peers, s.replicationFactor
+	s.peersMu.RUnlock()
+	active, failures := activePeers(peers)
+	fwd := &pb.ScanRequest{Start: start, End: end, Limit: int32(limit + 1), KeysOnly: req.KeysOnly, Forwarded: true, Owner: req.Owner}
+	pages := make([]scanPage, len(active)+1)
+	// the local page was read with one key more than the page size
+	pages[0] = scanPage{entries: local, complete: len(local) <= limit}
+	errs := make([]error, len(active))
+	var wg sync.WaitGroup
+	wg.Add(len(active))
+	for i, peer := range active {
+		go func(i int, peer *cluster.CacheClient) {
+			defer wg.Done()
+			pages[i+1], errs[i] = scanPeer(ctx, peer, fwd)
+		}(i, peer)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, peerFailed(active[i], err))
+		}
+	}
+	// every key is kept by factor nodes, it is read as long as one of them answered
+	if len(failures) >= factor {
+		return nil, false, quorumError("not enough nodes answered the scan", &pb.QuorumFailure{
+			Required:    int32(len(peers) + 2 - factor),
+			Achieved:    int32(len(peers) + 1 - len(failures)),
+			FailedPeers: failures,
+		})
+	}
+	newest := map[string]*pb.ScanEntry{}
+	bound, bounded := "", false
+	for _, page := range pages {
+		for _, entry := range page.entries {
+			if current, ok := newest[entry.Uuid]; !ok || entry.Version > current.Version {
+				newest[entry.Uuid] = entry
+			}
+		}
+		if !page.complete && len(page.entries) != 0 {
+			last := page.entries[len(page.entries)-1].Uuid
+			if !bounded || last < bound {
+				bound, bounded = last, true
+			}
+		}
+	}
+	entries := make([]*pb.ScanEntry, 0, len(newest))
+	for uuid, entry := range newest {
+		if !bounded || uuid <= bound {
+			entries = append(entries, entry)
+		}
+	}
+	slices.SortFunc(entries, func(a, b *pb.ScanEntry) int {
+		return strings.Compare(a.Uuid, b.Uuid)
+	})
+	return entries, bounded, nil
+}
+
+// scanPeer reads the page of the peer's own keys
+func scanPeer(ctx context.Context, peer *cluster.CacheClient, req *pb.ScanRequest) (scanPage, error) {
+	stream, err := peer.ServiceClient.Scan(ctx, req)
+	if err != nil {
+		return scanPage{}, err
+	}
+	page := scanPage{}
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return page, nil
+		}
+		if err != nil {
+			return scanPage{}, err
+		}
+		page.entries = append(page.entries, resp.Entries...)
+		page.complete = resp.ContinuationToken == ""
+	}
+}
@@ -2,9 +2,8 @@ package server
 
 import (
 	"context"
-	"crypto/rand"
 	"log"
-	"math/big"
+	"slices"
 	"sync"
 	"time"
 
@@ -13,8 +12,11 @@ import (
 	"github.com/radek-ryckowski/ssdc/cache"
 	"github.com/radek-ryckowski/ssdc/cluster"
 	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/radek-ryckowski/ssdc/raft"
 	synclog "github.com/radek-ryckowski/ssdc/sync"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
@@ -23,10 +25,15 @@ import (
 const GetTimeout = 5 * time.Second
 
 var (
-	nodeErrors = promauto.NewCounter(prometheus.CounterOpts{
+	nodeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "node_errors_total",
 		Help: "Total number of connection errors hits",
-	})
+	}, []string{"peer"})
+
+	rejectedCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "peer_rejected_calls_total",
+		Help: "Total number of calls to the peer rejected without calling it, by reason",
+	}, []string{"peer", "reason"})
 
 	slogErrors = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "slog_errors_total",
@@ -36,158 +43,464 @@ var (
 
 type Server struct {
 	pb.UnimplementedCacheServiceServer
-	mu    sync.Mutex
-	c     *cache.Cache
-	peers []*cluster.CacheClient
-	slog  *synclog.Updater
+	// keys orders writes of the same key, writes of different keys are replicated concurrently
+	keys keyLocks
+	c    *cache.Cache
+	slog *synclog.Updater
+	// peersMu guards peers and ring, both are replaced rather than modified in place
+	peersMu sync.RWMutex
+	peers   []*cluster.CacheClient
+	// membershipFile persists the peers when set
+	membershipFile string
+	// readReplicas is the number of nodes which have to answer Get, 0 means a majority
+	readReplicas int
+	// self, ring and replicationFactor partition the keys over the nodes, see SetReplication
+	self              string
+	ring              *cluster.Ring
+	replicationFactor int
+	vnodes            int
+	// health reports this node to its peers, healthInterval and healthTimeout drive the checks of the peers
+	health         *health.Server
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	// id is the persistent node id of this node, see SetNodeID
+	id string
+	// antiEntropy reconciles the data with the peers in the background, see SetAntiEntropy
+	antiEntropy AntiEntropyConfig
+	// trees caches the Merkle trees of the keys shared with the peers, see sharedTree
+	treesMu sync.Mutex
+	trees   map[string]*cachedTree
+	// raft orders the writes of the keys starting with one of raftPrefixes, see SetRaft
+	raft         *raft.Node
+	raftPrefixes []string
 }
 
 func (s *Server) Start() {
 	go s.c.WaitForSignal()
 	go s.c.Tick()
 
-	ticker := time.NewTicker(10 * time.Second)
-	go func() {
-		for range ticker.C {
-			for _, peer := range s.peers {
-				peer.RLock()
-				if !peer.Active {
-					peer.RUnlock()
-					peer.Lock()
-					if peer.Conn != nil {
-						peer.Conn.Close()
-					}
-					if peer.ServiceClient != nil {
-						peer.ServiceClient = nil
-					}
-					err := peer.Init()
-					if err != nil {
-						nodeErrors.Inc() //TODO add peer address to the metric as label
-						peer.Unlock()
-						s.slog.UpdatePeer(peer)
-						continue
-					}
-					peer.Unlock()
-				} else {
-					peer.RUnlock()
-					s.slog.UpdatePeer(peer)
-					s.slog.StartSync()
-				}
-			}
-		}
-	}()
-
+	go s.probePeers()
+	s.slog.Start()
+	if s.antiEntropy.Interval > 0 {
+		go s.runAntiEntropy()
+	}
 }
 
 func (s *Server) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if req.Uuid == "" {
+		return &pb.SetResponse{}, status.Error(codes.InvalidArgument, "empty uuid")
+	}
+	if req.Value == nil {
+		return &pb.SetResponse{}, status.Error(codes.InvalidArgument, "missing value")
+	}
+	if s.linearizable(req.Uuid) {
+		return s.raftSet(ctx, req)
+	}
+	peers, owner := s.replicas(req.Uuid)
+	quorum, localOnly, err := s.writeConsistency(req, len(peers))
+	if err != nil {
+		return &pb.SetResponse{}, err
+	}
+	if !owner && !localOnly && !req.Forwarded {
+		fwd := proto.Clone(req).(*pb.SetRequest)
+		fwd.Forwarded = true
+		return forward(peers, func(client pb.CacheServiceClient) (*pb.SetResponse, error) {
+			return client.Set(ctx, fwd)
+		})
+	}
+	unlock := s.keys.Lock(req.Uuid)
+	defer unlock()
 	value, err := proto.Marshal(req.Value)
 	nodeCount := int32(0)
 	if err != nil {
-		return &pb.SetResponse{Success: false}, err
+		return &pb.SetResponse{Success: false}, status.Error(codes.InvalidArgument, err.Error())
 	}
 	// Store the value locally in cache
-	err = s.c.Store([]byte(req.Uuid), value)
+	version := req.Version
+	if req.Local && version != 0 {
+		// write replicated by a peer, it is ignored when a newer version is already stored
+		_, err = s.c.StoreVersion([]byte(req.Uuid), value, version)
+	} else {
+		version, err = s.c.Put([]byte(req.Uuid), value)
+	}
 	if err != nil {
-		return &pb.SetResponse{Success: false}, err
+		return &pb.SetResponse{Success: false}, toStatus(err)
 	}
 	nodeCount++
-	if req.Local {
-		return &pb.SetResponse{Success: true, ConsistentNodes: nodeCount}, nil
+	if localOnly {
+		return &pb.SetResponse{Success: true, ConsistentNodes: nodeCount, Version: version}, nil
 	}
-	rQuorum := int(req.Quorum)
-	quorum := rQuorum
+	successCount, failures := s.replicate(peers, req.Uuid, req.Value, version, quorum)
+	nodeCount += int32(successCount)
+	if successCount < quorum {
+		return &pb.SetResponse{Success: false, ConsistentNodes: nodeCount, Version: version}, quorumError("write quorum not reached", &pb.QuorumFailure{
+			Required:    int32(quorum + 1),
+			Achieved:    nodeCount,
+			FailedPeers: failures,
+		})
+	}
+	return &pb.SetResponse{Success: true, ConsistentNodes: nodeCount, Version: version}, nil
+}
+
+// writeQuorum returns the number of the given replica peers which have to acknowledge a write with the legacy
+// quorum, values below 2 mean half of the peers and values above the number of peers all of them
+func writeQuorum(requested int32, peers int) int {
+	quorum := int(requested)
 	if quorum < 2 {
-		quorum = len(s.peers) / 2 // local +1
+		quorum = peers / 2 // local +1
 	}
-	var successCount int
-	var wg sync.WaitGroup
-	wg.Add(len(s.peers)) // wait only for quorum number of peers to respond with success
-	for _, peer := range s.peers {
+	return min(quorum, peers)
+}
+
+// replicate sends the write to the peers and returns as soon as required peers stored it, or once
+// it is clear they cannot. It returns the number of peers which acknowledged the write so far and the
+// failures seen so far. Replications still running continue in the background, inactive peers are not
+// called and peers which fail or are skipped get a hint in the sync log.
+func (s *Server) replicate(peers []*cluster.CacheClient, uuid string, value *anypb.Any, version int64, required int) (int, []*pb.PeerFailure) {
+	// a nil failure is an acknowledgement, the channel is buffered so late replies never block
+	ch := make(chan *pb.PeerFailure, len(peers))
+	for _, peer := range peers {
 		go func(peer *cluster.CacheClient) {
+			peer.RLock()
+			active, node := peer.Active, peer.ID()
+			peer.RUnlock()
+			if !active {
+				// a peer failing its health checks is not waited for
+				s.addHint(uuid, node, value, version)
+				ch <- inactivePeer(peer)
+				return
+			}
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
-			defer wg.Done()
-			resp, err := peer.ServiceClient.Set(ctx, &pb.SetRequest{Uuid: req.Uuid, Value: req.Value, Local: true})
+			resp, err := peer.ServiceClient.Set(ctx, &pb.SetRequest{Uuid: uuid, Value: value, Local: true, Version: version})
 			if err != nil {
-				nodeErrors.Inc() //TODO add peer address to the metric as label
-				peer.Lock()
-				nodeId := peer.Node
-				peer.Active = false // mark the peer as inactive
-				peer.Unlock()
-				// key = req.Uuid + random 4 bytes
-				// generate random 4 bytes
-				randomPart := make([]byte, 4)
-				_, err := rand.Read(randomPart)
-				if err != nil {
-					log.Printf("Error generating random key: %v", err)
-					return
-				}
-				err = s.slog.Put(append([]byte(req.Uuid), randomPart...), big.NewInt(int64(nodeId)).Bytes())
-				if err != nil {
-					slogErrors.Inc()
-					log.Printf("Error putting to sync log: %v", err)
-				}
+				failure := peerFailed(peer, err)
+				s.addHint(uuid, node, value, version)
+				ch <- failure
 				return
 			}
-			if resp.Success {
-				successCount++
-				nodeCount++
+			if !resp.Success {
+				ch <- &pb.PeerFailure{Address: peer.Address, Code: int32(codes.Unknown), Message: "write not acknowledged"}
+				return
 			}
+			ch <- nil
 		}(peer)
 	}
-	wg.Wait()
-	if successCount < quorum {
-		return &pb.SetResponse{Success: false, ConsistentNodes: nodeCount}, nil
+	var successCount int
+	var failures []*pb.PeerFailure
+	for successCount < required && len(peers)-len(failures) >= required {
+		if failure := <-ch; failure != nil {
+			failures = append(failures, failure)
+			continue
+		}
+		successCount++
 	}
-	return &pb.SetResponse{Success: true, ConsistentNodes: nodeCount}, nil
+	return successCount, failures
 }
 
-func worker(ctx context.Context, peer *cluster.CacheClient, req *pb.GetRequest, ch chan<- []byte, chNotFound chan<- bool) {
-	resp, err := peer.ServiceClient.Get(ctx, req)
+// CompareAndSet method writes the value only if the current state of the key on this node matches the request,
+// the check reads the DB on a cache miss. A successful write is replicated to the peers like Set.
+func (s *Server) CompareAndSet(ctx context.Context, req *pb.CompareAndSetRequest) (*pb.CompareAndSetResponse, error) {
+	if req.Uuid == "" {
+		return &pb.CompareAndSetResponse{}, status.Error(codes.InvalidArgument, "empty uuid")
+	}
+	if req.Value == nil {
+		return &pb.CompareAndSetResponse{}, status.Error(codes.InvalidArgument, "missing value")
+	}
+	if !req.CreateOnly && req.ExpectedValue == nil && req.ExpectedVersion == 0 {
+		return &pb.CompareAndSetResponse{}, status.Error(codes.InvalidArgument, "no condition given, use Set for unconditional writes")
+	}
+	if s.linearizable(req.Uuid) {
+		return s.raftCompareAndSet(ctx, req)
+	}
+	peers, owner := s.replicas(req.Uuid)
+	if !owner && !req.Forwarded {
+		fwd := proto.Clone(req).(*pb.CompareAndSetRequest)
+		fwd.Forwarded = true
+		return forward(peers, func(client pb.CacheServiceClient) (*pb.CompareAndSetResponse, error) {
+			return client.CompareAndSet(ctx, fwd)
+		})
+	}
+	unlock := s.keys.Lock(req.Uuid)
+	defer unlock()
+	value, err := proto.Marshal(req.Value)
 	if err != nil {
-		nodeErrors.Inc() //TODO add peer address to the metric as label
-		peer.Lock()
-		peer.Active = false // mark the peer as inactive
-		peer.Unlock()
-		return
-	}
-	if !resp.Found {
-		chNotFound <- true
-		return
-	}
-	if resp.Value != nil {
-		buf, err := proto.Marshal(resp.Value)
+		return &pb.CompareAndSetResponse{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cond := cache.CASCondition{Absent: req.CreateOnly, Version: req.ExpectedVersion}
+	if req.ExpectedValue != nil {
+		cond.Value, err = proto.Marshal(req.ExpectedValue)
 		if err != nil {
-			return
+			return &pb.CompareAndSetResponse{}, status.Error(codes.InvalidArgument, err.Error())
 		}
-		if len(buf) != 0 {
-			ch <- buf
+	}
+	result, err := s.c.CompareAndStore([]byte(req.Uuid), cond, value)
+	if err != nil {
+		return &pb.CompareAndSetResponse{}, toStatus(err)
+	}
+	if !result.Swapped {
+		resp := &pb.CompareAndSetResponse{Found: result.Found, Version: result.Version}
+		if result.Found {
+			any := &anypb.Any{}
+			if err := proto.Unmarshal(result.Value, any); err != nil {
+				return &pb.CompareAndSetResponse{}, status.Error(codes.Internal, err.Error())
+			}
+			resp.CurrentValue = any
 		}
+		return resp, nil
+	}
+	quorum := writeQuorum(req.Quorum, len(peers))
+	successCount, failures := s.replicate(peers, req.Uuid, req.Value, result.Version, quorum)
+	resp := &pb.CompareAndSetResponse{
+		Swapped:         true,
+		Success:         successCount >= quorum,
+		ConsistentNodes: int32(successCount + 1),
+		Found:           true,
+		Version:         result.Version,
+	}
+	if !resp.Success {
+		return resp, quorumError("write quorum not reached", &pb.QuorumFailure{
+			Required:    int32(quorum + 1),
+			Achieved:    resp.ConsistentNodes,
+			FailedPeers: failures,
+		})
 	}
+	return resp, nil
 }
 
-func localWorker(c *cache.Cache, req *pb.GetRequest, ch chan<- []byte, chNotFound chan<- bool) {
-	value, err := c.Get([]byte(req.Uuid))
+// SetHintLimits bounds the age and size of the hints kept in the sync log for every peer
+func (s *Server) SetHintLimits(limits synclog.Limits) {
+	s.slog.SetLimits(limits)
+}
+
+// MigrateLegacyHints migrates the hints the sync log holds from before hints carried their value, peers are
+// the addresses the node was started with, in the order their hints were numbered by
+func (s *Server) MigrateLegacyHints(peers []string) error {
+	migrated, err := s.slog.MigrateLegacyHints(peers, s.c.GetVersion)
+	if migrated > 0 {
+		log.Printf("migrated %d legacy hints of the sync log", migrated)
+	}
+	return err
+}
+
+// addHint records in the sync log the write the node missed, it is replayed once the node answers again,
+// node is the id of the peer or its address while the id is unknown
+func (s *Server) addHint(uuid string, node string, value *anypb.Any, version int64) {
+	err := s.slog.AddHint(node, &pb.Hint{Uuid: uuid, Value: value, Version: version, Timestamp: time.Now().UnixNano()})
 	if err != nil {
-		if s, ok := status.FromError(err); ok {
-			switch s.Code() {
-			case codes.NotFound:
-				chNotFound <- true
-			default:
+		slogErrors.Inc()
+		log.Printf("Error putting to sync log: %v", err)
+	}
+}
+
+// BatchSet method stores the entries on the nodes holding them, each node stores its entries as one atomic batch.
+// The entries held by this node are stored locally and replicated in one call per replica peer, the entries held
+// by other nodes are forwarded to them in one sub-batch per set of replicas.
+func (s *Server) BatchSet(ctx context.Context, req *pb.BatchSetRequest) (*pb.BatchSetResponse, error) {
+	kvs := make([]*pb.KeyValue, len(req.Entries))
+	uuids := make([]string, len(req.Entries))
+	for i, entry := range req.Entries {
+		if entry.Uuid == "" {
+			return &pb.BatchSetResponse{}, status.Error(codes.InvalidArgument, "empty uuid in batch")
+		}
+		if entry.Value == nil {
+			return &pb.BatchSetResponse{}, status.Error(codes.InvalidArgument, "missing value in batch")
+		}
+		if s.linearizable(entry.Uuid) {
+			return &pb.BatchSetResponse{}, status.Errorf(codes.InvalidArgument, "linearizable key %s cannot be written in a batch", entry.Uuid)
+		}
+		value, err := proto.Marshal(entry.Value)
+		if err != nil {
+			return &pb.BatchSetResponse{}, status.Error(codes.InvalidArgument, err.Error())
+		}
+		kvs[i] = &pb.KeyValue{Key: []byte(entry.Uuid), Value: value}
+		uuids[i] = entry.Uuid
+		if req.Local {
+			kvs[i].Version = entry.Version
+		}
+	}
+	groups := []*replicaGroup{{owner: true, indexes: make([]int, len(uuids))}}
+	for i := range uuids {
+		groups[0].indexes[i] = i
+	}
+	if !req.Local {
+		groups = s.groupByReplicas(uuids)
+	}
+	results := make([]*pb.BatchSetResult, len(req.Entries))
+	var failures []*pb.PeerFailure
+	var required int32
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	// a forwarded batch is coordinated by its receiver even when the ring changed in between
+	var owned []*replicaGroup
+	for _, group := range groups {
+		if group.owner || req.Forwarded {
+			owned = append(owned, group)
+			continue
+		}
+		wg.Add(1)
+		go func(group *replicaGroup) {
+			defer wg.Done()
+			sub := &pb.BatchSetRequest{Quorum: req.Quorum, Forwarded: true}
+			for _, i := range group.indexes {
+				sub.Entries = append(sub.Entries, req.Entries[i])
+			}
+			resp, err := forward(group.peers, func(client pb.CacheServiceClient) (*pb.BatchSetResponse, error) {
+				return client.BatchSet(ctx, sub)
+			})
+			if err == nil && len(resp.Results) == len(group.indexes) {
+				for j, i := range group.indexes {
+					results[i] = resp.Results[j]
+				}
 				return
 			}
+			failure := &pb.QuorumFailure{Required: 1}
+			if details := status.Convert(err).Details(); len(details) == 1 {
+				if f, ok := details[0].(*pb.QuorumFailure); ok {
+					failure = f
+				}
+			}
+			for _, i := range group.indexes {
+				results[i] = &pb.BatchSetResult{Uuid: req.Entries[i].Uuid}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			required = max(required, failure.Required)
+			failures = append(failures, failure.FailedPeers...)
+		}(group)
+	}
+	ownedRequired, ownedFailures, err := s.batchSetOwned(req, owned, kvs, results)
+	wg.Wait()
+	if err != nil {
+		return &pb.BatchSetResponse{}, err
+	}
+	required = max(required, ownedRequired)
+	failures = append(failures, ownedFailures...)
+	resp := &pb.BatchSetResponse{Success: true, Results: results, ConsistentNodes: 1}
+	var failedKeys []string
+	for i, result := range results {
+		if i == 0 || result.ConsistentNodes < resp.ConsistentNodes {
+			resp.ConsistentNodes = result.ConsistentNodes
+		}
+		if !result.Success {
+			resp.Success = false
+			failedKeys = append(failedKeys, result.Uuid)
 		}
 	}
-	if len(value) != 0 {
-		ch <- value
+	if !resp.Success {
+		return resp, quorumError("write quorum not reached", &pb.QuorumFailure{
+			Required:    required,
+			Achieved:    resp.ConsistentNodes,
+			FailedPeers: failures,
+			FailedKeys:  failedKeys,
+		})
 	}
-	chNotFound <- true
+	return resp, nil
+}
+
+// batchSetOwned stores the entries of the groups held by this node as one atomic batch and replicates them to the
+// other replicas in one call per peer, it fills in the results of the entries. It returns the largest number of
+// nodes required by an entry which failed and the failed peers.
+func (s *Server) batchSetOwned(req *pb.BatchSetRequest, groups []*replicaGroup, kvs []*pb.KeyValue, results []*pb.BatchSetResult) (int32, []*pb.PeerFailure, error) {
+	var uuids []string
+	var batch []*pb.KeyValue
+	// the entries replicated to each peer in the order of the batch and the quorum of every entry
+	peerIndexes := map[*cluster.CacheClient][]int{}
+	var peers []*cluster.CacheClient
+	quorums := map[int]int{}
+	for _, group := range groups {
+		quorum := 0
+		if !req.Local {
+			quorum = writeQuorum(req.Quorum, len(group.peers))
+		}
+		for _, i := range group.indexes {
+			uuids = append(uuids, string(kvs[i].Key))
+			batch = append(batch, kvs[i])
+			quorums[i] = quorum
+		}
+		for _, peer := range group.peers {
+			if _, ok := peerIndexes[peer]; !ok {
+				peers = append(peers, peer)
+			}
+			peerIndexes[peer] = append(peerIndexes[peer], group.indexes...)
+		}
+	}
+	if len(batch) == 0 {
+		return 0, nil, nil
+	}
+	unlock := s.keys.LockAll(uuids)
+	defer unlock()
+	if err := s.c.StoreBatch(batch); err != nil {
+		return 0, nil, toStatus(err)
+	}
+	// every entry is stored locally
+	keyNodes := map[int]int32{}
+	for i := range quorums {
+		keyNodes[i] = 1
+	}
+	var failures []*pb.PeerFailure
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(peers))
+	for _, peer := range peers {
+		go func(peer *cluster.CacheClient, indexes []int) {
+			defer wg.Done()
+			// replicate the versions assigned locally
+			entries := make([]*pb.BatchSetEntry, len(indexes))
+			for j, i := range indexes {
+				entries[j] = &pb.BatchSetEntry{Uuid: req.Entries[i].Uuid, Value: req.Entries[i].Value, Version: kvs[i].Version}
+			}
+			peer.RLock()
+			active, node := peer.Active, peer.ID()
+			peer.RUnlock()
+			var resp *pb.BatchSetResponse
+			failure := inactivePeer(peer)
+			if active {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				var err error
+				resp, err = peer.ServiceClient.BatchSet(ctx, &pb.BatchSetRequest{Entries: entries, Local: true})
+				cancel()
+				failure = nil
+				if err != nil {
+					failure = peerFailed(peer, err)
+				}
+			}
+			if failure != nil {
+				for _, entry := range entries {
+					s.addHint(entry.Uuid, node, entry.Value, entry.Version)
+				}
+				mu.Lock()
+				failures = append(failures, failure)
+				mu.Unlock()
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !resp.Success {
+				failures = append(failures, &pb.PeerFailure{Address: peer.Address, Code: int32(codes.Unknown), Message: "batch not acknowledged"})
+			}
+			for j, result := range resp.Results {
+				if j < len(indexes) && result.Success {
+					keyNodes[indexes[j]]++
+				}
+			}
+		}(peer, peerIndexes[peer])
+	}
+	wg.Wait()
+	var required int32
+	for i, quorum := range quorums {
+		// keyNodes counts the local node, quorum counts peers only
+		success := int(keyNodes[i])-1 >= quorum
+		results[i] = &pb.BatchSetResult{Uuid: req.Entries[i].Uuid, Success: success, ConsistentNodes: keyNodes[i]}
+		if !success {
+			required = max(required, int32(quorum+1))
+		}
+	}
+	return required, failures, nil
 }
 
 func (s *Server) getLocal(key []byte) (*pb.GetResponse, error) {
-	value, err := s.c.Get(key)
+	value, version, err := s.c.GetVersion(key)
 	if err != nil {
 		if s, ok := status.FromError(err); ok {
 			switch s.Code() {
@@ -197,80 +510,374 @@ func (s *Server) getLocal(key []byte) (*pb.GetResponse, error) {
 				return &pb.GetResponse{}, s.Err()
 			}
 		}
-		return &pb.GetResponse{}, err
+		return &pb.GetResponse{}, toStatus(err)
 	}
 	if len(value) != 0 {
 		any := &anypb.Any{}
 		err := proto.Unmarshal(value, any)
 		if err != nil {
-			return &pb.GetResponse{}, err
+			return &pb.GetResponse{}, status.Error(codes.Internal, err.Error())
 		}
-		return &pb.GetResponse{Value: any, Found: true}, nil
+		return &pb.GetResponse{Value: any, Found: true, Version: version}, nil
 	}
 	return &pb.GetResponse{}, nil
 }
 
-// Get method to get a value from the cache local and remote it favours found keys against not found keys
-func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
-	if req.Local {
-		return s.getLocal([]byte(req.Uuid))
-	}
-	numOfActivePeers := []*cluster.CacheClient{}
-	for _, peer := range s.peers {
+// activePeers splits the peers into the active ones and failures describing the inactive ones
+func activePeers(peers []*cluster.CacheClient) ([]*cluster.CacheClient, []*pb.PeerFailure) {
+	active := []*cluster.CacheClient{}
+	var failures []*pb.PeerFailure
+	for _, peer := range peers {
 		peer.RLock()
 		if peer.Active {
-			numOfActivePeers = append(numOfActivePeers, peer)
+			active = append(active, peer)
+		} else {
+			failures = append(failures, inactivePeer(peer))
 		}
 		peer.RUnlock()
 	}
-	ch := make(chan []byte, len(numOfActivePeers)+1)
-	chNotFound := make(chan bool, len(numOfActivePeers)+1)
-	AllNotFound := len(numOfActivePeers) + 1
-	cancelFuncs := make([]context.CancelFunc, len(numOfActivePeers))
-	go localWorker(s.c, req, ch, chNotFound)
-	req.Local = true
-	for i, peer := range numOfActivePeers {
-		ctx, cancel := context.WithTimeout(context.Background(), GetTimeout)
-		cancelFuncs[i] = cancel
-		go worker(ctx, peer, req, ch, chNotFound)
-	}
-	for {
+	return active, failures
+}
+
+// readQuorum returns the number of nodes, this one and the given number of replica peers, which have to answer
+// a read, it is a majority of them unless set with SetReadQuorum
+func (s *Server) readQuorum(peers int) int {
+	nodes := peers + 1
+	switch {
+	case s.readReplicas <= 0:
+		return majority(peers)
+	case s.readReplicas > nodes:
+		return nodes
+	}
+	return s.readReplicas
+}
+
+// SetReadQuorum sets the number of nodes, including this one, which have to answer Get, 0 means a majority
+func (s *Server) SetReadQuorum(r int) {
+	s.readReplicas = r
+}
+
+// getResult is the answer of a replica to Get, peer is -1 for the local node
+type getResult struct {
+	peer int
+	resp *pb.GetResponse
+	err  error
+}
+
+// Get method to get a value from the cache local and remote. It waits for the read quorum of nodes to answer
+// and returns the newest value among them, replicas with stale or missing values are repaired in the background.
+func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	if req.Uuid == "" {
+		return &pb.GetResponse{}, status.Error(codes.InvalidArgument, "empty uuid")
+	}
+	peers, owner := s.replicas(req.Uuid)
+	quorum, localOnly, err := s.readConsistency(req, len(peers))
+	if err != nil {
+		return &pb.GetResponse{}, err
+	}
+	if localOnly {
+		return s.getLocal([]byte(req.Uuid))
+	}
+	if s.linearizable(req.Uuid) {
+		if err := s.raftRead(ctx); err != nil {
+			return &pb.GetResponse{}, err
+		}
+		return s.getLocal([]byte(req.Uuid))
+	}
+	if !owner && !req.Forwarded {
+		fwd := proto.Clone(req).(*pb.GetRequest)
+		fwd.Forwarded = true
+		return forward(peers, func(client pb.CacheServiceClient) (*pb.GetResponse, error) {
+			return client.Get(ctx, fwd)
+		})
+	}
+	active, failures := activePeers(peers)
+	// peer calls outlive the request so that the late replies can be used for read repair
+	peerCtx, cancel := context.WithTimeout(context.Background(), GetTimeout)
+	ch := make(chan getResult, len(active)+1)
+	go func() {
+		resp, err := s.getLocal([]byte(req.Uuid))
+		ch <- getResult{peer: -1, resp: resp, err: err}
+	}()
+	peerReq := &pb.GetRequest{Uuid: req.Uuid, Local: true}
+	for i, peer := range active {
+		go func(i int, peer *cluster.CacheClient) {
+			resp, err := peer.ServiceClient.Get(peerCtx, peerReq)
+			ch <- getResult{peer: i, resp: resp, err: err}
+		}(i, peer)
+	}
+	answered := make([]bool, len(active))
+	replies := []getResult{}
+	pending := len(active) + 1
+	for ; pending > 0 && len(replies) < quorum; pending-- {
 		select {
-		case val := <-ch:
-			for _, cancel := range cancelFuncs {
-				cancel()
+		case result := <-ch:
+			if result.peer >= 0 {
+				answered[result.peer] = true
 			}
-			any := &anypb.Any{}
-			err := proto.Unmarshal(val, any)
+			if result.err != nil {
+				if result.peer < 0 {
+					failures = append(failures, &pb.PeerFailure{Address: "local", Code: int32(status.Code(result.err)), Message: result.err.Error()})
+				} else {
+					failures = append(failures, peerFailed(active[result.peer], result.err))
+				}
+				continue
+			}
+			replies = append(replies, result)
+		case <-peerCtx.Done():
+			cancel()
+			return &pb.GetResponse{}, readTimeout(active, answered, failures, quorum, len(replies))
+		case <-ctx.Done():
+			cancel()
+			return &pb.GetResponse{}, readTimeout(active, answered, failures, quorum, len(replies))
+		}
+	}
+	if len(replies) < quorum {
+		cancel()
+		return &pb.GetResponse{}, quorumError("not enough replicas answered", &pb.QuorumFailure{
+			Required:    int32(quorum),
+			Achieved:    int32(len(replies)),
+			FailedPeers: failures,
+		})
+	}
+	newest := newestReply(replies)
+	go func() {
+		defer cancel()
+		s.readRepair(peerCtx, req.Uuid, active, replies, ch, pending)
+	}()
+	if newest == nil {
+		return &pb.GetResponse{}, nil
+	}
+	return &pb.GetResponse{Value: newest.Value, Found: true, Version: newest.Version}, nil
+}
+
+// readTimeout builds the error of a read which did not reach quorum in time
+func readTimeout(active []*cluster.CacheClient, answered []bool, failures []*pb.PeerFailure, required, achieved int) error {
+	for i, peer := range active {
+		if !answered[i] {
+			failures = append(failures, peerFailed(peer, status.Error(codes.DeadlineExceeded, "no answer in time")))
+		}
+	}
+	return quorumError("read timed out", &pb.QuorumFailure{
+		Required:    int32(required),
+		Achieved:    int32(achieved),
+		FailedPeers: failures,
+		TimedOut:    true,
+	})
+}
+
+func (s *Server) batchGetLocal(uuids []string) (map[string]*anypb.Any, error) {
+	keys := make([][]byte, len(uuids))
+	for i, uuid := range uuids {
+		keys[i] = []byte(uuid)
+	}
+	values, err := s.c.BatchGet(keys)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	found := make(map[string]*anypb.Any, len(values))
+	for k, value := range values {
+		any := &anypb.Any{}
+		if err := proto.Unmarshal(value, any); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		found[k] = any
+	}
+	return found, nil
+}
+
+// BatchGet method to get many values at once from the nodes holding them. The keys held by this node are read
+// locally and the ones not found are requested from their replica peers in one call per peer, the keys held by
+// other nodes are forwarded to them in one sub-batch per set of replicas.
+func (s *Server) BatchGet(ctx context.Context, req *pb.BatchGetRequest) (*pb.BatchGetResponse, error) {
+	if slices.Contains(req.Uuids, "") {
+		return &pb.BatchGetResponse{}, status.Error(codes.InvalidArgument, "empty uuid in batch")
+	}
+	if !req.Local && slices.ContainsFunc(req.Uuids, s.linearizable) {
+		if err := s.raftRead(ctx); err != nil {
+			return &pb.BatchGetResponse{}, err
+		}
+	}
+	uuids := []string{}
+	seen := make(map[string]bool, len(req.Uuids))
+	for _, uuid := range req.Uuids {
+		if !seen[uuid] {
+			seen[uuid] = true
+			uuids = append(uuids, uuid)
+		}
+	}
+	groups := []*replicaGroup{{owner: true}}
+	if !req.Local {
+		groups = s.groupByReplicas(uuids)
+	}
+	for _, group := range groups {
+		if group.indexes == nil {
+			group.indexes = make([]int, len(uuids))
+			for i := range uuids {
+				group.indexes[i] = i
+			}
+		}
+	}
+	found := map[string]*anypb.Any{}
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(groups))
+	for _, group := range groups {
+		go func(group *replicaGroup) {
+			defer wg.Done()
+			keys := make([]string, len(group.indexes))
+			for j, i := range group.indexes {
+				keys[j] = uuids[i]
+			}
+			var values map[string]*anypb.Any
+			var err error
+			// a forwarded batch is read by its receiver even when the ring changed in between
+			if group.owner || req.Forwarded || req.Local {
+				values, err = s.batchGetOwned(ctx, keys, group.peers, req.Local)
+			} else {
+				var resp *pb.BatchGetResponse
+				resp, err = forward(group.peers, func(client pb.CacheServiceClient) (*pb.BatchGetResponse, error) {
+					return client.BatchGet(ctx, &pb.BatchGetRequest{Uuids: keys, Forwarded: true})
+				})
+				if err == nil {
+					values = map[string]*anypb.Any{}
+					for _, r := range resp.Results {
+						if r.Found && r.Value != nil {
+							values[r.Uuid] = r.Value
+						}
+					}
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				return &pb.GetResponse{}, err
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
 			}
-			return &pb.GetResponse{Value: any, Found: true}, nil
-		case <-chNotFound:
-			AllNotFound--
-			if AllNotFound == 0 {
-				return &pb.GetResponse{}, nil
+			for uuid, value := range values {
+				found[uuid] = value
 			}
-		case <-time.After(GetTimeout):
-			// cancel all contexts
-			for _, cancel := range cancelFuncs {
-				cancel()
+		}(group)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return &pb.BatchGetResponse{}, firstErr
+	}
+	results := make([]*pb.BatchGetResult, len(req.Uuids))
+	for i, uuid := range req.Uuids {
+		value, ok := found[uuid]
+		results[i] = &pb.BatchGetResult{Uuid: uuid, Value: value, Found: ok}
+	}
+	return &pb.BatchGetResponse{Results: results}, nil
+}
+
+// batchGetOwned reads the keys held by this node locally, unless local is set the keys not found are requested
+// from their replica peers in one call per peer
+func (s *Server) batchGetOwned(ctx context.Context, keys []string, peers []*cluster.CacheClient, local bool) (map[string]*anypb.Any, error) {
+	found, err := s.batchGetLocal(keys)
+	if err != nil {
+		return nil, err
+	}
+	missing := []string{}
+	wanted := make(map[string]bool, len(keys))
+	for _, uuid := range keys {
+		if _, ok := found[uuid]; !ok {
+			missing = append(missing, uuid)
+			wanted[uuid] = true
+		}
+	}
+	if local || len(missing) == 0 {
+		return found, nil
+	}
+	activePeers, failures := activePeers(peers)
+	remaining := len(missing)
+	// the local node answered for all keys
+	answeredNodes := 1
+	type batchResult struct {
+		peer    int
+		results []*pb.BatchGetResult
+		err     error
+	}
+	ch := make(chan batchResult, len(activePeers))
+	ctx, cancel := context.WithTimeout(ctx, GetTimeout)
+	defer cancel()
+	for i, peer := range activePeers {
+		go func(i int, peer *cluster.CacheClient) {
+			resp, err := peer.ServiceClient.BatchGet(ctx, &pb.BatchGetRequest{Uuids: missing, Local: true})
+			if err != nil {
+				ch <- batchResult{peer: i, err: err}
+				return
+			}
+			ch <- batchResult{peer: i, results: resp.Results}
+		}(i, peer)
+	}
+	answered := make([]bool, len(activePeers))
+	timedOut := false
+wait:
+	for range activePeers {
+		select {
+		case result := <-ch:
+			answered[result.peer] = true
+			if result.err != nil {
+				failures = append(failures, peerFailed(activePeers[result.peer], result.err))
+				continue
+			}
+			answeredNodes++
+			for _, r := range result.results {
+				if _, ok := found[r.Uuid]; !ok && wanted[r.Uuid] && r.Found && r.Value != nil {
+					found[r.Uuid] = r.Value
+					remaining--
+				}
+			}
+			if remaining == 0 {
+				break wait
+			}
+		case <-ctx.Done():
+			timedOut = true
+			for i, peer := range activePeers {
+				if !answered[i] {
+					failures = append(failures, peerFailed(peer, status.Error(codes.DeadlineExceeded, "no answer in time")))
+				}
+			}
+			break wait
+		}
+	}
+	if remaining != 0 && (timedOut || answeredNodes < s.readQuorum(len(peers))) {
+		failedKeys := []string{}
+		for _, uuid := range missing {
+			if _, ok := found[uuid]; !ok {
+				failedKeys = append(failedKeys, uuid)
 			}
-			return &pb.GetResponse{}, nil
 		}
+		return nil, quorumError("keys not found on enough replicas", &pb.QuorumFailure{
+			Required:    int32(s.readQuorum(len(peers))),
+			Achieved:    int32(answeredNodes),
+			FailedPeers: failures,
+			TimedOut:    timedOut,
+			FailedKeys:  failedKeys,
+		})
 	}
+	return found, nil
 }
 
 // SetPerrs sets the peers for the server
 func (s *Server) SetPeers(peers []*cluster.CacheClient) {
+	s.peersMu.Lock()
 	s.peers = peers
-	for _, peer := range s.peers {
+	s.buildRing()
+	s.peersMu.Unlock()
+	for _, peer := range peers {
 		s.slog.UpdatePeer(peer)
 	}
 }
 
 // GetPeers returns the peers for the server
 func (s *Server) GetPeers() []*cluster.CacheClient {
+	s.peersMu.RLock()
+	defer s.peersMu.RUnlock()
 	return s.peers
 }
 
@@ -283,9 +890,13 @@ func New(config *cache.CacheConfig) *Server {
 	if slog == nil {
 		return nil
 	}
-	slog.GetKeyCall = c.Get
+	hs := health.NewServer()
+	hs.SetServingStatus(HealthService, healthpb.HealthCheckResponse_SERVING)
 	return &Server{
-		c:    c,
-		slog: slog,
+		c:              c,
+		slog:           slog,
+		health:         hs,
+		healthInterval: DefaultHealthCheckInterval,
+		healthTimeout:  DefaultHealthCheckTimeout,
 	}
 }
@@ -0,0 +1,746 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/radek-ryckowski/ssdc/breaker"
+	"github.com/radek-ryckowski/ssdc/cache"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	"github.com/radek-ryckowski/ssdc/examples/db"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fakePeer is a CacheServiceClient keeping values in memory, calls not implemented here panic
+type fakePeer struct {
+	pb.CacheServiceClient
+	mu     sync.Mutex
+	values map[string]*pb.GetResponse
+	sets   []*pb.SetRequest
+	cas    []*pb.CompareAndSetRequest
+	err    error
+	// block delays Set until it is closed
+	block chan struct{}
+	// delay simulates the network latency of Set
+	delay time.Duration
+}
+
+func newFakePeer() *fakePeer {
+	return &fakePeer{values: make(map[string]*pb.GetResponse)}
+}
+
+func (f *fakePeer) Get(ctx context.Context, in *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if resp, ok := f.values[in.Uuid]; ok {
+		return resp, nil
+	}
+	return &pb.GetResponse{}, nil
+}
+
+func (f *fakePeer) Set(ctx context.Context, in *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+	if f.block != nil {
+		<-f.block
+	}
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.sets = append(f.sets, in)
+	f.values[in.Uuid] = &pb.GetResponse{Value: in.Value, Found: true, Version: in.Version}
+	return &pb.SetResponse{Success: true, ConsistentNodes: 1, Version: in.Version}, nil
+}
+
+func (f *fakePeer) CompareAndSet(ctx context.Context, in *pb.CompareAndSetRequest, opts ...grpc.CallOption) (*pb.CompareAndSetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.cas = append(f.cas, in)
+	return &pb.CompareAndSetResponse{Swapped: true, Success: true, ConsistentNodes: 2, Found: true, Version: 1}, nil
+}
+
+func (f *fakePeer) BatchSet(ctx context.Context, in *pb.BatchSetRequest, opts ...grpc.CallOption) (*pb.BatchSetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	resp := &pb.BatchSetResponse{Success: true, ConsistentNodes: 1}
+	for _, entry := range in.Entries {
+		f.values[entry.Uuid] = &pb.GetResponse{Value: entry.Value, Found: true, Version: entry.Version}
+		resp.Results = append(resp.Results, &pb.BatchSetResult{Uuid: entry.Uuid, Success: true, ConsistentNodes: 1})
+	}
+	return resp, nil
+}
+
+func (f *fakePeer) setCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sets)
+}
+
+func newTestServer(t testing.TB, peers ...*fakePeer) (*Server, func()) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	tempDir, err := os.MkdirTemp("", "server_test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	config := &cache.CacheConfig{
+		CacheSize:         1000,
+		WalPath:           tempDir,
+		SlogPath:          tempDir + "/slog",
+		TickerDelay:       24 * time.Hour,
+		RoCacheSize:       65536,
+		MaxSizeOfChannel:  8192,
+		WalSegmentSize:    1024 * 1024 * 10,
+		Logger:            logger,
+		DBStorage:         db.NewInMemoryDatabase(),
+		WalMaxWithoutSync: 1,
+	}
+	s := New(config)
+	if s == nil {
+		t.Fatalf("Failed to create server")
+	}
+	clients := make([]*cluster.CacheClient, len(peers))
+	for i, peer := range peers {
+		clients[i] = &cluster.CacheClient{ServiceClient: peer, Node: fmt.Sprintf("node%d", i), Address: fmt.Sprintf("peer%d", i), Active: true}
+	}
+	s.peers = clients
+	return s, func() { os.RemoveAll(tempDir) }
+}
+
+func stringValue(t testing.TB, v string) *anypb.Any {
+	any, err := anypb.New(wrapperspb.String(v))
+	if err != nil {
+		t.Fatalf("Failed to create any: %v", err)
+	}
+	return any
+}
+
+func TestGetReturnsNewestAndRepairs(t *testing.T) {
+	stale, missing, newer := newFakePeer(), newFakePeer(), newFakePeer()
+	s, cleanup := newTestServer(t, stale, missing, newer)
+	defer cleanup()
+	s.SetReadQuorum(4)
+
+	_, err := s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "old"), Local: true})
+	assert.NoError(t, err)
+	_, oldVersion, err := s.c.GetVersion([]byte("key"))
+	assert.NoError(t, err)
+	stale.values["key"] = &pb.GetResponse{Value: stringValue(t, "old"), Found: true, Version: oldVersion}
+	newVersion := oldVersion + 10
+	newer.values["key"] = &pb.GetResponse{Value: stringValue(t, "new"), Found: true, Version: newVersion}
+
+	resp, err := s.Get(context.Background(), &pb.GetRequest{Uuid: "key"})
+	assert.NoError(t, err)
+	assert.True(t, resp.Found)
+	assert.Equal(t, newVersion, resp.Version)
+	value := &wrapperspb.StringValue{}
+	assert.NoError(t, resp.Value.UnmarshalTo(value))
+	assert.Equal(t, "new", value.Value)
+
+	// the local node and both lagging peers are repaired, the newest one is left alone
+	assert.Eventually(t, func() bool {
+		_, version, err := s.c.GetVersion([]byte("key"))
+		return err == nil && version == newVersion && stale.setCount() == 1 && missing.setCount() == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, newer.setCount())
+	assert.Equal(t, newVersion, missing.sets[0].Version)
+}
+
+func TestGetSkipsRepairOfSameValue(t *testing.T) {
+	lagging, legacy, newer := newFakePeer(), newFakePeer(), newFakePeer()
+	s, cleanup := newTestServer(t, lagging, legacy, newer)
+	defer cleanup()
+	s.SetReadQuorum(4)
+
+	newer.values["key"] = &pb.GetResponse{Value: stringValue(t, "value"), Found: true, Version: 20}
+	// the same value under an older version and a value without a version are not repaired
+	lagging.values["key"] = &pb.GetResponse{Value: stringValue(t, "value"), Found: true, Version: 10}
+	legacy.values["key"] = &pb.GetResponse{Value: stringValue(t, "other"), Found: true}
+	repairs := testutil.ToFloat64(readRepairs)
+
+	resp, err := s.Get(context.Background(), &pb.GetRequest{Uuid: "key"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), resp.Version)
+
+	// only the local node, which misses the key, is repaired
+	assert.Eventually(t, func() bool {
+		_, version, err := s.c.GetVersion([]byte("key"))
+		return err == nil && version == 20
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, repairs+1, testutil.ToFloat64(readRepairs))
+	assert.Equal(t, 0, lagging.setCount())
+	assert.Equal(t, 0, legacy.setCount())
+}
+
+func TestGetNotFoundNeedsReadQuorum(t *testing.T) {
+	up, down := newFakePeer(), newFakePeer()
+	down.err = status.Error(codes.Unavailable, "connection refused")
+	s, cleanup := newTestServer(t, up, down)
+	defer cleanup()
+
+	// local and one peer answer, which is a majority of three nodes
+	resp, err := s.Get(context.Background(), &pb.GetRequest{Uuid: "missing"})
+	assert.NoError(t, err)
+	assert.False(t, resp.Found)
+
+	s.SetReadQuorum(3)
+	_, err = s.Get(context.Background(), &pb.GetRequest{Uuid: "missing"})
+	st := status.Convert(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	if assert.Len(t, st.Details(), 1) {
+		failure := st.Details()[0].(*pb.QuorumFailure)
+		assert.Equal(t, int32(3), failure.Required)
+		assert.Equal(t, int32(2), failure.Achieved)
+		assert.Len(t, failure.FailedPeers, 1)
+	}
+}
+
+func TestSetConsistency(t *testing.T) {
+	up, down := newFakePeer(), newFakePeer()
+	down.err = status.Error(codes.Unavailable, "connection refused")
+	s, cleanup := newTestServer(t, up, down)
+	defer cleanup()
+
+	tests := []struct {
+		name       string
+		req        *pb.SetRequest
+		code       codes.Code
+		nodes      int32
+		replicated bool
+	}{
+		{"one", &pb.SetRequest{Consistency: pb.Consistency_ONE}, codes.OK, 1, true},
+		{"quorum", &pb.SetRequest{Consistency: pb.Consistency_QUORUM}, codes.OK, 2, true},
+		{"all", &pb.SetRequest{Consistency: pb.Consistency_ALL}, codes.Unavailable, 0, true},
+		{"local only", &pb.SetRequest{Consistency: pb.Consistency_LOCAL_ONLY}, codes.OK, 1, false},
+		{"legacy", &pb.SetRequest{Quorum: 1}, codes.OK, 2, true},
+		{"legacy local", &pb.SetRequest{Local: true}, codes.OK, 1, false},
+		{"legacy quorum above the peers", &pb.SetRequest{Quorum: 3}, codes.Unavailable, 0, true},
+		{"consistency with quorum", &pb.SetRequest{Consistency: pb.Consistency_ALL, Quorum: 2}, codes.InvalidArgument, 0, false},
+		{"consistency with local", &pb.SetRequest{Consistency: pb.Consistency_ONE, Local: true}, codes.InvalidArgument, 0, false},
+		{"unknown consistency", &pb.SetRequest{Consistency: pb.Consistency(42)}, codes.InvalidArgument, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Uuid = tt.name
+			tt.req.Value = stringValue(t, tt.name)
+			before := up.setCount()
+			resp, err := s.Set(context.Background(), tt.req)
+			assert.Equal(t, tt.code, status.Code(err))
+			if err == nil {
+				assert.Equal(t, tt.nodes, resp.ConsistentNodes)
+			}
+			if tt.replicated {
+				// replication continues in the background once the required acks arrived
+				assert.Eventually(t, func() bool { return up.setCount() > before }, time.Second, time.Millisecond)
+			} else {
+				assert.Equal(t, before, up.setCount())
+			}
+		})
+	}
+}
+
+func TestLegacyQuorumIsClamped(t *testing.T) {
+	peer := newFakePeer()
+	s, cleanup := newTestServer(t, peer)
+	defer cleanup()
+	// a quorum above the number of peers waits for all of them
+	resp, err := s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "value"), Quorum: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), resp.ConsistentNodes)
+}
+
+func TestGetConsistency(t *testing.T) {
+	peer := newFakePeer()
+	s, cleanup := newTestServer(t, peer)
+	defer cleanup()
+	peer.values["key"] = &pb.GetResponse{Value: stringValue(t, "remote"), Found: true, Version: 1}
+
+	resp, err := s.Get(context.Background(), &pb.GetRequest{Uuid: "key", Consistency: pb.Consistency_LOCAL_ONLY})
+	assert.NoError(t, err)
+	assert.False(t, resp.Found)
+
+	resp, err = s.Get(context.Background(), &pb.GetRequest{Uuid: "key", Consistency: pb.Consistency_ALL})
+	assert.NoError(t, err)
+	assert.True(t, resp.Found)
+
+	_, err = s.Get(context.Background(), &pb.GetRequest{Uuid: "key", Consistency: pb.Consistency_QUORUM, Local: true})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestSetReturnsOnQuorum(t *testing.T) {
+	fast, slow, failing := newFakePeer(), newFakePeer(), newFakePeer()
+	slow.block = make(chan struct{})
+	failing.block = make(chan struct{})
+	failing.err = status.Error(codes.Unavailable, "connection refused")
+	s, cleanup := newTestServer(t, fast, slow, failing)
+	defer cleanup()
+
+	// two peers are needed for a majority of four nodes, the fast peer alone is not enough
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "value"), Consistency: pb.Consistency_QUORUM})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Set returned before quorum: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(slow.block)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Set did not return after quorum was reached")
+	}
+
+	// the failing peer answers after Set returned, its failure is recorded in the background without
+	// taking it out of rotation, only failed health checks do
+	errors := testutil.ToFloat64(nodeErrors.WithLabelValues("node2"))
+	close(failing.block)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(nodeErrors.WithLabelValues("node2")) == errors+1
+	}, time.Second, time.Millisecond)
+	s.peers[2].RLock()
+	assert.True(t, s.peers[2].Active)
+	s.peers[2].RUnlock()
+	assert.Equal(t, 1, fast.setCount())
+	assert.Equal(t, 1, slow.setCount())
+}
+
+func TestSetSkipsInactivePeers(t *testing.T) {
+	up, down := newFakePeer(), newFakePeer()
+	// a peer failing its health checks may hang, it is not called at all
+	down.block = make(chan struct{})
+	defer close(down.block)
+	s, cleanup := newTestServer(t, up, down)
+	defer cleanup()
+	s.peers[1].Active = false
+
+	resp, err := s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "value"), Quorum: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), resp.ConsistentNodes)
+
+	_, err = s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "value"), Consistency: pb.Consistency_ALL})
+	st := status.Convert(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	assert.Zero(t, down.setCount())
+}
+
+func TestHintReplaysExactWrite(t *testing.T) {
+	peer := newFakePeer()
+	peer.err = status.Error(codes.Unavailable, "connection refused")
+	s, cleanup := newTestServer(t, peer)
+	defer cleanup()
+	s.slog.UpdatePeer(s.peers[0])
+
+	resp, err := s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "old"), Consistency: pb.Consistency_ALL})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	missed := resp.Version
+	// the key changes locally before the peer is back, the peer still gets the write it missed
+	_, err = s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "new"), Consistency: pb.Consistency_LOCAL_ONLY})
+	assert.NoError(t, err)
+
+	peer.mu.Lock()
+	peer.err = nil
+	peer.mu.Unlock()
+	s.slog.WalkAndSend()
+	if assert.Equal(t, 1, peer.setCount()) {
+		replayed := peer.sets[0]
+		assert.Equal(t, missed, replayed.Version)
+		assert.True(t, replayed.Local)
+		value := &wrapperspb.StringValue{}
+		assert.NoError(t, replayed.Value.UnmarshalTo(value))
+		assert.Equal(t, "old", value.Value)
+	}
+
+	// a replayed hint is removed from the sync log
+	s.slog.WalkAndSend()
+	assert.Equal(t, 1, peer.setCount())
+}
+
+func TestSetFailsFastWhenQuorumIsImpossible(t *testing.T) {
+	down, slow, failing := newFakePeer(), newFakePeer(), newFakePeer()
+	slow.block = make(chan struct{})
+	defer close(slow.block)
+	failing.err = status.Error(codes.Unavailable, "connection refused")
+	down.err = status.Error(codes.Unavailable, "connection refused")
+	s, cleanup := newTestServer(t, down, slow, failing)
+	defer cleanup()
+
+	// ALL needs every peer, the first failure decides the result without waiting for the slow peer
+	resp, err := s.Set(context.Background(), &pb.SetRequest{Uuid: "key", Value: stringValue(t, "value"), Consistency: pb.Consistency_ALL})
+	st := status.Convert(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	assert.False(t, resp.Success)
+	assert.Equal(t, int32(1), resp.ConsistentNodes)
+}
+
+// errConn answers every unary call with err
+type errConn struct {
+	grpc.ClientConnInterface
+	err error
+}
+
+func (c *errConn) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	return c.err
+}
+
+func TestGuardKeepsPeerAnsweringUnavailable(t *testing.T) {
+	conn := &errConn{}
+	g := cluster.NewGuard(conn, cluster.GuardConfig{Breaker: breaker.Config{FailureThreshold: 1, OpenTimeout: time.Minute}})
+	// errors a working peer answers with itself keep its circuit closed
+	for _, err := range []error{
+		quorumError("quorum not reached", &pb.QuorumFailure{Required: 2, Achieved: 1}),
+		unavailable("NO_LEADER", "raft: no leader"),
+		toStatus(breaker.ErrOpen),
+	} {
+		conn.err = err
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, codes.Unavailable, status.Code(g.Invoke(context.Background(), "/m", nil, nil)))
+		}
+		assert.Equal(t, breaker.Closed, g.State(), "after %v", err)
+	}
+	// a peer which cannot be reached opens it
+	conn.err = status.Error(codes.Unavailable, "connection refused")
+	g.Invoke(context.Background(), "/m", nil, nil)
+	assert.Equal(t, breaker.Open, g.State())
+}
+
+func TestSetRoutesToReplicas(t *testing.T) {
+	peers := []*fakePeer{newFakePeer(), newFakePeer(), newFakePeer()}
+	s, cleanup := newTestServer(t, peers...)
+	defer cleanup()
+	s.SetReplication("self", 2, 0)
+	byAddress := map[string]*fakePeer{}
+	for i, peer := range peers {
+		byAddress[fmt.Sprintf("peer%d", i)] = peer
+	}
+
+	var owned, foreign string
+	for i := 0; owned == "" || foreign == ""; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if _, owner := s.replicas(key); owner {
+			owned = key
+		} else {
+			foreign = key
+		}
+	}
+
+	// a key this node owns is written locally and replicated to the other replica only
+	resp, err := s.Set(context.Background(), &pb.SetRequest{Uuid: owned, Value: stringValue(t, "owned"), Consistency: pb.Consistency_ALL})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), resp.ConsistentNodes)
+	replicas := s.ring.Replicas(owned, 2)
+	for address, peer := range byAddress {
+		_, ok := peer.values[owned]
+		assert.Equal(t, address == replicas[0] || address == replicas[1], ok, "peer %s", address)
+	}
+
+	// a key owned by other nodes is forwarded to its first replica and not stored here
+	first := byAddress[s.ring.Replicas(foreign, 2)[0]]
+	before := first.setCount()
+	_, err = s.Set(context.Background(), &pb.SetRequest{Uuid: foreign, Value: stringValue(t, "foreign")})
+	assert.NoError(t, err)
+	if assert.Equal(t, before+1, first.setCount()) {
+		assert.True(t, first.sets[before].Forwarded)
+		assert.False(t, first.sets[before].Local)
+	}
+	value, err := s.c.Get([]byte(foreign))
+	assert.Error(t, err)
+	assert.Empty(t, value)
+
+	// the first replica is down, the request goes to the second one
+	first.err = status.Error(codes.Unavailable, "connection refused")
+	second := byAddress[s.ring.Replicas(foreign, 2)[1]]
+	before = second.setCount()
+	_, err = s.Set(context.Background(), &pb.SetRequest{Uuid: foreign, Value: stringValue(t, "again")})
+	assert.NoError(t, err)
+	assert.Equal(t, before+1, second.setCount())
+
+	// a replica the guard rejects the call to is skipped like an unreachable one
+	for _, rejected := range []error{cluster.ErrOverloaded, cluster.ErrCircuitOpen} {
+		first.err = rejected
+		before = second.setCount()
+		_, err = s.Set(context.Background(), &pb.SetRequest{Uuid: foreign, Value: stringValue(t, "rejected")})
+		assert.NoError(t, err)
+		assert.Equal(t, before+1, second.setCount())
+	}
+
+	// the rejection is reported when no replica takes the request
+	second.err = cluster.ErrOverloaded
+	_, err = s.Set(context.Background(), &pb.SetRequest{Uuid: foreign, Value: stringValue(t, "rejected")})
+	st := status.Convert(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	if assert.Len(t, st.Details(), 1) {
+		failed := st.Details()[0].(*pb.QuorumFailure).FailedPeers
+		if assert.Len(t, failed, 2) {
+			assert.Equal(t, int32(codes.ResourceExhausted), failed[1].Code)
+		}
+	}
+}
+
+// flush pushes the writes held by the cache of the server to its storage and waits until they are dropped from
+// memory, later reads of the keys miss the cache
+func flush(t *testing.T, s *Server) {
+	switchovers := func() float64 {
+		families, err := prometheus.DefaultGatherer.Gather()
+		assert.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == "wal_switchover_total" {
+				return family.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		return 0
+	}
+	before := switchovers()
+	go s.c.WaitForSignal()
+	assert.NoError(t, s.c.SyncWAL())
+	assert.Eventually(t, func() bool { return switchovers() > before }, time.Second, time.Millisecond)
+}
+
+func TestCompareAndSet(t *testing.T) {
+	peer := newFakePeer()
+	s, cleanup := newTestServer(t, peer)
+	defer cleanup()
+	ctx := context.Background()
+
+	// a swap is replicated with the version it got
+	resp, err := s.CompareAndSet(ctx, &pb.CompareAndSetRequest{Uuid: "key", Value: stringValue(t, "v1"), CreateOnly: true, Quorum: 2})
+	assert.NoError(t, err)
+	assert.True(t, resp.Swapped)
+	assert.True(t, resp.Success)
+	assert.Equal(t, int32(2), resp.ConsistentNodes)
+	if assert.Equal(t, 1, peer.setCount()) {
+		assert.Equal(t, "key", peer.sets[0].Uuid)
+		assert.Equal(t, resp.Version, peer.sets[0].Version)
+		assert.True(t, peer.sets[0].Local)
+	}
+	version := resp.Version
+
+	// the key exists, a create fails and reports the current state
+	resp, err = s.CompareAndSet(ctx, &pb.CompareAndSetRequest{Uuid: "key", Value: stringValue(t, "v2"), CreateOnly: true})
+	assert.NoError(t, err)
+	assert.False(t, resp.Swapped)
+	assert.True(t, resp.Found)
+	assert.Equal(t, version, resp.Version)
+	assert.Equal(t, "v1", unwrapString(t, resp.CurrentValue))
+
+	// a conflict returns the current value and version and is not replicated
+	resp, err = s.CompareAndSet(ctx, &pb.CompareAndSetRequest{Uuid: "key", Value: stringValue(t, "v2"), ExpectedValue: stringValue(t, "other")})
+	assert.NoError(t, err)
+	assert.False(t, resp.Swapped)
+	assert.Equal(t, version, resp.Version)
+	assert.Equal(t, "v1", unwrapString(t, resp.CurrentValue))
+	assert.Equal(t, 1, peer.setCount())
+
+	// the condition is checked against the storage once the key left the cache, with the version it was flushed with
+	flush(t, s)
+	resp, err = s.CompareAndSet(ctx, &pb.CompareAndSetRequest{Uuid: "key", Value: stringValue(t, "v2"), ExpectedVersion: version - 1})
+	assert.NoError(t, err)
+	assert.False(t, resp.Swapped)
+	assert.Equal(t, version, resp.Version)
+	assert.Equal(t, "v1", unwrapString(t, resp.CurrentValue))
+	resp, err = s.CompareAndSet(ctx, &pb.CompareAndSetRequest{Uuid: "key", Value: stringValue(t, "v2"), ExpectedVersion: version})
+	assert.NoError(t, err)
+	assert.True(t, resp.Swapped)
+	assert.Greater(t, resp.Version, version)
+	assert.Equal(t, "v2", localString(t, s, "key"))
+}
+
+func TestCompareAndSetForwardsToOwner(t *testing.T) {
+	peers := []*fakePeer{newFakePeer(), newFakePeer(), newFakePeer()}
+	s, cleanup := newTestServer(t, peers...)
+	defer cleanup()
+	s.SetReplication("self", 2, 0)
+	foreign := ""
+	for i := 0; foreign == ""; i++ {
+		if _, owner := s.replicas(fmt.Sprintf("key%d", i)); !owner {
+			foreign = fmt.Sprintf("key%d", i)
+		}
+	}
+
+	resp, err := s.CompareAndSet(context.Background(), &pb.CompareAndSetRequest{Uuid: foreign, Value: stringValue(t, "value"), CreateOnly: true})
+	assert.NoError(t, err)
+	assert.True(t, resp.Swapped)
+	first := s.ring.Replicas(foreign, 2)[0]
+	for i, peer := range peers {
+		if fmt.Sprintf("peer%d", i) != first {
+			assert.Empty(t, peer.cas)
+			continue
+		}
+		if assert.Len(t, peer.cas, 1) {
+			assert.True(t, peer.cas[0].Forwarded)
+			assert.True(t, peer.cas[0].CreateOnly)
+		}
+	}
+	assert.Equal(t, "", localString(t, s, foreign))
+}
+
+// newTestCluster starts partitioned servers connected to each other, each key is stored on factor of them
+func newTestCluster(t *testing.T, names []string, factor int) map[string]*Server {
+	servers := map[string]*Server{}
+	for _, name := range names {
+		s, cleanup := newTestServer(t)
+		t.Cleanup(cleanup)
+		servers[name] = s
+	}
+	for _, name := range names {
+		peers := []*cluster.CacheClient{}
+		for _, other := range names {
+			if other != name {
+				peers = append(peers, servePeer(t, servers[other], other))
+			}
+		}
+		servers[name].SetPeers(peers)
+		servers[name].SetReplication(name, factor, 0)
+	}
+	return servers
+}
+
+func TestBatchesAndScansFollowTheRing(t *testing.T) {
+	servers := newTestCluster(t, []string{"a", "b", "c"}, 2)
+	s := servers["a"]
+	req := &pb.BatchSetRequest{}
+	uuids := []string{}
+	for i := 0; i < 20; i++ {
+		uuid := fmt.Sprintf("key%02d", i)
+		uuids = append(uuids, uuid)
+		req.Entries = append(req.Entries, &pb.BatchSetEntry{Uuid: uuid, Value: stringValue(t, uuid)})
+	}
+	resp, err := s.BatchSet(context.Background(), req)
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.Equal(t, int32(2), resp.ConsistentNodes)
+
+	// every key is stored on its replicas only
+	for _, uuid := range uuids {
+		replicas := s.ring.Replicas(uuid, 2)
+		for name, server := range servers {
+			stored := localString(t, server, uuid) == uuid
+			assert.Equal(t, slices.Contains(replicas, name), stored, "key %s on %s", uuid, name)
+		}
+	}
+
+	got, err := s.BatchGet(context.Background(), &pb.BatchGetRequest{Uuids: append(uuids, "missing")})
+	assert.NoError(t, err)
+	if assert.Len(t, got.Results, 21) {
+		for i, uuid := range uuids {
+			assert.True(t, got.Results[i].Found, uuid)
+		}
+		assert.False(t, got.Results[20].Found)
+	}
+
+	// the pages are merged from all nodes without duplicates
+	client := servePeer(t, s, "a").ServiceClient
+	scanned := []string{}
+	token := ""
+	for {
+		stream, err := client.Scan(context.Background(), &pb.ScanRequest{Prefix: "key", Limit: 7, ContinuationToken: token, KeysOnly: true})
+		assert.NoError(t, err)
+		token = ""
+		for {
+			page, err := stream.Recv()
+			if err != nil {
+				assert.ErrorIs(t, err, io.EOF)
+				break
+			}
+			for _, entry := range page.Entries {
+				scanned = append(scanned, entry.Uuid)
+			}
+			token = page.ContinuationToken
+		}
+		if token == "" {
+			break
+		}
+	}
+	assert.Equal(t, uuids, scanned)
+
+	// a prefix is watched on every node, each write is streamed once by the first replica of its key
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch, err := client.Watch(ctx, &pb.WatchRequest{Key: "w", Prefix: true})
+	assert.NoError(t, err)
+	resumed, err := client.Watch(ctx, &pb.WatchRequest{Key: "w", Prefix: true, StartRevision: 1})
+	if assert.NoError(t, err) {
+		_, err = resumed.Recv()
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	// the watches start asynchronously on the peers
+	time.Sleep(100 * time.Millisecond)
+	written := map[string]bool{}
+	batch := &pb.BatchSetRequest{}
+	for i := 0; i < 6; i++ {
+		uuid := fmt.Sprintf("w%d", i)
+		written[uuid] = true
+		batch.Entries = append(batch.Entries, &pb.BatchSetEntry{Uuid: uuid, Value: stringValue(t, uuid)})
+	}
+	_, err = servers["b"].BatchSet(context.Background(), batch)
+	assert.NoError(t, err)
+	for range batch.Entries {
+		ev, err := watch.Recv()
+		if !assert.NoError(t, err) {
+			break
+		}
+		assert.True(t, written[ev.Uuid], "unexpected or repeated event of %s", ev.Uuid)
+		delete(written, ev.Uuid)
+	}
+}
+
+func TestMembershipChangesPeers(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.SetReplication("self", 2, 0)
+	connect := func(address string) (*grpc.ClientConn, error) {
+		return grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	s.memberAlive("10.0.0.1:50051", connect)
+	s.memberAlive("10.0.0.2:50051", connect)
+	s.memberAlive("10.0.0.1:50051", connect)
+	assert.Len(t, s.GetPeers(), 2)
+	assert.Equal(t, []string{"10.0.0.1:50051", "10.0.0.2:50051", "self"}, s.ring.Members())
+
+	// a dead member keeps its keys, it only stops being asked until it is alive again
+	s.memberDead("10.0.0.1:50051")
+	assert.False(t, s.peer("10.0.0.1:50051").Active)
+	assert.Equal(t, []string{"10.0.0.1:50051", "10.0.0.2:50051", "self"}, s.ring.Members())
+	s.memberAlive("10.0.0.1:50051", connect)
+	assert.True(t, s.peer("10.0.0.1:50051").Active)
+
+	peer := s.removePeer("10.0.0.1:50051")
+	if assert.NotNil(t, peer) {
+		assert.False(t, peer.Active)
+		assert.Equal(t, connectivity.Shutdown, peer.Conn.GetState())
+	}
+	assert.Len(t, s.GetPeers(), 1)
+	assert.Equal(t, []string{"10.0.0.2:50051", "self"}, s.ring.Members())
+	assert.Nil(t, s.removePeer("10.0.0.1:50051"))
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/radek-ryckowski/ssdc/cache"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	"github.com/radek-ryckowski/ssdc/db"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// Watch streams put events of the watched keys applied on this node, both from clients and from peer replication.
+// Watching linearizable keys starts once this node applied every write of them acknowledged before the call.
+// When the client falls behind or resumes from a revision no longer kept, a RESYNC_REQUIRED event ends the stream.
+// In a partitioned cluster a key is watched on its replicas and a prefix on every node, each key's events are then
+// streamed by its first replica with the revisions of that node, so such a prefix watch cannot resume from one.
+func (s *Server) Watch(req *pb.WatchRequest, stream grpc.ServerStreamingServer[pb.WatchEvent]) error {
+	if req.StartRevision < 0 {
+		return status.Error(codes.InvalidArgument, "negative start revision")
+	}
+	// the watch starts from a state holding every acknowledged write of the linearizable keys
+	linearizable := s.linearizable(req.Key)
+	if req.Prefix {
+		linearizable = s.linearizableRange(req.Key, db.PrefixEnd(req.Key))
+	}
+	if linearizable {
+		if err := s.raftRead(stream.Context()); err != nil {
+			return err
+		}
+	}
+	if !req.Forwarded && s.partitioned() {
+		if req.Prefix {
+			return s.watchAll(req, stream)
+		}
+		if peers, owner := s.replicas(req.Key); !owner {
+			return s.watchReplica(req, peers, stream)
+		}
+	}
+	// a node watching a prefix for another one streams the keys it is the first replica of
+	var filter func(string) bool
+	if req.Forwarded && req.Prefix {
+		filter = s.firstReplica
+	}
+	return s.watchLocal(stream.Context(), req, filter, stream.Send)
+}
+
+// watchLocal streams the events of the watched keys applied on this node which pass the filter, nil passes all
+func (s *Server) watchLocal(ctx context.Context, req *pb.WatchRequest, filter func(string) bool, send func(*pb.WatchEvent) error) error {
+	w := s.c.Watch(req.Key, req.Prefix, req.StartRevision)
+	defer w.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-w.Events:
+			if !ok {
+				if w.ResyncRequired() {
+					return send(&pb.WatchEvent{Type: pb.WatchEvent_RESYNC_REQUIRED, Revision: s.c.Revision()})
+				}
+				return nil
+			}
+			if filter != nil && !filter(ev.Key) {
+				continue
+			}
+			resp := &pb.WatchEvent{Uuid: ev.Key, Revision: ev.Revision}
+			switch ev.Type {
+			case cache.EventPut:
+				resp.Type = pb.WatchEvent_PUT
+				any := &anypb.Any{}
+				if err := proto.Unmarshal(ev.Value, any); err != nil {
+					return status.Error(codes.Internal, err.Error())
+				}
+				resp.Value = any
+			case cache.EventDelete:
+				resp.Type = pb.WatchEvent_DELETE
+			}
+			if err := send(resp); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watchReplica relays the watch of a key held by other nodes from the first of its replicas which accepts it
+func (s *Server) watchReplica(req *pb.WatchRequest, peers []*cluster.CacheClient, stream grpc.ServerStreamingServer[pb.WatchEvent]) error {
+	fwd := proto.Clone(req).(*pb.WatchRequest)
+	fwd.Forwarded = true
+	events, err := forward(peers, func(client pb.CacheServiceClient) (grpc.ServerStreamingClient[pb.WatchEvent], error) {
+		return client.Watch(stream.Context(), fwd)
+	})
+	if err != nil {
+		return err
+	}
+	return relay(events, stream.Send)
+}
+
+// watchAll watches a prefix on every node of a partitioned cluster, each node streams the events of the keys it is
+// the first replica of. The first node to end its watch ends the whole watch, a resync it requires is passed on.
+func (s *Server) watchAll(req *pb.WatchRequest, stream grpc.ServerStreamingServer[pb.WatchEvent]) error {
+	if req.StartRevision != 0 {
+		return status.Error(codes.InvalidArgument, "a prefix watch of a partitioned cluster cannot resume from a revision")
+	}
+	peers := s.GetPeers()
+	active, failures := activePeers(peers)
+	if len(failures) != 0 {
+		return quorumError("the prefix cannot be watched on every node", &pb.QuorumFailure{
+			Required:    int32(len(peers) + 1),
+			Achieved:    int32(len(active) + 1),
+			FailedPeers: failures,
+		})
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	// send serializes the events of all nodes on the stream, nothing is sent once the watch returned
+	var mu sync.Mutex
+	closed := false
+	send := func(ev *pb.WatchEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return context.Canceled
+		}
+		return stream.Send(ev)
+	}
+	fwd := &pb.WatchRequest{Key: req.Key, Prefix: true, Forwarded: true}
+	done := make(chan error, len(active)+1)
+	for _, peer := range active {
+		go func(peer *cluster.CacheClient) {
+			events, err := peer.ServiceClient.Watch(ctx, fwd)
+			if err == nil {
+				err = relay(events, send)
+			}
+			if err != nil && ctx.Err() == nil {
+				err = quorumError("the watch of a node failed", &pb.QuorumFailure{
+					Required:    int32(len(peers) + 1),
+					Achieved:    int32(len(peers)),
+					FailedPeers: []*pb.PeerFailure{peerFailed(peer, err)},
+				})
+			}
+			done <- err
+		}(peer)
+	}
+	go func() {
+		done <- s.watchLocal(ctx, fwd, s.firstReplica, send)
+	}()
+	err := <-done
+	mu.Lock()
+	closed = true
+	mu.Unlock()
+	return err
+}
+
+// relay sends the events received from a peer until the peer ends the watch
+func relay(events grpc.ServerStreamingClient[pb.WatchEvent], send func(*pb.WatchEvent) error) error {
+	for {
+		ev, err := events.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := send(ev); err != nil {
+			return err
+		}
+	}
+}
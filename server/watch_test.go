@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func setString(t *testing.T, s *Server, key, value string) {
+	_, err := s.Set(context.Background(), &pb.SetRequest{Uuid: key, Value: stringValue(t, value)})
+	assert.NoError(t, err)
+}
+
+// recvWatch returns the next event of the watch, nil when the stream ended with an error
+func recvWatch(t *testing.T, stream grpc.ServerStreamingClient[pb.WatchEvent]) *pb.WatchEvent {
+	ev, err := stream.Recv()
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	return ev
+}
+
+func TestWatch(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	client := servePeer(t, s, "a").ServiceClient
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	setString(t, s, "k", "v1")
+	setString(t, s, "p/1", "1")
+	setString(t, s, "other", "x")
+	setString(t, s, "k", "v2")
+
+	// a key is watched from a revision by replaying the history
+	watch, err := client.Watch(ctx, &pb.WatchRequest{Key: "k", StartRevision: 1})
+	assert.NoError(t, err)
+	for i, value := range []string{"v1", "v2"} {
+		if ev := recvWatch(t, watch); ev != nil {
+			assert.Equal(t, pb.WatchEvent_PUT, ev.Type)
+			assert.Equal(t, "k", ev.Uuid)
+			assert.Equal(t, []int64{1, 4}[i], ev.Revision)
+			assert.Equal(t, value, unwrapString(t, ev.Value))
+		}
+	}
+	// new writes follow the replayed ones
+	setString(t, s, "k", "v3")
+	if ev := recvWatch(t, watch); ev != nil {
+		assert.Equal(t, int64(5), ev.Revision)
+		assert.Equal(t, "v3", unwrapString(t, ev.Value))
+	}
+
+	// a prefix watch streams only the keys with the prefix
+	prefix, err := client.Watch(ctx, &pb.WatchRequest{Key: "p/", Prefix: true, StartRevision: 1})
+	assert.NoError(t, err)
+	setString(t, s, "p/2", "2")
+	for i, key := range []string{"p/1", "p/2"} {
+		if ev := recvWatch(t, prefix); ev != nil {
+			assert.Equal(t, key, ev.Uuid)
+			assert.Equal(t, []int64{2, 6}[i], ev.Revision)
+		}
+	}
+
+	// resuming after the last seen revision skips the events seen before
+	resumed, err := client.Watch(ctx, &pb.WatchRequest{Key: "k", StartRevision: 2})
+	assert.NoError(t, err)
+	if ev := recvWatch(t, resumed); ev != nil {
+		assert.Equal(t, int64(4), ev.Revision)
+		assert.Equal(t, "v2", unwrapString(t, ev.Value))
+	}
+
+	// a revision the node does not have requires a resync from the current revision
+	future, err := client.Watch(ctx, &pb.WatchRequest{Key: "k", StartRevision: 100})
+	assert.NoError(t, err)
+	if ev := recvWatch(t, future); ev != nil {
+		assert.Equal(t, pb.WatchEvent_RESYNC_REQUIRED, ev.Type)
+		assert.Equal(t, int64(6), ev.Revision)
+	}
+	_, err = future.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+
+	negative, err := client.Watch(ctx, &pb.WatchRequest{Key: "k", StartRevision: -1})
+	assert.NoError(t, err)
+	_, err = negative.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestWatchForwardsToReplica(t *testing.T) {
+	servers := newTestCluster(t, []string{"a", "b", "c"}, 1)
+	s := servers["a"]
+	key := ""
+	var owner string
+	for i := 0; key == ""; i++ {
+		if peers, local := s.replicas(fmt.Sprintf("key%d", i)); !local {
+			key, owner = fmt.Sprintf("key%d", i), peers[0].Address
+		}
+	}
+	setString(t, s, key, "v")
+	assert.Equal(t, "v", localString(t, servers[owner], key))
+	assert.Zero(t, s.c.Revision())
+
+	// the node which does not hold the key relays the watch of its replica
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch, err := servePeer(t, s, "a").ServiceClient.Watch(ctx, &pb.WatchRequest{Key: key, StartRevision: 1})
+	assert.NoError(t, err)
+	setString(t, s, key, "v2")
+	for i, value := range []string{"v", "v2"} {
+		if ev := recvWatch(t, watch); ev != nil {
+			assert.Equal(t, key, ev.Uuid)
+			assert.Equal(t, int64(i+1), ev.Revision)
+			assert.Equal(t, value, unwrapString(t, ev.Value))
+		}
+	}
+}
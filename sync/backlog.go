@@ -0,0 +1,350 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// evictExpired and evictOverflow are the reasons a hint is evicted for
+	evictExpired  = "expired"
+	evictOverflow = "overflow"
+)
+
+// deadLetterPrefix starts the keys of the evicted hints kept by Limits.DeadLetter, node ids never
+// start with the separator so the walk skips them like the hints of an unknown node
+var deadLetterPrefix = []byte{hintSeparator, 'd', 'e', 'a', 'd', hintSeparator}
+
+var (
+	hintBacklog = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hint_backlog",
+		Help: "Number of hints waiting in the sync log to be replayed to the peer",
+	}, []string{"peer"})
+
+	hintBacklogBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hint_backlog_bytes",
+		Help: "Size of the hints waiting in the sync log to be replayed to the peer",
+	}, []string{"peer"})
+
+	hintOldestAge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hint_oldest_age_seconds",
+		Help: "Age of the oldest hint waiting to be replayed to the peer",
+	}, []string{"peer"})
+
+	hintsReplayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hints_replayed_total",
+		Help: "Total number of hints replayed to the peer",
+	}, []string{"peer"})
+
+	hintsEvicted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hints_evicted_total",
+		Help: "Total number of hints of the peer dropped or dead-lettered before they were replayed, by reason",
+	}, []string{"peer", "reason"})
+
+	hintDeadLetters = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hint_dead_letters",
+		Help: "Number of evicted hints of the peer kept as dead letters in the sync log",
+	}, []string{"peer"})
+
+	hintDeadLetterBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hint_dead_letter_bytes",
+		Help: "Size of the evicted hints of the peer kept as dead letters in the sync log",
+	}, []string{"peer"})
+)
+
+// Limits bounds the hints kept for a node, zero values keep the hints until they are replayed
+type Limits struct {
+	// MaxAge is how long a hint is kept
+	MaxAge time.Duration
+	// MaxNodeBytes bounds the size of the hints of one node, the oldest hints are evicted first
+	MaxNodeBytes int64
+	// DeadLetter keeps the evicted hints under a dead-letter prefix instead of dropping them, see DeadLetters
+	DeadLetter bool
+	// DeadLetterMaxAge is how long a dead letter is kept after its eviction, MaxAge when zero
+	DeadLetterMaxAge time.Duration
+	// DeadLetterMaxNodeBytes bounds the size of the dead letters of one node, the oldest are dropped first,
+	// MaxNodeBytes when zero
+	DeadLetterMaxNodeBytes int64
+}
+
+// deadLetterMaxAge returns the bound of the age of dead letters
+func (l Limits) deadLetterMaxAge() time.Duration {
+	if l.DeadLetterMaxAge > 0 {
+		return l.DeadLetterMaxAge
+	}
+	return l.MaxAge
+}
+
+// deadLetterMaxNodeBytes returns the bound of the size of the dead letters of a node
+func (l Limits) deadLetterMaxNodeBytes() int64 {
+	if l.DeadLetterMaxNodeBytes > 0 {
+		return l.DeadLetterMaxNodeBytes
+	}
+	return l.MaxNodeBytes
+}
+
+// backlog is the number and size of the hints of a node
+type backlog struct {
+	hints int
+	bytes int64
+}
+
+// SetLimits sets the bounds of the hints of every node, the hints already stored are trimmed to the size
+// bound at once and expired by the next Expire
+func (u *Updater) SetLimits(limits Limits) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	u.limits = limits
+	for node := range u.backlogs {
+		u.trim(node)
+	}
+	for node := range u.deadLetters {
+		u.trimDeadLetters(node)
+	}
+}
+
+// Backlog returns the number and size of the hints waiting to be replayed to the node
+func (u *Updater) Backlog(node string) (int, int64) {
+	u.mx.RLock()
+	defer u.mx.RUnlock()
+	if b, ok := u.backlogs[node]; ok {
+		return b.hints, b.bytes
+	}
+	return 0, 0
+}
+
+// DeadLetters returns the evicted hints of the node kept by Limits.DeadLetter in the order they were evicted
+func (u *Updater) DeadLetters(node string) ([]*pb.Hint, error) {
+	iter := u.db.NewIterator(util.BytesPrefix(deadLetterKey(nodePrefix(node))), nil)
+	defer iter.Release()
+	var hints []*pb.Hint
+	for iter.Next() {
+		hint := &pb.Hint{}
+		if err := proto.Unmarshal(iter.Value(), hint); err != nil {
+			return nil, err
+		}
+		hints = append(hints, hint)
+	}
+	return hints, iter.Error()
+}
+
+// PurgeDeadLetters deletes the dead letters of the node, it returns the number of deleted dead letters
+func (u *Updater) PurgeDeadLetters(node string) (int, error) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	iter := u.db.NewIterator(util.BytesPrefix(deadLetterKey(nodePrefix(node))), nil)
+	defer iter.Release()
+	purged := 0
+	for iter.Next() {
+		if !u.removeDeadLetter(iter.Key(), iter.Value()) {
+			return purged, fmt.Errorf("failed to purge dead letter %q", iter.Key())
+		}
+		purged++
+	}
+	return purged, iter.Error()
+}
+
+// DeadLetterBacklog returns the number and size of the dead letters of the node
+func (u *Updater) DeadLetterBacklog(node string) (int, int64) {
+	u.mx.RLock()
+	defer u.mx.RUnlock()
+	if b, ok := u.deadLetters[node]; ok {
+		return b.hints, b.bytes
+	}
+	return 0, 0
+}
+
+// Expire evicts the hints older than Limits.MaxAge, drops the dead letters evicted longer than
+// Limits.DeadLetterMaxAge ago and exports the age of the oldest hint of every node
+func (u *Updater) Expire() {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	now := time.Now()
+	for node := range u.backlogs {
+		iter := u.db.NewIterator(util.BytesPrefix(nodePrefix(node)), nil)
+		for iter.Next() {
+			age := now.Sub(hintTime(iter.Key(), node))
+			if u.limits.MaxAge > 0 && age > u.limits.MaxAge {
+				u.evict(iter.Key(), iter.Value(), evictExpired)
+				continue
+			}
+			hintOldestAge.WithLabelValues(node).Set(age.Seconds())
+			break
+		}
+		iter.Release()
+	}
+	maxAge := u.limits.deadLetterMaxAge()
+	if maxAge <= 0 {
+		return
+	}
+	for node := range u.deadLetters {
+		iter := u.db.NewIterator(util.BytesPrefix(deadLetterKey(nodePrefix(node))), nil)
+		for iter.Next() && now.Sub(hintTime(iter.Key()[len(deadLetterPrefix):], node)) > maxAge {
+			u.removeDeadLetter(iter.Key(), iter.Value())
+		}
+		iter.Release()
+	}
+}
+
+// loadBacklogs counts the hints stored before the updater was opened
+func (u *Updater) loadBacklogs() {
+	iter := u.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if bytes.HasPrefix(iter.Key(), deadLetterPrefix) {
+			if node, ok := hintNode(iter.Key()[len(deadLetterPrefix):]); ok {
+				u.accountDeadLetters(node, 1, int64(len(iter.Value())))
+			}
+			continue
+		}
+		if node, ok := hintNode(iter.Key()); ok {
+			u.account(node, 1, int64(len(iter.Value())))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		log.Printf("sync error counting hints: %v", err)
+	}
+}
+
+// account adds to the backlog of the node, it must be called with mx held
+func (u *Updater) account(node string, hints int, size int64) {
+	b, ok := u.backlogs[node]
+	if !ok {
+		b = &backlog{}
+		u.backlogs[node] = b
+	}
+	b.hints += hints
+	b.bytes += size
+	hintBacklog.WithLabelValues(node).Set(float64(b.hints))
+	hintBacklogBytes.WithLabelValues(node).Set(float64(b.bytes))
+	if b.hints <= 0 {
+		delete(u.backlogs, node)
+		hintOldestAge.WithLabelValues(node).Set(0)
+	}
+}
+
+// accountDeadLetters adds to the dead letters of the node, it must be called with mx held
+func (u *Updater) accountDeadLetters(node string, hints int, size int64) {
+	b, ok := u.deadLetters[node]
+	if !ok {
+		b = &backlog{}
+		u.deadLetters[node] = b
+	}
+	b.hints += hints
+	b.bytes += size
+	hintDeadLetters.WithLabelValues(node).Set(float64(b.hints))
+	hintDeadLetterBytes.WithLabelValues(node).Set(float64(b.bytes))
+	if b.hints <= 0 {
+		delete(u.deadLetters, node)
+	}
+}
+
+// trim evicts the oldest hints of the node while they exceed Limits.MaxNodeBytes, it must be called with mx held
+func (u *Updater) trim(node string) {
+	if u.limits.MaxNodeBytes <= 0 {
+		return
+	}
+	iter := u.db.NewIterator(util.BytesPrefix(nodePrefix(node)), nil)
+	defer iter.Release()
+	for u.backlogs[node] != nil && u.backlogs[node].bytes > u.limits.MaxNodeBytes && iter.Next() {
+		u.evict(iter.Key(), iter.Value(), evictOverflow)
+	}
+}
+
+// trimDeadLetters drops the oldest dead letters of the node while they exceed Limits.DeadLetterMaxNodeBytes,
+// it must be called with mx held
+func (u *Updater) trimDeadLetters(node string) {
+	maxBytes := u.limits.deadLetterMaxNodeBytes()
+	if maxBytes <= 0 {
+		return
+	}
+	iter := u.db.NewIterator(util.BytesPrefix(deadLetterKey(nodePrefix(node))), nil)
+	defer iter.Release()
+	for u.deadLetters[node] != nil && u.deadLetters[node].bytes > maxBytes && iter.Next() {
+		u.removeDeadLetter(iter.Key(), iter.Value())
+	}
+}
+
+// evict removes a hint which cannot be replayed anymore, it must be called with mx held. A dead letter is
+// keyed by the time of the eviction, so its age bound counts from it.
+func (u *Updater) evict(key, value []byte, reason string) {
+	node, _ := hintNode(key)
+	if ok, err := u.db.Has(key, nil); err != nil || !ok {
+		return
+	}
+	if u.limits.DeadLetter {
+		deadKey, err := hintKey(node, time.Now().UnixNano())
+		if err == nil {
+			err = u.db.Put(deadLetterKey(deadKey), value, nil)
+		}
+		if err != nil {
+			log.Printf("sync error dead-lettering hint: %v", err)
+			return
+		}
+		u.accountDeadLetters(node, 1, int64(len(value)))
+		u.trimDeadLetters(node)
+	}
+	if u.remove(key, value) {
+		hintsEvicted.WithLabelValues(node, reason).Inc()
+	}
+}
+
+// removeDeadLetter deletes a dead letter and takes it off the dead letters of its node, it must be called
+// with mx held
+func (u *Updater) removeDeadLetter(key, value []byte) bool {
+	if err := u.db.Delete(key, nil); err != nil {
+		log.Printf("sync error deleting dead letter: %v", err)
+		return false
+	}
+	if node, ok := hintNode(key[len(deadLetterPrefix):]); ok {
+		u.accountDeadLetters(node, -1, -int64(len(value)))
+	}
+	return true
+}
+
+// remove deletes a hint and takes it off the backlog of its node, it returns false when the hint was
+// already removed, e.g. replayed while it was evicted. It must be called with mx held.
+func (u *Updater) remove(key, value []byte) bool {
+	key = bytes.Clone(key)
+	if ok, err := u.db.Has(key, nil); err != nil || !ok {
+		return false
+	}
+	if err := u.db.Delete(key, nil); err != nil {
+		log.Printf("sync error deleting hint: %v", err)
+		return false
+	}
+	if node, ok := hintNode(key); ok {
+		if _, tracked := u.backlogs[node]; tracked {
+			u.account(node, -1, -int64(len(value)))
+		}
+	}
+	return true
+}
+
+// deadLetterKey returns the dead-letter key of a hint key
+func deadLetterKey(key []byte) []byte {
+	return append(bytes.Clone(deadLetterPrefix), key...)
+}
+
+// nodePrefix returns the start of the hint keys of the node
+func nodePrefix(node string) []byte {
+	return append([]byte(node), hintSeparator)
+}
+
+// hintTime returns the time a hint of the node was added at from its key
+func hintTime(key []byte, node string) time.Time {
+	start := len(node) + 1
+	if len(key) < start+8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[start:start+8])))
+}
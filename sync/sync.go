@@ -1,19 +1,31 @@
 package sync
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
-	"math/big"
 	"sync"
 	"time"
 
 	"github.com/radek-ryckowski/ssdc/cluster"
 	pb "github.com/radek-ryckowski/ssdc/proto/cache"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 )
 
+// DefaultSyncInterval is how often the hints are replayed without a peer coming back, a write can
+// fail on a peer which never stops answering its health checks
+const DefaultSyncInterval = 30 * time.Second
+
 // Node struct to store key and nodeID
 type Node struct {
 	Key    string
@@ -21,14 +33,21 @@ type Node struct {
 }
 
 type Updater struct {
-	Path               string // Path to updater database
-	db                 *leveldb.DB
-	mx                 sync.RWMutex
-	startSyncing       chan bool
-	StopTicker         chan bool
-	cacheClients       map[int]*cluster.CacheClient
-	GetKeyCall         func(key []byte) ([]byte, error)
+	Path         string // Path to updater database
+	db           *leveldb.DB
+	mx           sync.RWMutex
+	startSyncing chan bool
+	StopTicker   chan bool
+	// cacheClients holds the peers by node id and by address, hints name the peer by its id when it is known
+	cacheClients       map[string]*cluster.CacheClient
 	walkAndSendRunning bool
+	// SyncInterval is how often Start replays the hints on its own, DefaultSyncInterval by default
+	SyncInterval time.Duration
+	// limits bound the hints of every node, backlogs holds the hints waiting per node and deadLetters the
+	// hints evicted per node, see SetLimits
+	limits      Limits
+	backlogs    map[string]*backlog
+	deadLetters map[string]*backlog
 }
 
 func New(path string) *Updater {
@@ -37,28 +56,41 @@ func New(path string) *Updater {
 		log.Printf("failed to open database: %v", err)
 		return nil
 	}
-	return &Updater{
+	u := &Updater{
 		Path:         path,
 		db:           db,
 		startSyncing: make(chan bool, 1024),
-		cacheClients: make(map[int]*cluster.CacheClient),
+		StopTicker:   make(chan bool),
+		cacheClients: make(map[string]*cluster.CacheClient),
+		SyncInterval: DefaultSyncInterval,
+		backlogs:     make(map[string]*backlog),
+		deadLetters:  make(map[string]*backlog),
 	}
+	u.loadBacklogs()
+	return u
 }
 
 func (u *Updater) Start() {
 	// Start the updater
 	ticker := time.NewTicker(time.Second)
+	lastSync := time.Now()
 	go func() {
 		for range ticker.C {
 			select {
 			case <-u.startSyncing:
+				lastSync = time.Now()
 				u.WalkAndSend()
 			case <-u.StopTicker:
 				ticker.Stop()
 				u.db.Close()
 				return
 			default:
-				// Do nothing
+				if time.Since(lastSync) >= u.SyncInterval {
+					lastSync = time.Now()
+					u.WalkAndSend()
+				} else {
+					u.Expire()
+				}
 			}
 		}
 	}()
@@ -73,13 +105,39 @@ func (u *Updater) StartSync() {
 	u.startSyncing <- true
 }
 
+// UpdatePeer sends the hints for the node id and the address of the peer to it,
+// hints for an id the peer had before are not sent to it anymore
 func (u *Updater) UpdatePeer(node *cluster.CacheClient) {
+	node.RLock()
+	id, address := node.Node, node.Address
+	node.RUnlock()
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	u.forget(node)
+	u.cacheClients[address] = node
+	if id != "" {
+		u.cacheClients[id] = node
+	}
+}
+
+// RemovePeer stops sending hints to the node, its hints stay in the database
+func (u *Updater) RemovePeer(node *cluster.CacheClient) {
 	u.mx.Lock()
 	defer u.mx.Unlock()
-	u.cacheClients[node.Node] = node
+	u.forget(node)
+}
+
+// forget drops the node from cacheClients, it must be called with mx held
+func (u *Updater) forget(node *cluster.CacheClient) {
+	for key, client := range u.cacheClients {
+		if client == node {
+			delete(u.cacheClients, key)
+		}
+	}
 }
 
-// WalkAndSend method to walk through the database and send the data to the peers
+// WalkAndSend method to walk through the database and send the hints to the peers, a peer which
+// is inactive or fails a hint is skipped until the next walk. Expired hints are evicted first.
 func (u *Updater) WalkAndSend() {
 	u.mx.Lock()
 	if u.walkAndSendRunning {
@@ -93,45 +151,59 @@ func (u *Updater) WalkAndSend() {
 		u.walkAndSendRunning = false
 		u.mx.Unlock()
 	}()
+	u.Expire()
 
-	// Walk through the database
+	// Walk through the database, the hints of a node are stored together in the order they were added
 	iter := u.db.NewIterator(nil, nil)
-	for iter.Next() {
-		// remove last 4 bytesfrom the key (random sufix)
-		uuid := iter.Key()[:len(iter.Key())-4]
-		nodeID := int(big.NewInt(0).SetBytes(iter.Value()).Int64())
-		node := u.cacheClients[nodeID]
-		if node != nil {
-			node.RLock()
-			if !node.Active {
-				node.RUnlock()
-				continue
-			}
-			node.RUnlock()
-			value, error := u.GetKeyCall(iter.Key())
-			if error != nil {
-				log.Printf("sync error getting key: %v", error)
-				continue
-			}
-			// Send the data to the peer
-			any := &anypb.Any{}
-			err := proto.Unmarshal(value, any)
-			if err != nil {
-				log.Printf("sync error unmarshaling data: %v", err)
-				continue
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-			ret, err := node.ServiceClient.Set(ctx, &pb.SetRequest{Uuid: string(uuid), Value: any, Local: true})
-			cancel()
-			if err != nil || !ret.Success {
-				log.Printf("sync error sending data to peer: %v", err)
-				continue
+	for ok := iter.First(); ok; {
+		nodeID, found := hintNode(iter.Key())
+		if !found && bytes.HasPrefix(iter.Key(), deadLetterPrefix) {
+			ok = iter.Seek(util.BytesPrefix(deadLetterPrefix).Limit)
+			continue
+		}
+		if !found {
+			// legacy hints wait for MigrateLegacyHints, they cannot be replayed without their value
+			if _, _, legacy := legacyHint(iter.Key(), iter.Value()); !legacy {
+				log.Printf("sync dropping hint %q which cannot be read", iter.Key())
+				u.delete(iter.Key(), iter.Value())
 			}
-			// delete from db
-			u.mx.Lock()
-			u.db.Delete(uuid, nil)
-			u.mx.Unlock()
+			ok = iter.Next()
+			continue
+		}
+		u.mx.RLock()
+		node := u.cacheClients[nodeID]
+		u.mx.RUnlock()
+		if node == nil {
+			ok = skipNode(iter, nodeID)
+			continue
 		}
+		node.RLock()
+		active, client := node.Active, node.ServiceClient
+		node.RUnlock()
+		if !active || client == nil {
+			ok = skipNode(iter, nodeID)
+			continue
+		}
+		hint := &pb.Hint{}
+		if err := proto.Unmarshal(iter.Value(), hint); err != nil || hint.Uuid == "" {
+			log.Printf("sync dropping hint %q which cannot be read: %v", iter.Key(), err)
+			u.delete(iter.Key(), iter.Value())
+			ok = iter.Next()
+			continue
+		}
+		// Send the write to the peer, the version makes it keep a newer value it already has
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ret, err := client.Set(ctx, &pb.SetRequest{Uuid: hint.Uuid, Value: hint.Value, Local: true, Version: hint.Version})
+		cancel()
+		if err != nil || !ret.Success {
+			log.Printf("sync error sending data to peer %s: %v", nodeID, err)
+			ok = skipNode(iter, nodeID)
+			continue
+		}
+		if u.delete(iter.Key(), iter.Value()) {
+			hintsReplayed.WithLabelValues(nodeID).Inc()
+		}
+		ok = iter.Next()
 	}
 	iter.Release()
 	if err := iter.Error(); err != nil {
@@ -139,8 +211,170 @@ func (u *Updater) WalkAndSend() {
 	}
 }
 
-func (u *Updater) Put(key, value []byte) error {
+// AddHint stores a write the node missed, node is the id of the peer or its address while the id is unknown
+func (u *Updater) AddHint(node string, hint *pb.Hint) error {
+	if hint.Timestamp == 0 {
+		hint.Timestamp = time.Now().UnixNano()
+	}
+	value, err := proto.Marshal(hint)
+	if err != nil {
+		return err
+	}
+	key, err := hintKey(node, hint.Timestamp)
+	if err != nil {
+		return err
+	}
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	if err := u.db.Put(key, value, nil); err != nil {
+		return err
+	}
+	u.account(node, 1, int64(len(value)))
+	u.trim(node)
+	return nil
+}
+
+// delete removes a hint unless it was evicted meanwhile, the key is copied as the iterator reuses it
+func (u *Updater) delete(key, value []byte) bool {
 	u.mx.Lock()
 	defer u.mx.Unlock()
-	return u.db.Put(key, value, nil)
+	return u.remove(key, value)
+}
+
+// hintSeparator ends the node id at the start of a hint key
+const hintSeparator = 0
+
+// hintKeySuffix is the size of the timestamp and the random part following the separator
+const hintKeySuffix = 12
+
+// hintKey returns a new key of a hint of the node, key = node + separator + timestamp + random 4 bytes,
+// hints with the same timestamp do not collide
+func hintKey(node string, timestamp int64) ([]byte, error) {
+	key := make([]byte, 0, len(node)+1+hintKeySuffix)
+	key = append(key, node...)
+	key = append(key, hintSeparator)
+	key = binary.BigEndian.AppendUint64(key, uint64(timestamp))
+	randomPart := make([]byte, 4)
+	if _, err := rand.Read(randomPart); err != nil {
+		return nil, err
+	}
+	return append(key, randomPart...), nil
+}
+
+// hintNode returns the node id of a hint key, node ids never contain the separator so the separator is
+// the first one and sits right before the suffix. Dead letters and legacy hints are not hint keys.
+func hintNode(key []byte) (string, bool) {
+	i := len(key) - hintKeySuffix - 1
+	if i < 1 || key[i] != hintSeparator || bytes.IndexByte(key[:i], hintSeparator) >= 0 {
+		return "", false
+	}
+	return string(key[:i]), true
+}
+
+// legacyHintSuffix is the size of the random part ending the keys of legacy hints, which were written
+// before hints carried their value: key = uuid + random 4 bytes, value = number of the node big-endian
+const legacyHintSuffix = 4
+
+// legacyHint returns the uuid and the node number of a legacy hint, the random part may contain any byte
+// so only the uuid is checked for the separator. It must be called for keys which are not hint keys.
+func legacyHint(key, value []byte) (string, int, bool) {
+	if len(key) <= legacyHintSuffix || len(value) > 8 {
+		return "", 0, false
+	}
+	uuid := key[:len(key)-legacyHintSuffix]
+	if bytes.IndexByte(uuid, hintSeparator) >= 0 {
+		return "", 0, false
+	}
+	var node uint64
+	for _, b := range value {
+		node = node<<8 | uint64(b)
+	}
+	return string(uuid), int(node), true
+}
+
+// MigrateLegacyHints turns the legacy hints, which hold only the key and the number of the node, into hints
+// of the current layout. The number is the position of the node in peers, the addresses the node was started
+// with, value and version are read with get. A hint of a key get does not find is dropped, hints which
+// cannot be migrated now are kept for the next call. It returns the number of migrated hints.
+func (u *Updater) MigrateLegacyHints(peers []string, get func(key []byte) ([]byte, int64, error)) (int, error) {
+	type legacy struct {
+		key  []byte
+		uuid string
+		node int
+	}
+	var hints []legacy
+	iter := u.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if _, ok := hintNode(iter.Key()); ok || bytes.HasPrefix(iter.Key(), deadLetterPrefix) {
+			continue
+		}
+		if uuid, node, ok := legacyHint(iter.Key(), iter.Value()); ok {
+			hints = append(hints, legacy{key: bytes.Clone(iter.Key()), uuid: uuid, node: node})
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	migrated := 0
+	var errs []error
+	for _, h := range hints {
+		if h.node >= len(peers) {
+			errs = append(errs, fmt.Errorf("legacy hint of %s names node %d of %d peers", h.uuid, h.node, len(peers)))
+			continue
+		}
+		data, version, err := get([]byte(h.uuid))
+		if status.Code(err) == codes.NotFound {
+			log.Printf("sync dropping legacy hint of %s which is not stored anymore", h.uuid)
+			u.mx.Lock()
+			err = u.db.Delete(h.key, nil)
+			u.mx.Unlock()
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		hint := &pb.Hint{Uuid: h.uuid, Value: &anypb.Any{}, Version: version, Timestamp: time.Now().UnixNano()}
+		if err := proto.Unmarshal(data, hint.Value); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := u.migrate(h.key, peers[h.node], hint); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		migrated++
+	}
+	return migrated, errors.Join(errs...)
+}
+
+// migrate replaces the legacy hint stored under key with the hint of the node in one write
+func (u *Updater) migrate(key []byte, node string, hint *pb.Hint) error {
+	value, err := proto.Marshal(hint)
+	if err != nil {
+		return err
+	}
+	newKey, err := hintKey(node, hint.Timestamp)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(key)
+	batch.Put(newKey, value)
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	if err := u.db.Write(batch, nil); err != nil {
+		return err
+	}
+	u.account(node, 1, int64(len(value)))
+	u.trim(node)
+	return nil
+}
+
+// skipNode moves the iterator past the hints of the node
+func skipNode(iter iterator.Iterator, node string) bool {
+	return iter.Seek(append([]byte(node), hintSeparator+1))
 }
@@ -0,0 +1,213 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/radek-ryckowski/ssdc/cluster"
+	pb "github.com/radek-ryckowski/ssdc/proto/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// fakeService records the writes replayed to it, calls not implemented here panic
+type fakeService struct {
+	pb.CacheServiceClient
+	sets []*pb.SetRequest
+}
+
+func (f *fakeService) Set(ctx context.Context, in *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+	f.sets = append(f.sets, in)
+	return &pb.SetResponse{Success: true}, nil
+}
+
+func newTestUpdater(t *testing.T, path string) *Updater {
+	u := New(path)
+	if u == nil {
+		t.Fatalf("Failed to open the sync log")
+	}
+	t.Cleanup(func() { u.db.Close() })
+	return u
+}
+
+func hintSize(t *testing.T, hint *pb.Hint) int64 {
+	data, err := proto.Marshal(hint)
+	assert.NoError(t, err)
+	return int64(len(data))
+}
+
+func TestReplayCountsBacklog(t *testing.T) {
+	u := newTestUpdater(t, t.TempDir())
+	for _, uuid := range []string{"a", "b"} {
+		assert.NoError(t, u.AddHint("replay", &pb.Hint{Uuid: uuid, Version: 7}))
+	}
+	hints, _ := u.Backlog("replay")
+	assert.Equal(t, 2, hints)
+	assert.Equal(t, 2.0, testutil.ToFloat64(hintBacklog.WithLabelValues("replay")))
+
+	replayed := testutil.ToFloat64(hintsReplayed.WithLabelValues("replay"))
+	service := &fakeService{}
+	u.UpdatePeer(&cluster.CacheClient{Node: "replay", Address: "peer", Active: true, ServiceClient: service})
+	u.WalkAndSend()
+	if assert.Len(t, service.sets, 2) {
+		assert.Equal(t, "a", service.sets[0].Uuid)
+		assert.Equal(t, int64(7), service.sets[0].Version)
+	}
+	hints, size := u.Backlog("replay")
+	assert.Zero(t, hints)
+	assert.Zero(t, size)
+	assert.Equal(t, 0.0, testutil.ToFloat64(hintBacklog.WithLabelValues("replay")))
+	assert.Equal(t, replayed+2, testutil.ToFloat64(hintsReplayed.WithLabelValues("replay")))
+}
+
+func TestExpireDeadLettersOldHints(t *testing.T) {
+	u := newTestUpdater(t, t.TempDir())
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+	assert.NoError(t, u.AddHint("expire", &pb.Hint{Uuid: "old", Timestamp: old}))
+	assert.NoError(t, u.AddHint("expire", &pb.Hint{Uuid: "new"}))
+	u.Expire()
+	assert.Greater(t, testutil.ToFloat64(hintOldestAge.WithLabelValues("expire")), time.Hour.Seconds())
+
+	evicted := testutil.ToFloat64(hintsEvicted.WithLabelValues("expire", evictExpired))
+	u.SetLimits(Limits{MaxAge: time.Hour, DeadLetter: true})
+	u.Expire()
+	hints, _ := u.Backlog("expire")
+	assert.Equal(t, 1, hints)
+	assert.Less(t, testutil.ToFloat64(hintOldestAge.WithLabelValues("expire")), time.Hour.Seconds())
+	assert.Equal(t, evicted+1, testutil.ToFloat64(hintsEvicted.WithLabelValues("expire", evictExpired)))
+	dead, err := u.DeadLetters("expire")
+	assert.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, "old", dead[0].Uuid)
+	}
+
+	// dead letters are not replayed
+	service := &fakeService{}
+	u.UpdatePeer(&cluster.CacheClient{Node: "expire", Address: "peer", Active: true, ServiceClient: service})
+	u.WalkAndSend()
+	if assert.Len(t, service.sets, 1) {
+		assert.Equal(t, "new", service.sets[0].Uuid)
+	}
+}
+
+func TestSizeLimitDropsOldestHints(t *testing.T) {
+	u := newTestUpdater(t, t.TempDir())
+	first := &pb.Hint{Uuid: "first", Timestamp: time.Now().UnixNano()}
+	evicted := testutil.ToFloat64(hintsEvicted.WithLabelValues("overflow", evictOverflow))
+	u.SetLimits(Limits{MaxNodeBytes: 2 * hintSize(t, first)})
+	assert.NoError(t, u.AddHint("overflow", first))
+	for _, uuid := range []string{"secnd", "third"} {
+		assert.NoError(t, u.AddHint("overflow", &pb.Hint{Uuid: uuid, Timestamp: first.Timestamp + 1}))
+	}
+	hints, size := u.Backlog("overflow")
+	assert.Equal(t, 2, hints)
+	assert.Equal(t, 2*hintSize(t, first), size)
+	assert.Equal(t, evicted+1, testutil.ToFloat64(hintsEvicted.WithLabelValues("overflow", evictOverflow)))
+	dead, err := u.DeadLetters("overflow")
+	assert.NoError(t, err)
+	assert.Empty(t, dead)
+
+	// the backlog of a reopened sync log is counted from the stored hints
+	u.db.Close()
+	u = newTestUpdater(t, u.Path)
+	hints, size = u.Backlog("overflow")
+	assert.Equal(t, 2, hints)
+	assert.Equal(t, 2*hintSize(t, first), size)
+}
+
+func TestMigrateLegacyHints(t *testing.T) {
+	// a sync log written before hints carried their value: key = uuid + random 4 bytes, value = node number
+	path := t.TempDir()
+	legacy, err := leveldb.OpenFile(path, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, legacy.Put([]byte("first\x00\x01\x00\x02"), nil, nil))
+	assert.NoError(t, legacy.Put([]byte("second\x07\x00\x00\x09"), []byte{1}, nil))
+	assert.NoError(t, legacy.Put([]byte("gone\x01\x02\x03\x04"), []byte{1}, nil))
+	assert.NoError(t, legacy.Close())
+
+	u := newTestUpdater(t, path)
+	service := &fakeService{}
+	u.UpdatePeer(&cluster.CacheClient{Node: "node1", Address: "peer1", Active: true, ServiceClient: service})
+	// legacy hints are kept until they are migrated
+	u.WalkAndSend()
+	assert.Empty(t, service.sets)
+
+	values := map[string][]byte{}
+	for uuid, value := range map[string]string{"first": "one", "second": "two"} {
+		data, err := proto.Marshal(&anypb.Any{TypeUrl: "test", Value: []byte(value)})
+		assert.NoError(t, err)
+		values[uuid] = data
+	}
+	get := func(key []byte) ([]byte, int64, error) {
+		if value, ok := values[string(key)]; ok {
+			return value, 3, nil
+		}
+		return nil, 0, status.Error(codes.NotFound, "not found")
+	}
+	migrated, err := u.MigrateLegacyHints([]string{"peer0", "peer1"}, get)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, migrated)
+	hints, _ := u.Backlog("peer0")
+	assert.Equal(t, 1, hints)
+
+	u.WalkAndSend()
+	if assert.Len(t, service.sets, 1) {
+		assert.Equal(t, "second", service.sets[0].Uuid)
+		assert.Equal(t, []byte("two"), service.sets[0].Value.Value)
+		assert.Equal(t, int64(3), service.sets[0].Version)
+	}
+	// nothing is left to migrate, the hint of the key which is gone was dropped
+	migrated, err = u.MigrateLegacyHints([]string{"peer0", "peer1"}, get)
+	assert.NoError(t, err)
+	assert.Zero(t, migrated)
+	hints, _ = u.Backlog("peer0")
+	assert.Equal(t, 1, hints)
+}
+
+func TestDeadLettersAreBoundedAndPurged(t *testing.T) {
+	u := newTestUpdater(t, t.TempDir())
+	hint := &pb.Hint{Uuid: "first", Timestamp: time.Now().UnixNano()}
+	size := hintSize(t, hint)
+	u.SetLimits(Limits{MaxNodeBytes: size, DeadLetter: true, DeadLetterMaxNodeBytes: 2 * size})
+	for i, uuid := range []string{"first", "secnd", "third", "forth"} {
+		assert.NoError(t, u.AddHint("dead", &pb.Hint{Uuid: uuid, Timestamp: hint.Timestamp + int64(i)}))
+	}
+	// three hints were evicted, a dead letter was dropped to keep them within their bound
+	dead, err := u.DeadLetters("dead")
+	assert.NoError(t, err)
+	assert.Len(t, dead, 2)
+	assert.Equal(t, 2.0, testutil.ToFloat64(hintDeadLetters.WithLabelValues("dead")))
+	assert.Equal(t, float64(2*size), testutil.ToFloat64(hintDeadLetterBytes.WithLabelValues("dead")))
+
+	// the dead letters of a reopened sync log are counted from the stored ones
+	u.db.Close()
+	u = newTestUpdater(t, u.Path)
+	letters, bytes := u.DeadLetterBacklog("dead")
+	assert.Equal(t, 2, letters)
+	assert.Equal(t, 2*size, bytes)
+
+	// dead letters expire counting from their eviction
+	u.SetLimits(Limits{MaxAge: time.Hour, DeadLetterMaxAge: time.Nanosecond})
+	u.Expire()
+	letters, _ = u.DeadLetterBacklog("dead")
+	assert.Zero(t, letters)
+	hints, _ := u.Backlog("dead")
+	assert.Equal(t, 1, hints)
+
+	u.SetLimits(Limits{MaxAge: time.Nanosecond, DeadLetter: true})
+	u.Expire()
+	purged, err := u.PurgeDeadLetters("dead")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	dead, err = u.DeadLetters("dead")
+	assert.NoError(t, err)
+	assert.Empty(t, dead)
+	assert.Equal(t, 0.0, testutil.ToFloat64(hintDeadLetters.WithLabelValues("dead")))
+}